@@ -0,0 +1,49 @@
+package config
+
+import "slices"
+
+// AdminRole 管理员角色，权限依次递增，高级角色拥有低级角色的全部权限
+type AdminRole int
+
+const (
+	RoleNone     AdminRole = iota
+	RoleViewer             //查看统计数据
+	RoleOperator           //清除缓存、修改用户配额
+	RoleOwner              //重载配置、管理封禁
+)
+
+func (r AdminRole) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleOwner:
+		return "owner"
+	}
+	return "none"
+}
+
+// GetAdminRole 查询用户的管理员角色
+//
+// General.AdminUID 视为owner，同一用户出现在多个列表时取最高的角色
+func GetAdminRole(UID int64) AdminRole {
+	cf := Get()
+	if UID == 0 || cf == nil {
+		return RoleNone
+	}
+	switch {
+	case UID == cf.General.AdminUID || slices.Contains(cf.Admin.Owners, UID):
+		return RoleOwner
+	case slices.Contains(cf.Admin.Operators, UID):
+		return RoleOperator
+	case slices.Contains(cf.Admin.Viewers, UID):
+		return RoleViewer
+	}
+	return RoleNone
+}
+
+// HasAdminRole 用户是否拥有role及以上的角色
+func HasAdminRole(UID int64, role AdminRole) bool {
+	return GetAdminRole(UID) >= role
+}
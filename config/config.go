@@ -7,13 +7,44 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
-var cf *Config
+// 当前生效的配置，重新加载时整体替换，避免与读取方产生数据竞争
+var current atomic.Pointer[Config]
+
+const (
+	UpdateModePolling = "polling"
+	UpdateModeWebhook = "webhook"
+)
+
+// 运行模式
+const (
+	RunModeAll    = "all"    //处理Telegram消息并在本地转码
+	RunModeBot    = "bot"    //仅处理Telegram消息，转码任务交由worker
+	RunModeWorker = "worker" //仅从Redis拉取并执行转码任务
+)
+
+// 缓存文件的存储后端
+const (
+	CacheStoreLocal = "local" //本地磁盘
+	CacheStoreS3    = "s3"    //S3兼容的对象存储，多个实例可共享
+	CacheStoreRedis = "redis" //直接存入Redis，仅适合较小的文件
+)
+
+// 缓存的淘汰策略
+const (
+	CacheEvictionLRU = "lru" //优先淘汰最久未使用的，命中时延长有效期
+	CacheEvictionLFU = "lfu" //优先淘汰命中次数最少的，命中时延长有效期
+	CacheEvictionTTL = "ttl" //按保存时间淘汰，命中不影响有效期
+)
+
+// 命令行指定的运行模式，优先于配置文件
+var runModeOverride string
 
 type Config struct {
 	General struct {
-		BotToken                string `yaml:"bot_token"                env:"BOT_TOKEN,required"`
+		BotToken                string `yaml:"bot_token"                env:"BOT_TOKEN"`
 		Language                string `yaml:"language"                 env:"LANGUAGE"           envDefault:"zh-hans"`
 		WorkerNum               int    `yaml:"worker_num"               env:"WORKER_NUM"         envDefault:"2"`
 		DownloadWorkerNum       int    `yaml:"download_worker_num"      env:"DOWNLOAD_WORKER_NUM" envDefault:"3"`
@@ -23,8 +54,71 @@ type Config struct {
 		ProcessTimeout          int    `yaml:"process_timeout"          env:"PROCESS_TIMEOUT"    envDefault:"60"`
 		SupportTGSFile          bool   `yaml:"support_tgs_file"         env:"SUPPORT_TGS_FILE"   envDefault:"false"`
 		MaxAmountPerReq         int    `yaml:"max_amount_per_req"       env:"MAX_AMOUNT_PER_REQ" envDefault:"100"`
+		UpdateMode              string `yaml:"update_mode"              env:"UPDATE_MODE"        envDefault:"polling"`
+		OutputFormat            string `yaml:"output_format"            env:"OUTPUT_FORMAT"      envDefault:"gif"`
+		RunMode                 string `yaml:"run_mode"                 env:"RUN_MODE"           envDefault:"all"`
+		ConvertWorkerNum        int    `yaml:"convert_worker_num"       env:"CONVERT_WORKER_NUM" envDefault:"2"`
+		InlineConvert           bool   `yaml:"inline_convert"           env:"INLINE_CONVERT"     envDefault:"false"`
+		InlineUploadChatID      int64  `yaml:"inline_upload_chat_id"    env:"INLINE_UPLOAD_CHAT_ID" envDefault:"0"`
 	} `yaml:"general" envPrefix:"GENERAL_"`
 
+	BotAPI struct {
+		Endpoint string `yaml:"endpoint" env:"ENDPOINT" envDefault:"https://api.telegram.org"`
+		Local    bool   `yaml:"local"    env:"LOCAL"    envDefault:"false"`
+	} `yaml:"bot_api" envPrefix:"BOT_API_"`
+
+	Download struct {
+		MaxSize int `yaml:"max_size" env:"MAX_SIZE" envDefault:"20"`
+		Retries int `yaml:"retries"  env:"RETRIES"  envDefault:"3"`
+		Timeout int `yaml:"timeout"  env:"TIMEOUT"  envDefault:"60"`
+	} `yaml:"download" envPrefix:"DOWNLOAD_"`
+
+	RateLimit struct {
+		UserRate    float64 `yaml:"user_rate"    env:"USER_RATE"    envDefault:"0.5"`
+		UserBurst   int     `yaml:"user_burst"   env:"USER_BURST"   envDefault:"3"`
+		ChatRate    float64 `yaml:"chat_rate"    env:"CHAT_RATE"    envDefault:"1"`
+		ChatBurst   int     `yaml:"chat_burst"   env:"CHAT_BURST"   envDefault:"5"`
+		GlobalRate  float64 `yaml:"global_rate"  env:"GLOBAL_RATE"  envDefault:"30"`
+		GlobalBurst int     `yaml:"global_burst" env:"GLOBAL_BURST" envDefault:"60"`
+	} `yaml:"rate_limit" envPrefix:"RATE_LIMIT_"`
+
+	Quota struct {
+		Free      QuotaPlan `yaml:"free"      envPrefix:"FREE_"`
+		Supporter QuotaPlan `yaml:"supporter" envPrefix:"SUPPORTER_"`
+		VIP       QuotaPlan `yaml:"vip"       envPrefix:"VIP_"`
+
+		Cost struct {
+			Sticker        int `yaml:"sticker"          env:"STICKER"          envDefault:"1"`
+			Animation      int `yaml:"animation"        env:"ANIMATION"        envDefault:"1"`
+			StickerSetUnit int `yaml:"sticker_set_unit" env:"STICKER_SET_UNIT" envDefault:"10"`
+		} `yaml:"cost" envPrefix:"COST_"`
+	} `yaml:"quota" envPrefix:"QUOTA_"`
+
+	Admin struct {
+		Owners    []int64 `yaml:"owners"    env:"OWNERS"`
+		Operators []int64 `yaml:"operators" env:"OPERATORS"`
+		Viewers   []int64 `yaml:"viewers"   env:"VIEWERS"`
+	} `yaml:"admin" envPrefix:"ADMIN_"`
+
+	Ban struct {
+		AutoBan         bool    `yaml:"auto_ban"          env:"AUTO_BAN"          envDefault:"true"`
+		AutoBanTrips    int     `yaml:"auto_ban_trips"    env:"AUTO_BAN_TRIPS"    envDefault:"10"`
+		AutoBanWindow   int     `yaml:"auto_ban_window"   env:"AUTO_BAN_WINDOW"   envDefault:"60"`
+		AutoBanDuration int     `yaml:"auto_ban_duration" env:"AUTO_BAN_DURATION" envDefault:"3600"`
+		AllowList       []int64 `yaml:"allow_list"        env:"ALLOW_LIST"`
+	} `yaml:"ban" envPrefix:"BAN_"`
+
+	Webhook struct {
+		URL            string `yaml:"url"             env:"URL"`
+		ListenAddr     string `yaml:"listen_addr"     env:"LISTEN_ADDR"     envDefault:":8443"`
+		Path           string `yaml:"path"            env:"PATH"            envDefault:"/webhook"`
+		SecretToken    string `yaml:"secret_token"    env:"SECRET_TOKEN"`
+		MaxConnections int    `yaml:"max_connections" env:"MAX_CONNECTIONS" envDefault:"40"`
+		TLS            bool   `yaml:"tls"             env:"TLS"             envDefault:"false"`
+		CertFile       string `yaml:"cert_file"       env:"CERT_FILE"`
+		KeyFile        string `yaml:"key_file"        env:"KEY_FILE"`
+	} `yaml:"webhook" envPrefix:"WEBHOOK_"`
+
 	Community struct {
 		Enable          bool `yaml:"enable"            env:"ENABLE"            envDefault:"true"`
 		ForceChannelSub bool `yaml:"force_channel_sub" env:"FORCE_CHANNEL_SUB" envDefault:"true"`
@@ -39,12 +133,51 @@ type Config struct {
 		} `yaml:"reward" envPrefix:"REWARD_"`
 	} `yaml:"community" envPrefix:"COMMUNITY_"`
 
+	Metrics struct {
+		Enable     bool   `yaml:"enable"      env:"ENABLE"      envDefault:"false"`
+		ListenAddr string `yaml:"listen_addr" env:"LISTEN_ADDR" envDefault:":9091"`
+		Path       string `yaml:"path"        env:"PATH"        envDefault:"/metrics"`
+	} `yaml:"metrics" envPrefix:"METRICS_"`
+
+	Dashboard struct {
+		Enable     bool   `yaml:"enable"      env:"ENABLE"      envDefault:"false"`
+		ListenAddr string `yaml:"listen_addr" env:"LISTEN_ADDR" envDefault:"127.0.0.1:9092"`
+		Token      string `yaml:"token"       env:"TOKEN"`
+	} `yaml:"dashboard" envPrefix:"DASHBOARD_"`
+
+	Group struct {
+		Enable     bool    `yaml:"enable"      env:"ENABLE"      envDefault:"false"`
+		DailyLimit int     `yaml:"daily_limit" env:"DAILY_LIMIT" envDefault:"30"`
+		AllowList  []int64 `yaml:"allow_list"  env:"ALLOW_LIST"`
+		DenyList   []int64 `yaml:"deny_list"   env:"DENY_LIST"`
+	} `yaml:"group" envPrefix:"GROUP_"`
+
 	Cache struct {
 		Enabled            bool   `yaml:"enabled"              env:"ENABLED"              envDefault:"false"`
 		StorageDir         string `yaml:"storage_dir"          env:"STORAGE_DIR"          envDefault:"./storage/cache"`
 		MaxDiskUsage       int    `yaml:"max_disk_usage"       env:"MAX_DISK_USAGE"       envDefault:"1024"`
 		CacheExpire        int    `yaml:"cache_expire"         env:"CACHE_EXPIRE"         envDefault:"86400"`
 		CacheCleanInterval int    `yaml:"cache_clean_interval" env:"CACHE_CLEAN_INTERVAL" envDefault:"1800"`
+		Store              string `yaml:"store"                env:"STORE"                envDefault:"local"`
+		RedisBlobMaxSize   int    `yaml:"redis_blob_max_size"  env:"REDIS_BLOB_MAX_SIZE"  envDefault:"512"`
+		EvictionPolicy     string `yaml:"eviction_policy"      env:"EVICTION_POLICY"      envDefault:"lru"`
+		S3                 struct {
+			Endpoint  string `yaml:"endpoint"   env:"ENDPOINT"`
+			Region    string `yaml:"region"     env:"REGION"     envDefault:"us-east-1"`
+			Bucket    string `yaml:"bucket"     env:"BUCKET"`
+			AccessKey string `yaml:"access_key" env:"ACCESS_KEY"`
+			SecretKey string `yaml:"secret_key" env:"SECRET_KEY"`
+			Prefix    string `yaml:"prefix"     env:"PREFIX"`
+		} `yaml:"s3" envPrefix:"S3_"`
+		Warmup struct {
+			Enabled     bool `yaml:"enabled"       env:"ENABLED"       envDefault:"false"`
+			TopSets     int  `yaml:"top_sets"      env:"TOP_SETS"      envDefault:"10"`
+			Days        int  `yaml:"days"          env:"DAYS"          envDefault:"7"`
+			Interval    int  `yaml:"interval"      env:"INTERVAL"      envDefault:"3600"`
+			StartHour   int  `yaml:"start_hour"    env:"START_HOUR"    envDefault:"2"`
+			EndHour     int  `yaml:"end_hour"      env:"END_HOUR"      envDefault:"6"`
+			MaxQueueLen int  `yaml:"max_queue_len" env:"MAX_QUEUE_LEN" envDefault:"0"`
+		} `yaml:"warmup" envPrefix:"WARMUP_"`
 	} `yaml:"cache" envPrefix:"CACHE_"`
 
 	Logger struct {
@@ -62,7 +195,15 @@ type Config struct {
 	} `yaml:"redis" envPrefix:"REDIS_"`
 }
 
+// QuotaPlan 配额方案在各统计窗口内可使用的次数，0表示不限制
+type QuotaPlan struct {
+	Daily   int `yaml:"daily"   env:"DAILY"`
+	Weekly  int `yaml:"weekly"  env:"WEEKLY"`
+	Monthly int `yaml:"monthly" env:"MONTHLY"`
+}
+
 func Init() {
+	cf := new(Config)
 	if !isExist("./config.yaml") {
 		if isExist("./.env") {
 			log.Println("Loading .env file")
@@ -70,7 +211,6 @@ func Init() {
 		}
 
 		log.Println("Loading configuration from environment variables")
-		cf = new(Config)
 		if err := env.Parse(cf); err != nil {
 			log.Fatalln("failed to parse environment variables:", err)
 		}
@@ -82,7 +222,6 @@ func Init() {
 			log.Fatalln("failed to load config.yaml", err)
 		}
 
-		cf = new(Config)
 		err = yaml.Unmarshal(data, cf)
 		if err != nil {
 			log.Fatalln("failed to parse config.yaml", err)
@@ -94,6 +233,156 @@ func Init() {
 		log.Fatalln("General.MaxAmountPerReq should NOT be 0")
 	}
 
+	//update mode
+	switch cf.General.UpdateMode {
+	case "":
+		cf.General.UpdateMode = UpdateModePolling
+	case UpdateModePolling:
+	case UpdateModeWebhook:
+		if cf.Webhook.TLS && (cf.Webhook.CertFile == "" || cf.Webhook.KeyFile == "") {
+			log.Fatalln("Webhook.TLS is enabled, but Webhook.CertFile or Webhook.KeyFile is empty")
+		}
+		//update中的用户ID用于权限判断，不校验来源时任何人都可伪造管理员的消息
+		if cf.Webhook.SecretToken == "" {
+			log.Fatalln("Webhook.SecretToken is required in webhook mode")
+		}
+		if !isValidSecretToken(cf.Webhook.SecretToken) {
+			log.Fatalln("Webhook.SecretToken should be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+		}
+	default:
+		log.Fatalln("General.UpdateMode should be \"polling\" or \"webhook\"")
+	}
+
+	//run mode
+	if runModeOverride != "" {
+		cf.General.RunMode = runModeOverride
+	}
+	switch cf.General.RunMode {
+	case "":
+		cf.General.RunMode = RunModeAll
+	case RunModeAll, RunModeBot:
+	case RunModeWorker:
+		//worker不访问Telegram，无需BotToken
+		if cf.General.ConvertWorkerNum <= 0 {
+			log.Fatalln("General.ConvertWorkerNum should be greater than 0 in worker mode")
+		}
+	default:
+		log.Fatalln("General.RunMode should be \"all\", \"bot\" or \"worker\"")
+	}
+	if cf.General.RunMode != RunModeWorker && cf.General.BotToken == "" {
+		log.Fatalln("General.BotToken is required")
+	}
+
+	//rate limit
+	if cf.RateLimit.UserRate <= 0 || cf.RateLimit.UserBurst <= 0 {
+		cf.RateLimit.UserRate, cf.RateLimit.UserBurst = 0.5, 3
+	}
+	if cf.RateLimit.ChatRate <= 0 || cf.RateLimit.ChatBurst <= 0 {
+		cf.RateLimit.ChatRate, cf.RateLimit.ChatBurst = 1, 5
+	}
+	if cf.RateLimit.GlobalRate <= 0 || cf.RateLimit.GlobalBurst <= 0 {
+		cf.RateLimit.GlobalRate, cf.RateLimit.GlobalBurst = 30, 60
+	}
+
+	//quota
+	if cf.Quota.Free.Daily == 0 {
+		cf.Quota.Free.Daily = cf.General.UserDailyLimit
+	}
+	if cf.Quota.Cost.Sticker <= 0 {
+		cf.Quota.Cost.Sticker = 1
+	}
+	if cf.Quota.Cost.Animation <= 0 {
+		cf.Quota.Cost.Animation = 1
+	}
+	if cf.Quota.Cost.StickerSetUnit <= 0 {
+		cf.Quota.Cost.StickerSetUnit = 10
+	}
+
+	//ban
+	if cf.Ban.AutoBan && (cf.Ban.AutoBanTrips <= 0 || cf.Ban.AutoBanWindow <= 0 || cf.Ban.AutoBanDuration <= 0) {
+		log.Fatalln("Ban.AutoBanTrips, Ban.AutoBanWindow and Ban.AutoBanDuration should be greater than 0")
+	}
+
+	//inline
+	if cf.General.InlineConvert && cf.General.InlineUploadChatID == 0 {
+		log.Fatalln("General.InlineUploadChatID is required when General.InlineConvert is enabled")
+	}
+
+	//bot api
+	cf.BotAPI.Endpoint = strings.TrimRight(cf.BotAPI.Endpoint, "/")
+	if cf.BotAPI.Endpoint == "" {
+		cf.BotAPI.Endpoint = "https://api.telegram.org"
+	}
+
+	//download
+	if cf.Download.MaxSize <= 0 {
+		cf.Download.MaxSize = 20
+	}
+	if cf.Download.Retries < 0 {
+		cf.Download.Retries = 0
+	}
+	if cf.Download.Timeout <= 0 {
+		cf.Download.Timeout = 60
+	}
+
+	//cache store
+	switch cf.Cache.Store {
+	case "":
+		cf.Cache.Store = CacheStoreLocal
+	case CacheStoreLocal:
+	case CacheStoreS3:
+		if cf.Cache.S3.Endpoint == "" || cf.Cache.S3.Bucket == "" {
+			log.Fatalln("Cache.S3.Endpoint and Cache.S3.Bucket should NOT be empty")
+		}
+		if cf.Cache.S3.Region == "" {
+			cf.Cache.S3.Region = "us-east-1"
+		}
+	case CacheStoreRedis:
+		if cf.Cache.RedisBlobMaxSize <= 0 {
+			cf.Cache.RedisBlobMaxSize = 512
+		}
+	default:
+		log.Fatalln("Cache.Store should be \"local\", \"s3\" or \"redis\"")
+	}
+
+	//cache eviction
+	switch cf.Cache.EvictionPolicy {
+	case "":
+		cf.Cache.EvictionPolicy = CacheEvictionLRU
+	case CacheEvictionLRU, CacheEvictionLFU, CacheEvictionTTL:
+	default:
+		log.Fatalln("Cache.EvictionPolicy should be \"lru\", \"lfu\" or \"ttl\"")
+	}
+
+	//cache warmup
+	if cf.Cache.Warmup.TopSets <= 0 {
+		cf.Cache.Warmup.TopSets = 10
+	}
+	if cf.Cache.Warmup.Days <= 0 {
+		cf.Cache.Warmup.Days = 7
+	}
+	if cf.Cache.Warmup.Interval <= 0 {
+		cf.Cache.Warmup.Interval = 3600
+	}
+	if cf.Cache.Warmup.Enabled {
+		if cf.Cache.Enabled == false {
+			log.Fatalln("Cache.Warmup requires Cache.Enabled")
+		}
+		if cf.Cache.Warmup.StartHour < 0 || cf.Cache.Warmup.StartHour > 23 || cf.Cache.Warmup.EndHour < 0 || cf.Cache.Warmup.EndHour > 23 {
+			log.Fatalln("Cache.Warmup.StartHour and Cache.Warmup.EndHour should be between 0 and 23")
+		}
+	}
+
+	//dashboard
+	if cf.Dashboard.Enable && len(cf.Dashboard.Token) < 16 {
+		log.Fatalln("Dashboard.Token should be at least 16 characters")
+	}
+
+	//group
+	if cf.Group.Enable && cf.Group.DailyLimit <= 0 {
+		log.Fatalln("Group.DailyLimit should be greater than 0")
+	}
+
 	//community
 	if cf.Community.Enable {
 		if cf.Community.Channel.Username == "" || cf.Community.Channel.Username == "@your_channel" {
@@ -106,10 +395,18 @@ func Init() {
 			log.Println("[WARN] You have enabled channel subscription rewards, but the number of rewards you set is 0")
 		}
 	}
+
+	current.Store(cf)
 }
 
+// SetRunMode 使用命令行参数覆盖运行模式，需在Init之前调用
+func SetRunMode(mode string) {
+	runModeOverride = mode
+}
+
+// Get 返回当前生效的配置，调用方不应修改
 func Get() *Config {
-	return cf
+	return current.Load()
 }
 
 func isExist(path string) bool {
@@ -119,3 +416,16 @@ func isExist(path string) bool {
 	}
 	return true
 }
+
+// 校验secret_token，Telegram仅允许1-256位的A-Z、a-z、0-9、_和-
+func isValidSecretToken(token string) bool {
+	if len(token) == 0 || len(token) > 256 {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
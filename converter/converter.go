@@ -0,0 +1,99 @@
+// Package converter 转码任务的分发
+//
+// all模式下转码在本地执行；bot模式下转码任务经Redis交由worker进程执行，
+// 输入及输出文件随任务一同传输，worker无需访问Telegram。
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/metrics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"os"
+	"time"
+)
+
+// JobQueue 转码任务队列名
+const JobQueue = "Convert"
+
+func init() {
+	metrics.RegisterJobQueue(JobQueue)
+}
+
+type convertJob struct {
+	InputExtension string               `json:"input_extension"`
+	Input          []byte               `json:"input"`
+	PreserveJson   bool                 `json:"preserve_json"`
+	Options        utils.ConvertOptions `json:"options"`
+}
+
+type convertResult struct {
+	Error  string `json:"error"`
+	Output []byte `json:"output"`
+	Json   []byte `json:"json"`
+}
+
+// Convert 执行转码任务
+//
+// bot模式下提交给worker并等待结果，其余模式直接在本地执行
+func Convert(ctx context.Context, task *utils.ConvertTask) error {
+	start := time.Now()
+	var err error
+	if config.Get().General.RunMode != config.RunModeBot {
+		err = task.Run(ctx)
+	} else {
+		err = submit(ctx, task)
+	}
+	metrics.ObserveConvert(task.InputExtension, time.Since(start), err)
+	return err
+}
+
+func submit(ctx context.Context, task *utils.ConvertTask) error {
+	input, err := os.ReadFile(task.InputFilePath)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(convertJob{
+		InputExtension: task.InputExtension,
+		Input:          input,
+		PreserveJson:   task.PreserveJsonPath != "",
+		Options:        task.ConvertOptions,
+	})
+	if err != nil {
+		return err
+	}
+	id, err := db.PushJob(JobQueue, payload)
+	if err != nil {
+		return err
+	}
+
+	data, err := db.WaitJobResult(ctx, JobQueue, id)
+	if err != nil {
+		//超时或被取消，避免worker继续处理无人接收的任务
+		if cancelErr := db.CancelJob(JobQueue, id); cancelErr != nil {
+			logger.Error.Println("[converter]failed to cancel job:", cancelErr)
+		}
+		return err
+	}
+	result := new(convertResult)
+	if err = json.Unmarshal(data, result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+
+	if err = os.WriteFile(task.OutputFilePath, result.Output, 0644); err != nil {
+		return err
+	}
+	if task.PreserveJsonPath != "" && result.Json != nil {
+		if err = os.WriteFile(task.PreserveJsonPath, result.Json, 0644); err != nil {
+			logger.Warn.Printf("failed to preserve JSON to %s: %v", task.PreserveJsonPath, err)
+		}
+	}
+	return nil
+}
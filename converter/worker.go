@@ -0,0 +1,177 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/metrics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// 任务的可见性超时，处理期间定期续期
+const jobVisibility = 30 * time.Second
+
+// 队列为空时的轮询间隔
+const pollInterval = 500 * time.Millisecond
+
+// Start 启动num个worker，返回的channel在所有worker退出后关闭
+//
+// ctx被取消后，正在处理的任务将重新入队
+func Start(ctx context.Context, num int) <-chan struct{} {
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(ctx)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		job, err := db.ReserveJob(JobQueue, jobVisibility)
+		if err != nil {
+			if !errors.Is(err, db.ErrorQueueEmpty) {
+				logger.Error.Println("[converter]failed to reserve job:", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		process(ctx, job)
+	}
+}
+
+func process(ctx context.Context, job *db.Job) {
+	cj := new(convertJob)
+	if err := json.Unmarshal(job.Payload, cj); err != nil {
+		//无法解析的任务重试也没有意义，直接丢弃
+		logger.Error.Printf("[converter]invalid job %s: %v", job.ID, err)
+		if err = job.Ack(); err != nil {
+			logger.Error.Println("[converter]failed to ack job:", err)
+		}
+		return
+	}
+
+	//处理期间续期，防止被其他worker重复领取；任务已被提交者取消时停止处理
+	runCtx, stopRun := context.WithCancelCause(ctx)
+	go keepAlive(runCtx, job, stopRun)
+
+	result := run(runCtx, cj)
+	stopRun(nil)
+	if errors.Is(context.Cause(runCtx), db.ErrorNotFound) {
+		logger.Info.Printf("[converter]job %s is no longer in the queue, result discarded", job.ID)
+		return
+	}
+
+	//程序退出导致的失败交给其他worker重试
+	if ctx.Err() != nil {
+		if err := job.Nack(); err != nil {
+			logger.Error.Println("[converter]failed to requeue job:", err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Error.Println("[converter]failed to encode result:", err)
+		return
+	}
+	if err = db.PushJobResult(JobQueue, job.ID, data); err != nil {
+		logger.Error.Println("[converter]failed to push result:", err)
+		return
+	}
+	if err = job.Ack(); err != nil {
+		logger.Error.Println("[converter]failed to ack job:", err)
+	}
+}
+
+func run(ctx context.Context, cj *convertJob) *convertResult {
+	result := new(convertResult)
+	name := utils.RandString()
+	inPath := fmt.Sprintf("./storage/tmp/worker_%s.%s", name, cj.InputExtension)
+	if err := os.WriteFile(inPath, cj.Input, 0644); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer utils.RemoveFile(inPath)
+
+	opts := cj.Options.ForInput(cj.InputExtension)
+	task := utils.ConvertTask{
+		InputFilePath:  inPath,
+		InputExtension: cj.InputExtension,
+		OutputFilePath: fmt.Sprintf("./storage/tmp/worker_%s_out.%s", name, opts.OutputFormat.Ext()),
+		ConvertOptions: opts,
+	}
+	if cj.PreserveJson {
+		task.PreserveJsonPath = task.OutputFilePath + ".json"
+		defer utils.RemoveFile(task.PreserveJsonPath)
+	}
+	defer utils.RemoveFile(task.OutputFilePath)
+
+	timeout := config.Get().General.ProcessTimeout
+	if timeout == 0 {
+		timeout = 60
+	}
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	start := time.Now()
+	err := task.Run(runCtx)
+	cancel()
+	metrics.ObserveConvert(cj.InputExtension, time.Since(start), err)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if result.Output, err = os.ReadFile(task.OutputFilePath); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if cj.PreserveJson {
+		result.Json, _ = os.ReadFile(task.PreserveJsonPath)
+	}
+	return result
+}
+
+func keepAlive(ctx context.Context, job *db.Job, abandon context.CancelCauseFunc) {
+	ticker := time.NewTicker(jobVisibility / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := job.Extend(jobVisibility)
+			if errors.Is(err, db.ErrorNotFound) {
+				abandon(err)
+				return
+			}
+			if err != nil {
+				logger.Warn.Printf("[converter]failed to extend job %s: %v", job.ID, err)
+			}
+		}
+	}
+}
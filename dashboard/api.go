@@ -0,0 +1,162 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 每页返回的缓存记录数上限
+const maxCachePageSize = 200
+
+func overview(w http.ResponseWriter, r *http.Request) {
+	usage, max := db.CacheDiskUsage()
+	data := map[string]interface{}{
+		"wait_queue_length":   db.QueueLen(),
+		"sender_queue_length": utils.SendQueueLen(),
+		"cache_enabled":       config.Get().Cache.Enabled,
+		"cache_disk_usage":    usage,
+		"cache_disk_max":      max,
+	}
+	if statistics.Statistics != nil {
+		data["statistics"] = statistics.Statistics.Counters()
+		data["statistics_start"] = statistics.Statistics.StartTime.Unix()
+	}
+	writeJson(w, data)
+}
+
+func queue(w http.ResponseWriter, r *http.Request) {
+	items, err := db.QueueItems()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, items)
+}
+
+func cacheList(w http.ResponseWriter, r *http.Request) {
+	cursor, _ := strconv.ParseUint(r.URL.Query().Get("cursor"), 10, 64)
+	count, _ := strconv.ParseInt(r.URL.Query().Get("count"), 10, 64)
+	if count <= 0 || count > maxCachePageSize {
+		count = 50
+	}
+	items, next, err := db.ListStickerCache(cursor, count)
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"items":  items,
+		"cursor": strconv.FormatUint(next, 10),
+	})
+}
+
+func cacheClean(w http.ResponseWriter, r *http.Request) {
+	if err := db.CleanCache(); err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	logger.Info.Println("[dashboard]cache cleaned by", r.RemoteAddr)
+	usage, max := db.CacheDiskUsage()
+	writeJson(w, map[string]int64{"cache_disk_usage": usage, "cache_disk_max": max})
+}
+
+func cacheClear(w http.ResponseWriter, r *http.Request) {
+	out, err := db.ClearCache()
+	if err != nil {
+		writeCacheError(w, err)
+		return
+	}
+	logger.Info.Println("[dashboard]cache cleared by", r.RemoteAddr)
+	writeJson(w, map[string]string{"result": out})
+}
+
+func userGet(w http.ResponseWriter, r *http.Request) {
+	UID, err := strconv.ParseInt(r.PathValue("uid"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid uid")
+		return
+	}
+	writeJson(w, userQuota(UID))
+}
+
+func userSet(w http.ResponseWriter, r *http.Request) {
+	UID, err := strconv.ParseInt(r.PathValue("uid"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid uid")
+		return
+	}
+
+	//方案，plan_days为0时永久有效
+	if plan := r.PostFormValue("plan"); plan != "" {
+		days, _ := strconv.Atoi(r.PostFormValue("plan_days"))
+		if err = db.SetPlan(UID, plan, time.Duration(max(days, 0))*24*time.Hour); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger.Info.Printf("[dashboard]set plan of %d to %s(%dd) by %s", UID, plan, days, r.RemoteAddr)
+	}
+
+	//已使用次数
+	if window := r.PostFormValue("window"); window != "" {
+		used, err := strconv.Atoi(r.PostFormValue("used"))
+		if err != nil || used < 0 {
+			writeError(w, http.StatusBadRequest, "invalid used")
+			return
+		}
+		if err = db.SetUsed(UID, window, used); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger.Info.Printf("[dashboard]set %s used of %d to %d by %s", window, UID, used, r.RemoteAddr)
+	}
+	writeJson(w, userQuota(UID))
+}
+
+func userQuota(UID int64) map[string]interface{} {
+	planExpire := int64(-1)
+	if ttl := db.GetPlanExpire(UID); ttl > 0 {
+		planExpire = int64(ttl.Seconds())
+	}
+	return map[string]interface{}{
+		"uid":         UID,
+		"plan":        db.GetPlan(UID),
+		"plan_expire": planExpire,
+		"windows":     db.GetUsage(UID),
+	}
+}
+
+func reload(w http.ResponseWriter, r *http.Request) {
+	config.Init()
+	languages.Init()
+	logger.Info.Println("[dashboard]config reloaded by", r.RemoteAddr)
+	writeJson(w, map[string]bool{"ok": true})
+}
+
+func writeCacheError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.CacheErrorDisabled) {
+		writeError(w, http.StatusConflict, "cache is disabled")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,168 @@
+// Package dashboard 网页管理后台
+//
+// 提供等待队列、缓存、用户使用次数的查看与修改，所有接口均需令牌认证
+package dashboard
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"github.com/rroy233/StickerDownloader/config"
+	"gopkg.in/rroy233/logger.v2"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+const sessionCookieName = "sd_dashboard_session"
+
+// 登录会话的有效期
+const sessionExpire = 24 * time.Hour
+
+var server *http.Server
+
+// Start 启动管理后台
+func Start() {
+	cf := config.Get().Dashboard
+	if !cf.Enable {
+		return
+	}
+
+	static, _ := fs.Sub(staticFiles, "static")
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.FS(static)))
+	mux.HandleFunc("POST /login", login)
+	mux.HandleFunc("POST /logout", logout)
+	mux.Handle("GET /api/overview", auth(overview))
+	mux.Handle("GET /api/queue", auth(queue))
+	mux.Handle("GET /api/cache", auth(cacheList))
+	mux.Handle("POST /api/cache/clean", auth(cacheClean))
+	mux.Handle("POST /api/cache/clear", auth(cacheClear))
+	mux.Handle("GET /api/user/{uid}", auth(userGet))
+	mux.Handle("POST /api/user/{uid}", auth(userSet))
+	mux.Handle("POST /api/reload", auth(reload))
+
+	server = &http.Server{
+		Addr:              cf.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error.Println("[dashboard]server error:", err)
+		}
+	}()
+	logger.Info.Printf("[dashboard]Listening on %s", cf.ListenAddr)
+}
+
+// Stop 停止管理后台
+func Stop() {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error.Println("[dashboard]failed to shutdown server:", err)
+	}
+}
+
+// 校验令牌，支持 Authorization: Bearer <token> 及登录后写入的会话cookie
+func auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func authorized(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return checkToken(token)
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return checkSession(cookie.Value)
+	}
+	return false
+}
+
+func checkToken(token string) bool {
+	expected := config.Get().Dashboard.Token
+	if expected == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// 会话值为"过期时间.签名"，签名密钥由令牌派生，cookie中不保存令牌本身
+//
+// 修改令牌后已签发的会话随之失效
+func sessionSign(expire int64) string {
+	key := hmac.New(sha256.New, []byte(config.Get().Dashboard.Token))
+	key.Write([]byte("dashboard session"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(strconv.FormatInt(expire, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newSession() (string, time.Time) {
+	expire := time.Now().Add(sessionExpire)
+	return strconv.FormatInt(expire.Unix(), 10) + "." + sessionSign(expire.Unix()), expire
+}
+
+func checkSession(value string) bool {
+	if config.Get().Dashboard.Token == "" {
+		return false
+	}
+	expireStr, sign, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	expire, err := strconv.ParseInt(expireStr, 10, 64)
+	if err != nil || time.Now().Unix() > expire {
+		return false
+	}
+	return hmac.Equal([]byte(sign), []byte(sessionSign(expire)))
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if !checkToken(token) {
+		logger.Warn.Println("[dashboard]login failed from", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	session, expire := newSession()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session,
+		Path:     "/",
+		Expires:  expire,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJson(w, map[string]bool{"ok": true})
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJson(w, map[string]bool{"ok": true})
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rroy233/StickerDownloader/config"
+	"gopkg.in/rroy233/logger.v2"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BanInfo 封禁记录
+type BanInfo struct {
+	UID    int64  `json:"uid"`
+	Reason string `json:"reason"`
+	//UID of the admin, 0 for automatic bans
+	By        int64 `json:"by"`
+	CreatedAt int64 `json:"created_at"`
+	//0 for permanent bans
+	ExpireAt int64 `json:"expire_at"`
+}
+
+func banKey(UID int64) string {
+	return fmt.Sprintf("%s:Ban:%d", ServicePrefix, UID)
+}
+
+// 所有封禁记录的UID，记录过期后由BanList清除
+func banListKey() string {
+	return fmt.Sprintf("%s:BanList", ServicePrefix)
+}
+
+func rateLimitTripsKey(UID int64) string {
+	return fmt.Sprintf("%s:User_%d:RateLimitTrips", ServicePrefix, UID)
+}
+
+// KEYS[1] 计数
+//
+// ARGV[1] 统计窗口(s)
+var incrWithExpireScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// Ban 封禁用户，duration为0时永久封禁
+func Ban(UID int64, duration time.Duration, reason string, by int64) (*BanInfo, error) {
+	info := &BanInfo{
+		UID:       UID,
+		Reason:    reason,
+		By:        by,
+		CreatedAt: time.Now().Unix(),
+	}
+	if duration > 0 {
+		info.ExpireAt = time.Now().Add(duration).Unix()
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, banKey(UID), data, duration)
+		pipe.SAdd(ctx, banListKey(), UID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Unban 解除封禁，返回该用户此前是否处于封禁状态
+func Unban(UID int64) (bool, error) {
+	removed, err := rdb.Del(ctx, banKey(UID)).Result()
+	if err != nil {
+		return false, err
+	}
+	rdb.SRem(ctx, banListKey(), UID)
+	rdb.Del(ctx, rateLimitTripsKey(UID))
+	return removed != 0, nil
+}
+
+// IsBanned 查询用户是否被封禁
+//
+// 查询失败时视为未封禁，避免Redis故障时拒绝所有用户
+func IsBanned(UID int64) bool {
+	if UID <= 0 {
+		return false
+	}
+	n, err := rdb.Exists(ctx, banKey(UID)).Result()
+	if err != nil {
+		logger.Error.Println("[IsBanned]failed to query ban:", err)
+		return false
+	}
+	return n != 0
+}
+
+// BanList 列出所有生效中的封禁，按封禁时间排序
+func BanList() ([]*BanInfo, error) {
+	members, err := rdb.SMembers(ctx, banListKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*BanInfo, 0, len(members))
+	for _, member := range members {
+		UID, _ := strconv.ParseInt(member, 10, 64)
+		data := rdb.Get(ctx, banKey(UID)).Val()
+		if data == "" {
+			//已过期
+			rdb.SRem(ctx, banListKey(), member)
+			continue
+		}
+		info := new(BanInfo)
+		if err := json.Unmarshal([]byte(data), info); err != nil {
+			logger.Error.Println("[BanList]failed to parse ban:", err, data)
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt < list[j].CreatedAt
+	})
+	return list, nil
+}
+
+// 记录一次触发访问频率限制，在统计窗口内达到次数后自动临时封禁
+//
+// 管理员及Ban.AllowList中的用户不会被自动封禁
+func recordRateLimitTrip(UID int64) {
+	cf := config.Get().Ban
+	if !cf.AutoBan || UID <= 0 || config.HasAdminRole(UID, config.RoleViewer) || slices.Contains(cf.AllowList, UID) {
+		return
+	}
+	trips, err := incrWithExpireScript.Run(ctx, rdb, []string{rateLimitTripsKey(UID)}, cf.AutoBanWindow).Int()
+	if err != nil {
+		logger.Error.Println("[recordRateLimitTrip]failed to record:", err)
+		return
+	}
+	if trips < cf.AutoBanTrips {
+		return
+	}
+
+	rdb.Del(ctx, rateLimitTripsKey(UID))
+	duration := time.Duration(cf.AutoBanDuration) * time.Second
+	if _, err = Ban(UID, duration, fmt.Sprintf("auto: rate limit tripped %d times in %ds", trips, cf.AutoBanWindow), 0); err != nil {
+		logger.Error.Println("[recordRateLimitTrip]failed to ban:", err)
+		return
+	}
+	logger.Info.Printf("[recordRateLimitTrip]%d is banned for %s", UID, duration)
+}
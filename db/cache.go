@@ -5,17 +5,19 @@ import (
 	"errors"
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/go-redis/redis/v8"
 	"github.com/rroy233/StickerDownloader/config"
 	"github.com/rroy233/StickerDownloader/statistics"
 	"github.com/rroy233/StickerDownloader/utils"
 	"gopkg.in/rroy233/logger.v2"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var cacheEnabled bool
-var cacheDir string
 var cacheMaxUsage int64
 
 var CacheExpire time.Duration
@@ -26,7 +28,6 @@ var (
 	CacheErrorNotExist     = errors.New("CacheErrorNotExist")
 	CacheErrorVerifyFailed = errors.New("CacheErrorVerifyFailed")
 )
-var cacheLocalDiskUsage int64
 
 func initCache() {
 	if config.Get().Cache.Enabled == false {
@@ -35,14 +36,12 @@ func initCache() {
 	loggerPrefix := "[CacheInit]"
 	cacheEnabled = true
 
-	//check StorageDir
-	if utils.IsExist(config.Get().Cache.StorageDir) == false {
-		err := os.Mkdir(config.Get().Cache.StorageDir, 0755)
-		if err != nil {
-			logger.FATAL.Println(loggerPrefix+"Failed to create cache folder!!", err)
-		}
+	//init store
+	var err error
+	cacheStore, err = newCacheStore()
+	if err != nil {
+		logger.FATAL.Println(loggerPrefix+"Failed to init cache store!!", err)
 	}
-	cacheDir = config.Get().Cache.StorageDir
 
 	//check cacheMaxUsage
 	cacheMaxUsage = int64(config.Get().Cache.MaxDiskUsage << 20)
@@ -58,76 +57,61 @@ func initCache() {
 	CacheExpire = time.Duration(config.Get().Cache.CacheExpire) * time.Second
 	CacheCleanInterval = time.Duration(config.Get().Cache.CacheCleanInterval) * time.Second
 
-	//calculate local disk usage
-	err := cacheGetLocalDiskUsage()
+	//build index
+	err = cacheIndexRebuild()
 	if err != nil {
-		logger.FATAL.Println(loggerPrefix+"Failed to calculate local storage usage:", err)
+		logger.FATAL.Println(loggerPrefix+"Failed to build cache index:", err)
 	}
 
 	//start cleaner
 	go cacheCleaner()
 
-	logger.Info.Printf("Cache Usage %dMB/%dMB", cacheLocalDiskUsage>>20, cacheMaxUsage>>20)
+	logger.Info.Printf("Cache Usage %dMB/%dMB (%s, %s)", cacheUsage()>>20, cacheMaxUsage>>20, config.Get().Cache.Store, config.Get().Cache.EvictionPolicy)
 
 	return
 }
 
-// 删除单个文件的缓存
-func cacheRemove(uniqueID string) {
-	record := rdb.Get(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID))).Val()
-	if record == "" {
-		return
-	}
-
-	err := rdb.Del(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID))).Err()
-	if err != nil {
-		logger.Error.Println("[cacheRemove]rdb.Del error", err)
-		return
-	}
-
-	item := new(StickerItem)
-	err = json.Unmarshal([]byte(record), item)
-	if err != nil {
-		logger.Error.Println("[cacheRemove]json.Unmarshal error", err)
-		return
+// 缓存在redis中的key
+//
+// 默认转码选项沿用旧的key，其余选项在uniqueID后附加Variant
+func stickerCacheKey(uniqueID string, opts utils.ConvertOptions) string {
+	if opts.Variant() == "" {
+		return fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID))
 	}
+	return fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID+"."+opts.Variant()))
+}
 
-	if utils.IsExist(item.SavePath) == true {
-		err = os.Remove(item.SavePath)
-		if err != nil {
-			logger.Error.Println("[cacheRemove]os.Remove error", err)
-			return
-		}
-	}
-	return
+func (si *StickerItem) cacheKey() string {
+	return stickerCacheKey(si.Info.FileUniqueID, si.ConvertOptions)
 }
 
-func cacheGetLocalDiskUsage() error {
-	entries, err := os.ReadDir(cacheDir)
-	if err != nil {
-		return err
+// 缓存文件在存储后端中的名称
+//
+// 旧版本的记录只有本地路径SavePath
+func (si *StickerItem) storeName() string {
+	if si.FileName != "" {
+		return si.FileName
 	}
+	return filepath.Base(si.SavePath)
+}
 
-	sum := int64(0)
-	for _, entry := range entries {
-		info, _ := entry.Info()
-		sum += info.Size()
+// 缓存文件名中时间戳之后的部分
+func (si *StickerItem) fileSuffix() string {
+	if si.Variant() == "" {
+		return utils.MD5(si.Info.FileUniqueID) + "." + si.FileExt
 	}
-
-	cacheLocalDiskUsage = sum
-
-	return nil
+	return utils.MD5(si.Info.FileUniqueID+"."+si.Variant()) + "." + si.FileExt
 }
 
 // FindStickerCache 查询是否有缓存
 // 返回本地文件地址
 //
 // 若不存在，则返回CacheErrorNotExist
-func FindStickerCache(uniqueID string) (string, error) {
+func FindStickerCache(uniqueID string, opts utils.ConvertOptions) (string, error) {
 	if cacheEnabled == false {
 		return "", CacheErrorDisabled
 	}
-	data := rdb.Get(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID))).Val()
+	data := rdb.Get(ctx, stickerCacheKey(uniqueID, opts)).Val()
 	if data == "" {
 		return "", CacheErrorNotExist
 	}
@@ -138,40 +122,53 @@ func FindStickerCache(uniqueID string) (string, error) {
 		return "", CacheErrorNotExist
 	}
 
-	if utils.IsExist(item.SavePath) == false {
+	//复制一份到tmp
+	newFilePath := fmt.Sprintf("./storage/tmp/convert_%s.%s", utils.RandString(), item.FileExt)
+	err = cacheStore.Get(item.storeName(), newFilePath)
+	if err != nil {
+		utils.RemoveFile(newFilePath)
+		if err != CacheErrorNotExist {
+			logger.Error.Println("[FindStickerCache]cacheStore.Get error", err)
+		}
 		return "", CacheErrorNotExist
 	}
 
 	//校验
-	fileMd5, err := utils.MD5File(item.SavePath)
+	fileMd5, err := utils.MD5File(newFilePath)
 	if err != nil {
+		utils.RemoveFile(newFilePath)
 		return "", CacheErrorNotExist
 	}
 	if fileMd5 != item.MD5 {
-		logger.Error.Printf("Cache MD5 mismatch!! redis[%s]=%s localFile[%s]=%s", utils.JsonEncode(item), item.MD5, item.SavePath, fileMd5)
-		cacheRemove(item.Info.FileUniqueID)
+		logger.Error.Printf("Cache MD5 mismatch!! redis[%s]=%s file[%s]=%s", utils.JsonEncode(item), item.MD5, item.storeName(), fileMd5)
+		utils.RemoveFile(newFilePath)
+		cacheEvict(item.cacheKey())
 		return "", CacheErrorVerifyFailed
 	}
 
-	//复制一份到tmp
-	newFilePath := fmt.Sprintf("./storage/tmp/convert_%s.%s", utils.RandString(), item.FileExt)
-	err = utils.CopyFile(item.SavePath, newFilePath)
-	if err != nil {
-		return "", err
-	}
-
+	cacheIndexTouch(item.cacheKey(), 1)
 	return newFilePath, nil
 }
 
+// CacheDiskUsage 查询缓存在存储后端中的占用及上限(B)
+//
+// 未启用缓存时均返回0
+func CacheDiskUsage() (usage int64, max int64) {
+	if cacheEnabled == false {
+		return 0, 0
+	}
+	return cacheUsage(), cacheMaxUsage
+}
+
 // FindStickerCacheItem 查询是否有缓存
 // 返回缓存实例
 //
 // 若不存在，则返回CacheErrorNotExist
-func FindStickerCacheItem(uniqueID string) (*StickerItem, error) {
+func FindStickerCacheItem(uniqueID string, opts utils.ConvertOptions) (*StickerItem, error) {
 	if cacheEnabled == false {
 		return nil, CacheErrorDisabled
 	}
-	data := rdb.Get(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID))).Val()
+	data := rdb.Get(ctx, stickerCacheKey(uniqueID, opts)).Val()
 	if data == "" {
 		return nil, CacheErrorNotExist
 	}
@@ -182,6 +179,7 @@ func FindStickerCacheItem(uniqueID string) (*StickerItem, error) {
 		return nil, CacheErrorNotExist
 	}
 
+	cacheIndexTouch(item.cacheKey(), 1)
 	return item, nil
 }
 
@@ -201,25 +199,133 @@ func ClearCache() (string, error) {
 		return "", CacheErrorDisabled
 	}
 
-	keys := rdb.Keys(ctx, fmt.Sprintf("%s:Sticker_Cache:*", ServicePrefix)).Val()
-	countRedis := len(keys)
-	for _, key := range keys {
-		rdb.Del(ctx, key)
+	countRedis := 0
+	for _, pattern := range []string{"Sticker_Cache", "Source_Cache", "Set_Cache"} {
+		var cursor uint64
+		for {
+			keys, next, err := rdb.Scan(ctx, cursor, fmt.Sprintf("%s:%s:*", ServicePrefix, pattern), cacheEvictBatch).Result()
+			if err != nil {
+				return "", errors.New("scan redis error:" + err.Error())
+			}
+			if len(keys) != 0 {
+				countRedis += int(rdb.Del(ctx, keys...).Val())
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
 	}
 
-	files, err := os.ReadDir(cacheDir)
+	files, err := cacheStore.List()
 	if err != nil {
-		return "", errors.New("read cache dir error:" + err.Error())
+		return "", errors.New("list cache store error:" + err.Error())
 	}
-	countLocal := len(files)
-	for _, file := range files {
-		err := os.Remove(fmt.Sprintf("%s/%s", cacheDir, file.Name()))
+	countLocal := 0
+	for name := range files {
+		if !isCacheFileName(name) {
+			continue
+		}
+		countLocal++
+		err := cacheStore.Delete(name)
 		if err != nil {
 			logger.Error.Println("[ClearCache]Cache remove error:", err)
 		}
 	}
+
+	//重置索引，Usage同时作为重建索引的标记，需保留为0
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, cacheIndexKeys()...)
+	pipe.Set(ctx, cacheIndexKey(cacheIndexUsage), 0, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error.Println("[ClearCache]Failed to reset index:", err)
+	}
+	return fmt.Sprintf("Succeed!\nRemoved %d records from Redis\nRemoved %d files from %s storage!", countRedis, countLocal, config.Get().Cache.Store), nil
+}
+
+// CleanCache 立即执行一次缓存清理
+func CleanCache() error {
+	if cacheEnabled == false {
+		return CacheErrorDisabled
+	}
 	cacheDoClean()
-	return fmt.Sprintf("Succeed!\nRemoved %d records from Redis\nRemoved %d files from localStorage!", countRedis, countLocal), nil
+	return nil
+}
+
+// ListStickerCache 按最近访问时间倒序分页遍历缓存记录
+//
+// cursor为偏移量，0时从头开始，返回的cursor为0表示遍历结束
+//
+// 索引中同时包含原始文件的缓存，只返回转码后的贴纸
+func ListStickerCache(cursor uint64, count int64) ([]*StickerItem, uint64, error) {
+	if cacheEnabled == false {
+		return nil, 0, CacheErrorDisabled
+	}
+	prefix := fmt.Sprintf("%s:Sticker_Cache:", ServicePrefix)
+	items := make([]*StickerItem, 0, count)
+	for int64(len(items)) < count {
+		keys, err := rdb.ZRevRange(ctx, cacheIndexKey(cacheIndexAccess), int64(cursor), int64(cursor)+count-1).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, key := range keys {
+			if int64(len(items)) == count {
+				//本页已满，下次从此处继续
+				return items, cursor + uint64(i), nil
+			}
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			val := rdb.Get(ctx, key).Val()
+			if val == "" {
+				continue
+			}
+			item, err := parseIntoCacheItem(val)
+			if err != nil {
+				continue
+			}
+			items = append(items, item)
+		}
+		if int64(len(keys)) < count {
+			return items, 0, nil
+		}
+		cursor += uint64(len(keys))
+	}
+	return items, cursor, nil
+}
+
+// StickerCacheCoverage 统计贴纸在转码选项opts下已缓存的数量
+func StickerCacheCoverage(stickers []tgbotapi.Sticker, opts utils.ConvertOptions) (int, error) {
+	if cacheEnabled == false {
+		return 0, CacheErrorDisabled
+	}
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.IntCmd, len(stickers))
+	for i, sticker := range stickers {
+		cmds[i] = pipe.Exists(ctx, stickerCacheKey(sticker.FileUniqueID, opts.ForSticker(sticker)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	cached := 0
+	for _, cmd := range cmds {
+		if cmd.Val() != 0 {
+			cached++
+		}
+	}
+	return cached, nil
+}
+
+// KeepStickerCache 更新贴纸缓存的访问时间，避免热门表情包被淘汰
+//
+// 不计入命中次数
+func KeepStickerCache(stickers []tgbotapi.Sticker, opts utils.ConvertOptions) {
+	if cacheEnabled == false {
+		return
+	}
+	for _, sticker := range stickers {
+		cacheIndexTouch(stickerCacheKey(sticker.FileUniqueID, opts.ForSticker(sticker)), 0)
+	}
 }
 
 // Update
@@ -231,28 +337,31 @@ func (si *StickerItem) Update() error {
 		return err
 	}
 
-	err = rdb.Set(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(si.Info.FileUniqueID)), string(data), CacheExpire).Err()
+	err = rdb.Set(ctx, si.cacheKey(), string(data), CacheExpire).Err()
 	return err
 }
 
 // CacheSticker 缓存贴纸
 //
-// 传入tgbotapi.Sticker 和 convertedFilePath已转码文件的地址
-func CacheSticker(sticker tgbotapi.Sticker, convertedFilePath string) (*StickerItem, error) {
+// 传入tgbotapi.Sticker、转码选项opts 和 convertedFilePath已转码文件的地址
+func CacheSticker(sticker tgbotapi.Sticker, opts utils.ConvertOptions, convertedFilePath string) (*StickerItem, error) {
 	if cacheEnabled == false {
 		return nil, errors.New("cache is DISABLED")
 	}
-	data := rdb.Get(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(sticker.FileUniqueID))).Val()
+	data := rdb.Get(ctx, stickerCacheKey(sticker.FileUniqueID, opts)).Val()
 	if data != "" {
 		//cache已存在
 		return parseIntoCacheItem(data)
 	}
+	//记录已过期但尚未被清理时，先删除旧文件及索引
+	cacheEvict(stickerCacheKey(sticker.FileUniqueID, opts))
 
 	item := new(StickerItem)
 	item.Info = sticker
+	item.ConvertOptions = opts
 	item.SaveTimeStamp = time.Now().Unix()
 	item.FileExt = utils.GetFileExtName(convertedFilePath)
-	item.SavePath = fmt.Sprintf("%s/%d_%s.%s", cacheDir, item.SaveTimeStamp, utils.MD5(sticker.FileUniqueID), item.FileExt)
+	item.FileName = fmt.Sprintf("%d_%s", item.SaveTimeStamp, item.fileSuffix())
 
 	stat, err := os.Stat(convertedFilePath)
 	if err != nil {
@@ -266,9 +375,9 @@ func CacheSticker(sticker tgbotapi.Sticker, convertedFilePath string) (*StickerI
 	}
 	item.MD5 = fileMd5
 
-	err = utils.CopyFile(convertedFilePath, item.SavePath)
+	err = cacheStore.Put(item.FileName, convertedFilePath)
 	if err != nil {
-		return nil, errors.New("Failed to copy file:" + err.Error())
+		return nil, errors.New("Failed to store file:" + err.Error())
 	}
 
 	out, err := json.Marshal(item)
@@ -276,12 +385,15 @@ func CacheSticker(sticker tgbotapi.Sticker, convertedFilePath string) (*StickerI
 		return nil, errors.New("json.Marshal(item) error:" + err.Error())
 	}
 
-	err = rdb.Set(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(sticker.FileUniqueID)), string(out), CacheExpire).Err()
+	err = rdb.Set(ctx, item.cacheKey(), string(out), CacheExpire).Err()
 	if err != nil {
 		return nil, errors.New("Failed to store redis:" + err.Error())
 	}
 
-	cacheLocalDiskUsage += item.Size
+	err = cacheIndexAdd(item.cacheKey(), item.SaveTimeStamp, item.Size, item.storeName())
+	if err != nil {
+		logger.Error.Println("[CacheSticker]Failed to add index:", err)
+	}
 	//记录statistic(+)
 	statistics.Statistics.Record("StorageChange", int32(item.Size))
 	return item, nil
@@ -290,10 +402,10 @@ func CacheSticker(sticker tgbotapi.Sticker, convertedFilePath string) (*StickerI
 func cacheCleaner() {
 	old := int64(0)
 	for true {
-		old = cacheLocalDiskUsage
+		old = cacheUsage()
 		cacheDoClean()
-		if cacheLocalDiskUsage != old {
-			logger.Info.Printf("Cache Usage %dMB/%dMB", cacheLocalDiskUsage>>20, cacheMaxUsage>>20)
+		if usage := cacheUsage(); usage != old {
+			logger.Info.Printf("Cache Usage %dMB/%dMB", usage>>20, cacheMaxUsage>>20)
 		}
 		time.Sleep(CacheCleanInterval)
 	}
@@ -301,86 +413,48 @@ func cacheCleaner() {
 
 func cacheDoClean() {
 	loggerPrefix := "[cacheDoClean]"
-	keys := rdb.Keys(ctx, fmt.Sprintf("%s:Sticker_Cache:*", ServicePrefix)).Val()
-
-	//本地文件名后缀的哈希表，若checkMap[localFilenamePrefix]!=0则本地文件有效，无需因过期而清除
-	checkMap := make(map[string]int, len(keys))
-	//本地文件名到stickerItem的映射
-	itemMapByFilename := make(map[string]*StickerItem)
-	val := ""
-	var err error
-	var item *StickerItem
-	for _, key := range keys {
-		item = new(StickerItem)
-		val = rdb.Get(ctx, key).Val()
-		if val == "" {
-			continue
-		}
 
-		err = json.Unmarshal([]byte(val), item)
+	//清除过期的缓存，TTL策略按保存时间，其余按最近访问时间
+	deadline := strconv.FormatInt(time.Now().Add(-CacheExpire).Unix(), 10)
+	last := ""
+	for {
+		keys, err := rdb.ZRangeByScore(ctx, cacheExpireIndex(), &redis.ZRangeBy{Min: "-inf", Max: deadline, Count: cacheEvictBatch}).Result()
 		if err != nil {
-			logger.Error.Println(loggerPrefix+"Failed to parse cache:", err, key, val)
-			continue
+			logger.Error.Println(loggerPrefix+"Failed to read index:", err)
+			return
+		}
+		//未能从索引中移除时避免死循环
+		if len(keys) == 0 || keys[0] == last {
+			break
 		}
-		checkMap[utils.MD5(item.Info.FileUniqueID)+"."+item.FileExt]++
-
-		//查看本地文件是否存在，若不存在，则删除redis对应记录
-		if utils.IsExist(fmt.Sprintf("%s/%d_%s.%s", cacheDir, item.SaveTimeStamp, utils.MD5(item.Info.FileUniqueID), item.FileExt)) == true {
-			//存在
-			itemMapByFilename[fmt.Sprintf("%d_%s.%s", item.SaveTimeStamp, utils.MD5(item.Info.FileUniqueID), item.FileExt)] = item
-		} else {
-			//不存在
-			rdb.Del(ctx, key)
+		last = keys[0]
+		for _, key := range keys {
+			cacheEvict(key)
 		}
 	}
 
-	//读取本地所有文件
-	localEntries, err := os.ReadDir(cacheDir)
-	if len(localEntries) == 0 {
+	//判断是否达到容量阈值，若达到则按淘汰策略清除缓存，直至最大容量的75%
+	if cacheUsage() <= cacheMaxUsage {
 		return
 	}
-	if err != nil {
-		logger.Error.Println(loggerPrefix+"Failed to read local files:", err)
-		return
-	}
-
-	//遍历所有本地文件，若在redis中不存在，则删除本地文件
-	for _, entry := range localEntries {
-		if strings.Contains(entry.Name(), "_") == false {
-			continue
+	target := int64(float64(cacheMaxUsage) * 0.75)
+	last = ""
+	for cacheUsage() >= target {
+		keys, err := rdb.ZRange(ctx, cacheEvictionIndex(), 0, cacheEvictBatch-1).Result()
+		if err != nil {
+			logger.Error.Println(loggerPrefix+"Failed to read index:", err)
+			return
 		}
-		if checkMap[strings.Split(entry.Name(), "_")[1]] == 0 {
-			utils.RemoveFile(fmt.Sprintf("%s/%s", cacheDir, entry.Name()))
-			itemMapByFilename[entry.Name()] = nil
-			//读取文件大小，记录statistic(-)
-			info, err := entry.Info()
-			if err == nil {
-				statistics.Statistics.Record("StorageChange", -1*int32(info.Size()))
-			}
+		if len(keys) == 0 || keys[0] == last {
+			break
 		}
-	}
-
-	//判断是否达到容量阈值，若达到则清除旧缓存文件，直至最大容量的75%
-	err = cacheGetLocalDiskUsage()
-	if err != nil {
-		logger.Error.Println(loggerPrefix+"cacheGetLocalDiskUsage error", err)
-		return
-	}
-	if cacheLocalDiskUsage > cacheMaxUsage {
-		for i := 0; i < len(localEntries); i++ {
-			if cacheLocalDiskUsage < int64(float64(cacheMaxUsage)*0.75) {
+		last = keys[0]
+		for _, key := range keys {
+			cacheEvict(key)
+			if cacheUsage() < target {
 				break
 			}
-			item := itemMapByFilename[localEntries[i].Name()]
-			if item != nil {
-				utils.RemoveFile(item.SavePath)
-				rdb.Del(ctx, fmt.Sprintf("%s:Sticker_Cache:%s", ServicePrefix, utils.MD5Short(item.Info.FileUniqueID)))
-				cacheLocalDiskUsage -= item.Size
-				//记录statistic(-)
-				statistics.Statistics.Record("StorageChange", -1*int32(item.Size))
-			}
 		}
 	}
-	_ = cacheGetLocalDiskUsage()
 	return
 }
@@ -0,0 +1,275 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"gopkg.in/rroy233/logger.v2"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// 缓存索引，成员为转码后文件及原始文件的缓存在redis中的key
+//
+// 有序集合Access、Hits、Saved的分数分别为最近访问时间、命中次数、保存时间；
+// 哈希表Size、File记录文件大小及在存储后端中的名称，Usage为所有文件的总大小
+const (
+	cacheIndexAccess = "Access"
+	cacheIndexHits   = "Hits"
+	cacheIndexSaved  = "Saved"
+	cacheIndexSize   = "Size"
+	cacheIndexFile   = "File"
+	cacheIndexUsage  = "Usage"
+)
+
+// 每次从索引中取出的候选数量
+const cacheEvictBatch = 100
+
+// 缓存文件的命名规则：<保存时间>_<md5>[.source].<扩展名>
+//
+// 存储后端可能与其他程序共用(如未设置前缀的S3存储桶)，只删除符合规则的文件
+var cacheFileNameRegexp = regexp.MustCompile(`^\d+_[0-9a-f]{32}(\.source)?\.[0-9A-Za-z]+$`)
+
+func isCacheFileName(name string) bool {
+	return cacheFileNameRegexp.MatchString(name)
+}
+
+func cacheIndexKey(name string) string {
+	return fmt.Sprintf("%s:Cache_Index:%s", ServicePrefix, name)
+}
+
+// 脚本使用的KEYS，顺序与上述常量一致
+func cacheIndexKeys() []string {
+	return []string{
+		cacheIndexKey(cacheIndexAccess),
+		cacheIndexKey(cacheIndexHits),
+		cacheIndexKey(cacheIndexSaved),
+		cacheIndexKey(cacheIndexSize),
+		cacheIndexKey(cacheIndexFile),
+		cacheIndexKey(cacheIndexUsage),
+	}
+}
+
+// KEYS 同cacheIndexKeys
+//
+// ARGV[1] 缓存key ARGV[2] 保存时间 ARGV[3] 文件大小 ARGV[4] 文件名
+//
+// 返回更新后的总大小
+var cacheIndexAddScript = redis.NewScript(`
+local old = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or 0)
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[2], 'NX', 0, ARGV[1])
+redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[3])
+redis.call('HSET', KEYS[5], ARGV[1], ARGV[4])
+return redis.call('INCRBY', KEYS[6], tonumber(ARGV[3]) - old)
+`)
+
+// KEYS 同cacheIndexKeys
+//
+// ARGV[1] 缓存key
+//
+// 返回{文件大小, 文件名}，不在索引中时返回false
+var cacheIndexRemoveScript = redis.NewScript(`
+local size = redis.call('HGET', KEYS[4], ARGV[1])
+if not size then
+	return false
+end
+local name = redis.call('HGET', KEYS[5], ARGV[1]) or ''
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+redis.call('DECRBY', KEYS[6], size)
+return {size, name}
+`)
+
+// KEYS[1] Access KEYS[2] Hits KEYS[3] Saved KEYS[4] 缓存key
+//
+// ARGV[1] 缓存key ARGV[2] 当前时间 ARGV[3] 记录的有效期(s)，为0时不延长 ARGV[4] 增加的命中次数
+var cacheIndexTouchScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('ZINCRBY', KEYS[2], ARGV[4], ARGV[1])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('EXPIRE', KEYS[4], ARGV[3])
+end
+return 1
+`)
+
+// 将缓存加入索引，name为文件在存储后端中的名称
+func cacheIndexAdd(key string, saveTimeStamp int64, size int64, name string) error {
+	return cacheIndexAddScript.Run(ctx, rdb, cacheIndexKeys(), key, saveTimeStamp, size, name).Err()
+}
+
+// 从索引中移除，返回文件名及大小
+func cacheIndexRemove(key string) (string, int64, bool) {
+	ret, err := cacheIndexRemoveScript.Run(ctx, rdb, cacheIndexKeys(), key).Slice()
+	if err != nil || len(ret) != 2 {
+		if err != nil && err != redis.Nil {
+			logger.Error.Println("[cacheIndexRemove]failed to run script:", err)
+		}
+		return "", 0, false
+	}
+	size, _ := strconv.ParseInt(fmt.Sprint(ret[0]), 10, 64)
+	name, _ := ret[1].(string)
+	return name, size, true
+}
+
+// 记录hits次命中并更新访问时间，LRU及LFU策略下同时延长记录的有效期
+//
+// 预热时hits为0，不影响LFU的排序
+func cacheIndexTouch(key string, hits int64) {
+	expire := int64(CacheExpire / time.Second)
+	if config.Get().Cache.EvictionPolicy == config.CacheEvictionTTL {
+		expire = 0
+	}
+	keys := []string{cacheIndexKey(cacheIndexAccess), cacheIndexKey(cacheIndexHits), cacheIndexKey(cacheIndexSaved), key}
+	if err := cacheIndexTouchScript.Run(ctx, rdb, keys, key, time.Now().Unix(), expire, hits).Err(); err != nil {
+		logger.Error.Println("[cacheIndexTouch]failed to run script:", err)
+	}
+}
+
+// 按淘汰策略排序的有序集合，分数越小越先淘汰
+func cacheEvictionIndex() string {
+	switch config.Get().Cache.EvictionPolicy {
+	case config.CacheEvictionLFU:
+		return cacheIndexKey(cacheIndexHits)
+	case config.CacheEvictionTTL:
+		return cacheIndexKey(cacheIndexSaved)
+	}
+	return cacheIndexKey(cacheIndexAccess)
+}
+
+// 判断是否过期的有序集合，TTL策略按保存时间，其余按最近访问时间
+func cacheExpireIndex() string {
+	if config.Get().Cache.EvictionPolicy == config.CacheEvictionTTL {
+		return cacheIndexKey(cacheIndexSaved)
+	}
+	return cacheIndexKey(cacheIndexAccess)
+}
+
+// 缓存的总大小
+func cacheUsage() int64 {
+	usage, _ := rdb.Get(ctx, cacheIndexKey(cacheIndexUsage)).Int64()
+	return usage
+}
+
+// 删除缓存记录、文件及索引，返回释放的大小
+func cacheEvict(key string) int64 {
+	record := rdb.Get(ctx, key).Val()
+	if record != "" {
+		if err := rdb.Del(ctx, key).Err(); err != nil {
+			logger.Error.Println("[cacheEvict]rdb.Del error", err)
+			return 0
+		}
+	}
+
+	name, size, ok := cacheIndexRemove(key)
+	if !ok {
+		//旧版本未加入索引的记录
+		item, err := parseIntoCacheItem(record)
+		if record == "" || err != nil {
+			return 0
+		}
+		name, size = item.storeName(), item.Size
+	}
+
+	if err := cacheStore.Delete(name); err != nil {
+		logger.Error.Println("[cacheEvict]cacheStore.Delete error", err)
+	}
+	//记录statistic(-)
+	statistics.Statistics.Record("StorageChange", -1*int32(size))
+	return size
+}
+
+// 由已有的缓存记录重建索引，并删除没有记录的文件
+//
+// 仅在索引不存在时(升级后首次启动)执行
+func cacheIndexRebuild() error {
+	exists, err := rdb.Exists(ctx, cacheIndexKey(cacheIndexUsage)).Result()
+	if err != nil || exists != 0 {
+		return err
+	}
+	loggerPrefix := "[cacheIndexRebuild]"
+
+	//以SET NX作为锁，避免多个实例同时重建
+	locked, err := rdb.SetNX(ctx, cacheIndexKey(cacheIndexUsage), 0, 0).Result()
+	if err != nil || !locked {
+		return err
+	}
+
+	files, err := cacheStore.List()
+	if err != nil {
+		rdb.Del(ctx, cacheIndexKey(cacheIndexUsage))
+		return err
+	}
+
+	indexed := make(map[string]bool, len(files))
+	for _, pattern := range []string{"Sticker_Cache", "Source_Cache"} {
+		var cursor uint64
+		for {
+			keys, next, err := rdb.Scan(ctx, cursor, fmt.Sprintf("%s:%s:*", ServicePrefix, pattern), cacheEvictBatch).Result()
+			if err != nil {
+				//丢弃不完整的索引并释放锁，下次启动时重新构建
+				rdb.Del(ctx, cacheIndexKeys()...)
+				return err
+			}
+			for _, key := range keys {
+				saveTimeStamp, size, name, ok := parseCacheRecord(pattern, rdb.Get(ctx, key).Val())
+				if !ok {
+					continue
+				}
+				if _, ok := files[name]; !ok {
+					rdb.Del(ctx, key)
+					continue
+				}
+				if err := cacheIndexAdd(key, saveTimeStamp, size, name); err != nil {
+					logger.Error.Println(loggerPrefix+"Failed to add index:", err)
+					continue
+				}
+				indexed[name] = true
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	removed := 0
+	for name := range files {
+		if indexed[name] || !isCacheFileName(name) {
+			continue
+		}
+		if err := cacheStore.Delete(name); err != nil {
+			logger.Error.Println(loggerPrefix+"Failed to delete file:", err)
+			continue
+		}
+		removed++
+	}
+	logger.Info.Printf("%sIndexed %d files, removed %d files without record", loggerPrefix, len(indexed), removed)
+	return nil
+}
+
+// 解析缓存记录中索引所需的字段
+func parseCacheRecord(pattern string, record string) (saveTimeStamp int64, size int64, name string, ok bool) {
+	if pattern == "Source_Cache" {
+		item := new(SourceItem)
+		if err := json.Unmarshal([]byte(record), item); err != nil {
+			return 0, 0, "", false
+		}
+		return item.SaveTimeStamp, item.Size, item.FileName, true
+	}
+	item, err := parseIntoCacheItem(record)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	return item.SaveTimeStamp, item.Size, item.storeName(), true
+}
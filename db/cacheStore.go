@@ -0,0 +1,106 @@
+package db
+
+import (
+	"errors"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/utils"
+	"os"
+	"path/filepath"
+)
+
+// CacheStore 缓存文件的存储后端
+//
+// 缓存索引保存在Redis中，文件按名称保存在后端；使用S3或Redis作为后端时多个实例可共享缓存
+type CacheStore interface {
+	// Put 将本地文件filePath保存为name
+	Put(name string, filePath string) error
+
+	// Get 将name的内容写入本地文件filePath
+	//
+	// 若不存在，则返回CacheErrorNotExist
+	Get(name string, filePath string) error
+
+	// Delete 删除name，不存在时不返回错误
+	Delete(name string) error
+
+	// List 列出所有文件的名称及大小(B)
+	List() (map[string]int64, error)
+}
+
+var cacheStore CacheStore
+
+var CacheErrorTooLarge = errors.New("CacheErrorTooLarge")
+
+// 根据配置创建存储后端
+func newCacheStore() (CacheStore, error) {
+	cf := config.Get().Cache
+	switch cf.Store {
+	case config.CacheStoreS3:
+		return NewS3CacheStore(S3Config{
+			Endpoint:  cf.S3.Endpoint,
+			Region:    cf.S3.Region,
+			Bucket:    cf.S3.Bucket,
+			AccessKey: cf.S3.AccessKey,
+			SecretKey: cf.S3.SecretKey,
+			Prefix:    cf.S3.Prefix,
+		}), nil
+	case config.CacheStoreRedis:
+		return NewRedisCacheStore(rdb, int64(cf.RedisBlobMaxSize)<<10), nil
+	default:
+		return NewLocalCacheStore(cf.StorageDir)
+	}
+}
+
+// LocalCacheStore 本地磁盘
+type LocalCacheStore struct {
+	dir string
+}
+
+// NewLocalCacheStore 使用dir作为缓存目录，不存在时创建
+func NewLocalCacheStore(dir string) (*LocalCacheStore, error) {
+	if utils.IsExist(dir) == false {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalCacheStore{dir: dir}, nil
+}
+
+func (s *LocalCacheStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+func (s *LocalCacheStore) Put(name string, filePath string) error {
+	return utils.CopyFile(filePath, s.path(name))
+}
+
+func (s *LocalCacheStore) Get(name string, filePath string) error {
+	if utils.IsExist(s.path(name)) == false {
+		return CacheErrorNotExist
+	}
+	return utils.CopyFile(s.path(name), filePath)
+}
+
+func (s *LocalCacheStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalCacheStore) List() (map[string]int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files[entry.Name()] = info.Size()
+	}
+	return files, nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"os"
+	"strings"
+)
+
+// RedisCacheStore 将文件内容直接存入Redis，适合较小的文件
+type RedisCacheStore struct {
+	client  *redis.Client
+	maxSize int64
+}
+
+// NewRedisCacheStore 超过maxSize(B)的文件不保存，返回CacheErrorTooLarge
+func NewRedisCacheStore(client *redis.Client, maxSize int64) *RedisCacheStore {
+	return &RedisCacheStore{client: client, maxSize: maxSize}
+}
+
+func (s *RedisCacheStore) key(name string) string {
+	return fmt.Sprintf("%s:Cache_Blob:%s", ServicePrefix, name)
+}
+
+func (s *RedisCacheStore) Put(name string, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > s.maxSize {
+		return CacheErrorTooLarge
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key(name), data, 0).Err()
+}
+
+func (s *RedisCacheStore) Get(name string, filePath string) error {
+	data, err := s.client.Get(ctx, s.key(name)).Bytes()
+	if err == redis.Nil {
+		return CacheErrorNotExist
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+func (s *RedisCacheStore) Delete(name string) error {
+	return s.client.Del(ctx, s.key(name)).Err()
+}
+
+func (s *RedisCacheStore) List() (map[string]int64, error) {
+	prefix := s.key("")
+	files := make(map[string]int64)
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, prefix+"*", 500).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) != 0 {
+			pipe := s.client.Pipeline()
+			sizes := make([]*redis.IntCmd, len(keys))
+			for i, key := range keys {
+				sizes[i] = pipe.StrLen(ctx, key)
+			}
+			if _, err = pipe.Exec(ctx); err != nil {
+				return nil, err
+			}
+			for i, key := range keys {
+				files[strings.TrimPrefix(key, prefix)] = sizes[i].Val()
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return files, nil
+		}
+	}
+}
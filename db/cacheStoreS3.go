@@ -0,0 +1,241 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config S3兼容的对象存储
+type S3Config struct {
+	//如 https://s3.us-east-1.amazonaws.com 或 http://127.0.0.1:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	//对象名的前缀
+	Prefix string
+}
+
+// S3CacheStore 使用path-style访问S3兼容的对象存储，如AWS S3、MinIO、Cloudflare R2
+//
+// 请求使用AWS Signature V4签名，AccessKey为空时匿名访问
+type S3CacheStore struct {
+	cf     S3Config
+	client *http.Client
+}
+
+// NewS3CacheStore 创建S3存储后端
+func NewS3CacheStore(cf S3Config) *S3CacheStore {
+	cf.Endpoint = strings.TrimRight(cf.Endpoint, "/")
+	return &S3CacheStore{
+		cf:     cf,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func (s *S3CacheStore) Put(name string, filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPut, s.cf.Prefix+name, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3CacheStore) Get(name string, filePath string) error {
+	resp, err := s.do(http.MethodGet, s.cf.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return CacheErrorNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+func (s *S3CacheStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.cf.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3CacheStore) List() (map[string]int64, error) {
+	files := make(map[string]int64)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cf.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		result := new(s3ListResult)
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			files[strings.TrimPrefix(object.Key, s.cf.Prefix)] = object.Size
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// 发送签名后的请求，key为空时请求bucket
+func (s *S3CacheStore) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s.cf.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(s.cf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = u.Path + s3Escape(path, false)
+	u.Path = u.Path + path
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, u, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// 按AWS Signature V4签名
+func (s *S3CacheStore) sign(req *http.Request, u *url.URL, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.cf.AccessKey == "" {
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], s.cf.Region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.cf.SecretKey), amzDate[:8])
+	signingKey = hmacSHA256(signingKey, s.cf.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cf.AccessKey, scope, signedHeaders, signature))
+}
+
+// 按SigV4的规则编码，除A-Z a-z 0-9 - _ . ~外均需编码，路径中的/可保留
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buf.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", b)
+	}
+	return buf.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := slices.Clone(query[key])
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3Error(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s", resp.Request.Method, resp.Status, strings.TrimSpace(string(data)))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"github.com/rroy233/StickerDownloader/config"
+	"slices"
+)
+
+// IsGroupAllowed 根据配置的允许/拒绝列表判断bot能否留在该群组
+//
+// 拒绝列表优先，允许列表为空时允许所有群组
+func IsGroupAllowed(chatID int64) bool {
+	if !config.Get().Group.Enable {
+		return false
+	}
+	if slices.Contains(config.Get().Group.DenyList, chatID) {
+		return false
+	}
+	allowList := config.Get().Group.AllowList
+	return len(allowList) == 0 || slices.Contains(allowList, chatID)
+}
+
+// GetDailyLimit 获取每日可用次数，0表示不限制
+//
+// 群组(UID<0)共用群组额度，其余为用户所在方案的额度
+func GetDailyLimit(UID int64) int {
+	return GetPlanLimits(GetPlan(UID)).Daily
+}
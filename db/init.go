@@ -6,6 +6,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/rroy233/StickerDownloader/config"
 	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/throttle"
 	"gopkg.in/rroy233/logger.v2"
 )
 
@@ -41,6 +42,9 @@ func Init() *redis.Client {
 	//cache
 	initCache()
 
+	//rate limit
+	throttle.Init(rdb)
+
 	return rdb
 }
 
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Job 可靠队列中的任务
+//
+// 任务被取出后进入处理中状态，需在可见性超时前调用Ack()确认完成，
+// 否则视为处理者已崩溃，任务将重新入队，保证至少被处理一次。
+type Job struct {
+	ID       string
+	Payload  []byte
+	Attempts int
+	queue    string
+}
+
+// 超过最大尝试次数的任务将移入死信队列
+const maxJobAttempts = 5
+
+// 死信队列只保留最近的任务，避免无限增长
+const maxDeadJobs = 1000
+
+func jobReadyKey(queue string) string {
+	return fmt.Sprintf("%s:Job:%s:Ready", ServicePrefix, queue)
+}
+
+func jobProcessingKey(queue string) string {
+	return fmt.Sprintf("%s:Job:%s:Processing", ServicePrefix, queue)
+}
+
+func jobDataKey(queue string) string {
+	return fmt.Sprintf("%s:Job:%s:Data", ServicePrefix, queue)
+}
+
+func jobAttemptsKey(queue string) string {
+	return fmt.Sprintf("%s:Job:%s:Attempts", ServicePrefix, queue)
+}
+
+func jobDeadKey(queue string) string {
+	return fmt.Sprintf("%s:Job:%s:Dead", ServicePrefix, queue)
+}
+
+func jobKeys(queue string) []string {
+	return []string{jobReadyKey(queue), jobProcessingKey(queue), jobDataKey(queue), jobAttemptsKey(queue), jobDeadKey(queue)}
+}
+
+// KEYS 同jobKeys
+//
+// ARGV[1] 可见性超时(ms) ARGV[2] 最大尝试次数 ARGV[3] 死信队列长度上限
+//
+// 先将超时的任务重新入队，再取出一个任务，返回{id, payload, attempts}
+//
+// 移入死信队列的是任务内容，同时删除任务数据及尝试次数
+var reserveJobScript = redis.NewScript(redisNowLua + `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now)
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	local attempts = tonumber(redis.call('HGET', KEYS[4], id) or '0')
+	if attempts >= tonumber(ARGV[2]) then
+		local payload = redis.call('HGET', KEYS[3], id)
+		if payload then
+			redis.call('LPUSH', KEYS[5], payload)
+			redis.call('LTRIM', KEYS[5], 0, tonumber(ARGV[3]) - 1)
+		end
+		redis.call('HDEL', KEYS[3], id)
+		redis.call('HDEL', KEYS[4], id)
+	else
+		redis.call('RPUSH', KEYS[1], id)
+	end
+end
+
+while true do
+	local id = redis.call('RPOP', KEYS[1])
+	if not id then
+		return false
+	end
+	local payload = redis.call('HGET', KEYS[3], id)
+	if payload then
+		local attempts = redis.call('HINCRBY', KEYS[4], id, 1)
+		redis.call('ZADD', KEYS[2], now + tonumber(ARGV[1]), id)
+		return {id, payload, attempts}
+	end
+end
+`)
+
+// KEYS[1] 处理中
+//
+// ARGV[1] id ARGV[2] 可见性超时(ms)
+var extendJobScript = redis.NewScript(redisNowLua + `
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+return 1
+`)
+
+// KEYS 同jobKeys
+//
+// ARGV[1] id
+var nackJobScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+return 1
+`)
+
+// KEYS 同jobKeys KEYS[6] 任务结果
+//
+// ARGV[1] id
+var cancelJobScript = redis.NewScript(`
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('DEL', KEYS[6])
+return 1
+`)
+
+// PushJob 向队列queue添加任务
+func PushJob(queue string, payload []byte) (string, error) {
+	id := uuid.New().String()
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, jobDataKey(queue), id, payload)
+	pipe.LPush(ctx, jobReadyKey(queue), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ReserveJob 从队列queue取出一个任务
+//
+// 任务在visibility时间内对其他处理者不可见，队列为空时返回ErrorQueueEmpty
+func ReserveJob(queue string, visibility time.Duration) (*Job, error) {
+	res, err := reserveJobScript.Run(ctx, rdb, jobKeys(queue), visibility.Milliseconds(), maxJobAttempts, maxDeadJobs).Slice()
+	if err == redis.Nil {
+		return nil, ErrorQueueEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 3 {
+		return nil, fmt.Errorf("unexpected reserve result: %v", res)
+	}
+	job := &Job{queue: queue}
+	job.ID, _ = res[0].(string)
+	payload, _ := res[1].(string)
+	job.Payload = []byte(payload)
+	attempts, _ := res[2].(int64)
+	job.Attempts = int(attempts)
+	return job, nil
+}
+
+// Ack 确认任务已完成
+func (j *Job) Ack() error {
+	pipe := rdb.TxPipeline()
+	pipe.ZRem(ctx, jobProcessingKey(j.queue), j.ID)
+	pipe.HDel(ctx, jobDataKey(j.queue), j.ID)
+	pipe.HDel(ctx, jobAttemptsKey(j.queue), j.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Extend 延长任务的可见性超时，用于耗时较长的任务
+//
+// 若任务已超时被重新入队，返回ErrorNotFound
+func (j *Job) Extend(visibility time.Duration) error {
+	ok, err := extendJobScript.Run(ctx, rdb, []string{jobProcessingKey(j.queue)}, j.ID, visibility.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// Nack 放弃处理，任务立即重新入队
+func (j *Job) Nack() error {
+	ok, err := nackJobScript.Run(ctx, rdb, jobKeys(j.queue), j.ID).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrorNotFound
+	}
+	return nil
+}
+
+// CancelJob 提交者不再等待结果时删除任务
+//
+// 尚未被取出的任务不会再被处理；正在处理的任务无法中断，其结果将被丢弃
+func CancelJob(queue, id string) error {
+	return cancelJobScript.Run(ctx, rdb, append(jobKeys(queue), jobResultKey(queue, id)), id).Err()
+}
+
+// JobQueueLen 查询等待中及处理中的任务数
+func JobQueueLen(queue string) (ready int64, processing int64) {
+	ready = rdb.LLen(ctx, jobReadyKey(queue)).Val()
+	processing = rdb.ZCard(ctx, jobProcessingKey(queue)).Val()
+	return
+}
+
+func jobResultKey(queue, id string) string {
+	return fmt.Sprintf("%s:Job:%s:Result:%s", ServicePrefix, queue, id)
+}
+
+// 任务结果的保留时间，提交者超时未取回则丢弃
+const jobResultExpire = 10 * time.Minute
+
+// PushJobResult 保存任务结果，供提交者取回
+func PushJobResult(queue, id string, result []byte) error {
+	pipe := rdb.TxPipeline()
+	pipe.RPush(ctx, jobResultKey(queue, id), result)
+	pipe.Expire(ctx, jobResultKey(queue, id), jobResultExpire)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// WaitJobResult 阻塞等待任务结果，直到c被取消
+func WaitJobResult(c context.Context, queue, id string) ([]byte, error) {
+	for {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+		res, err := rdb.BLPop(c, time.Second, jobResultKey(queue, id)).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		//任务可能被重复执行，只取第一个结果
+		rdb.Del(ctx, jobResultKey(queue, id))
+		return []byte(res[1]), nil
+	}
+}
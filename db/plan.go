@@ -0,0 +1,88 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rroy233/StickerDownloader/config"
+	"time"
+)
+
+// 配额方案
+const (
+	PlanFree      = "free"
+	PlanSupporter = "supporter"
+	PlanVIP       = "vip"
+	//群组共用的方案，不可手动设置
+	PlanGroup = "group"
+)
+
+var ErrorUnknownPlan = errors.New("ErrorUnknownPlan")
+
+func userPlanKey(UID int64) string {
+	return fmt.Sprintf("%s:UserPlan:%d", ServicePrefix, UID)
+}
+
+// GetPlan 查询用户当前的配额方案，未设置或已过期时为free
+func GetPlan(UID int64) string {
+	if UID < 0 {
+		return PlanGroup
+	}
+	switch plan := rdb.Get(ctx, userPlanKey(UID)).Val(); plan {
+	case PlanSupporter, PlanVIP:
+		return plan
+	}
+	return PlanFree
+}
+
+// GetPlanExpire 查询用户方案的剩余时间，-1表示永久或未设置
+func GetPlanExpire(UID int64) time.Duration {
+	ttl := rdb.TTL(ctx, userPlanKey(UID)).Val()
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+// SetPlan 设置用户的配额方案，duration为0时永久有效
+//
+// 设置为free时删除记录
+func SetPlan(UID int64, plan string, duration time.Duration) error {
+	switch plan {
+	case PlanFree:
+		return rdb.Del(ctx, userPlanKey(UID)).Err()
+	case PlanSupporter, PlanVIP:
+		return rdb.Set(ctx, userPlanKey(UID), plan, duration).Err()
+	}
+	return ErrorUnknownPlan
+}
+
+// GetPlanLimits 获取方案在各统计窗口内可使用的次数，0表示不限制
+func GetPlanLimits(plan string) config.QuotaPlan {
+	switch plan {
+	case PlanSupporter:
+		return config.Get().Quota.Supporter
+	case PlanVIP:
+		return config.Get().Quota.VIP
+	case PlanGroup:
+		return config.QuotaPlan{Daily: config.Get().Group.DailyLimit}
+	}
+	return config.Get().Quota.Free
+}
+
+// StickerCost 转换单个贴纸消耗的次数
+func StickerCost() int {
+	return config.Get().Quota.Cost.Sticker
+}
+
+// AnimationCost 转换单个gif消耗的次数
+func AnimationCost() int {
+	return config.Get().Quota.Cost.Animation
+}
+
+// StickerSetCost 转换count个贴纸组成的表情包消耗的次数
+//
+// 每Quota.Cost.StickerSetUnit个贴纸消耗1次，至少1次
+func StickerSetCost(count int) int {
+	unit := config.Get().Quota.Cost.StickerSetUnit
+	return max(1, (count+unit-1)/unit)
+}
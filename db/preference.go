@@ -0,0 +1,92 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+)
+
+// UserPreference 用户偏好设置
+type UserPreference struct {
+	//output format of animated stickers
+	OutputFormat utils.OutputFormat `json:"output_format"`
+
+	//max fps of converted file, 0 for default
+	MaxFPS int `json:"max_fps"`
+
+	//longest side of converted file(px), 0 for original size
+	TargetSize int `json:"target_size"`
+
+	//language code, empty for following telegram client
+	Language string `json:"language"`
+
+	//archive format of sticker set
+	ArchiveFormat utils.ArchiveFormat `json:"archive_format"`
+
+	//whether to include the json of tgs stickers in sticker set
+	IncludeTGSJson bool `json:"include_tgs_json"`
+}
+
+func preferenceKey(UID int64) string {
+	return fmt.Sprintf("%s:User_%d:Preference", ServicePrefix, UID)
+}
+
+// DefaultUserPreference 由配置生成的默认偏好
+func DefaultUserPreference() *UserPreference {
+	return &UserPreference{
+		OutputFormat:   utils.DefaultOutputFormat(),
+		ArchiveFormat:  utils.ArchiveFormatZip,
+		IncludeTGSJson: true,
+	}
+}
+
+// GetUserPreference 获取用户偏好设置
+//
+// 若用户未设置过，则返回默认偏好
+func GetUserPreference(UID int64) *UserPreference {
+	pref := DefaultUserPreference()
+	data := rdb.Get(ctx, preferenceKey(UID)).Val()
+	if data == "" {
+		return pref
+	}
+	if err := json.Unmarshal([]byte(data), pref); err != nil {
+		logger.Error.Println("[GetUserPreference]json.Unmarshal error", err)
+		return DefaultUserPreference()
+	}
+	if _, ok := utils.ParseOutputFormat(string(pref.OutputFormat)); !ok {
+		pref.OutputFormat = utils.DefaultOutputFormat()
+	}
+	if _, ok := utils.ParseArchiveFormat(string(pref.ArchiveFormat)); !ok {
+		pref.ArchiveFormat = utils.ArchiveFormatZip
+	}
+	return pref
+}
+
+// Save 保存用户偏好设置
+func (p *UserPreference) Save(UID int64) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, preferenceKey(UID), string(data), 0).Err()
+}
+
+// ConvertOptions 根据偏好生成转码选项
+func (p *UserPreference) ConvertOptions() utils.ConvertOptions {
+	return utils.ConvertOptions{
+		OutputFormat: p.OutputFormat,
+		MaxFPS:       p.MaxFPS,
+		TargetSize:   p.TargetSize,
+	}
+}
+
+// GetUserLanguage 获取用户设置的语言
+//
+// 返回空字符串表示未设置，群组的设置保存在群组ID(负数)下
+func GetUserLanguage(UID int64) string {
+	if rdb == nil || UID == 0 {
+		return ""
+	}
+	return GetUserPreference(UID).Language
+}
@@ -3,9 +3,11 @@ package db
 import (
 	"errors"
 	"fmt"
+	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"gopkg.in/rroy233/logger.v2"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,7 +19,7 @@ var (
 	ErrorAborted    = errors.New("ErrorAborted")
 )
 
-// QStruct 队列规则：
+// 队列规则：
 //
 // 1.凭借用户UID入队，单个用户的不同请求可同时存在于队列中，返回QItem作为凭证。
 //
@@ -26,28 +28,155 @@ var (
 // 3.出队时调用QItem的Dequeue()方法，若队首不是自己或前方存在未弃权的用户，则出队失败返回ErrorNotAllowed。
 //
 // 4.若业务过程结束后希望立即完成出队，可先调用QItem的Abort()方法，进行弃权登记，则可立即允许完成出队。
-type QStruct struct {
-	data []*QItem
-	size int
-	head int
-	tail int
-	lock sync.Mutex
-}
-
+//
+// 队列保存在Redis中，可由多个实例共享。每个QItem带有可见性超时，等待期间每次QueryFront()都会续期，
+// 包括到达队首时的最后一次；此后持有者不再查询，若崩溃未能出队，超时后该项自动失效，后续用户可继续出队。
 type QItem struct {
-	UUID       string
-	queueIndex int
-	uid        int64
-	addTime    int64
-	abort      bool
+	UUID    string
+	uid     int64
+	addTime int64
 }
 
-var queue *QStruct
 var maxQueueSize int
 var QueueTimeout int64
 
 const queueCleanerInterval = 10 * time.Second
 
+// 按入队顺序排列的有序集合
+func queueKey() string {
+	return fmt.Sprintf("%s:Queue", ServicePrefix)
+}
+
+func queueSeqKey() string {
+	return fmt.Sprintf("%s:Queue:Seq", ServicePrefix)
+}
+
+// 有序集合，分数为可见性超时的截止时间(ms)，弃权后置为0
+func queueDeadlineKey() string {
+	return fmt.Sprintf("%s:Queue:Deadline", ServicePrefix)
+}
+
+// 哈希表，记录各项的UID及入队时间
+func queueInfoKey() string {
+	return fmt.Sprintf("%s:Queue:Info", ServicePrefix)
+}
+
+// 脚本使用的KEYS，入队时另需序号
+func queueKeys() []string {
+	return []string{queueKey(), queueDeadlineKey(), queueInfoKey()}
+}
+
+// 以Redis服务器时间为准，避免多个实例间的时钟偏差，供各脚本共用，结果保存在now(ms)中
+//
+// Redis 5以下需先开启命令复制，才能在TIME之后执行写操作
+const redisNowLua = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+// 清除已弃权或已失效的项，ARGV[1]对应的项除外
+//
+// 每项只会被清除一次，队列中剩余的项均未弃权且未失效
+const queuePurgeLua = `
+local removed = 0
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now)) do
+	if id ~= ARGV[1] then
+		redis.call('ZREM', KEYS[1], id)
+		redis.call('ZREM', KEYS[2], id)
+		redis.call('HDEL', KEYS[3], id)
+		removed = removed + 1
+	end
+end
+`
+
+// KEYS 同queueKeys KEYS[4] 序号
+//
+// ARGV[1] UUID ARGV[2] 最大长度 ARGV[3] UID及入队时间 ARGV[4] 超时(ms)
+var enqueueScript = redis.NewScript(redisNowLua + queuePurgeLua + `
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+local seq = redis.call('INCR', KEYS[4])
+redis.call('ZADD', KEYS[1], seq, ARGV[1])
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[4]), ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+return 1
+`)
+
+// KEYS 同queueKeys
+//
+// ARGV[1] UUID ARGV[2] 超时(ms)
+//
+// 返回前方未弃权的数量，-1表示不存在或已弃权
+var queryFrontScript = redis.NewScript(redisNowLua + `
+local deadline = tonumber(redis.call('ZSCORE', KEYS[2], ARGV[1]) or '0')
+if deadline <= now then
+	return -1
+end
+` + queuePurgeLua + `
+local front = redis.call('ZRANK', KEYS[1], ARGV[1])
+if not front then
+	return -1
+end
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+return front
+`)
+
+// KEYS 同queueKeys
+//
+// ARGV[1] UUID
+//
+// 返回1成功，0前方存在未弃权的用户，-1队列为空，-2未找到
+var dequeueScript = redis.NewScript(redisNowLua + `
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	return -1
+end
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return -2
+end
+` + queuePurgeLua + `
+if redis.call('ZRANK', KEYS[1], ARGV[1]) ~= 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// KEYS 同queueKeys
+//
+// ARGV[1] 为空
+//
+// 清除已弃权或已失效的项，返回清除的数量
+var queueCleanScript = redis.NewScript(redisNowLua + queuePurgeLua + `
+for _, id in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if not redis.call('ZSCORE', KEYS[2], id) then
+		redis.call('ZREM', KEYS[1], id)
+		redis.call('HDEL', KEYS[3], id)
+		removed = removed + 1
+	end
+end
+return removed
+`)
+
+// KEYS[1] 截止时间 KEYS[2] 队列项信息
+//
+// ARGV[1] UUID
+//
+// 返回{剩余可见性超时(ms), 队列项信息}，剩余时间为-1表示已弃权或已失效
+var queueItemScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local deadline = tonumber(redis.call('ZSCORE', KEYS[1], ARGV[1]) or '0')
+local info = redis.call('HGET', KEYS[2], ARGV[1]) or ''
+if deadline <= now then
+	return {-1, info}
+end
+return {deadline - now, info}
+`)
+
 func initQueue(maxSize int) {
 	if maxSize == 0 {
 		maxQueueSize = 5
@@ -58,35 +187,20 @@ func initQueue(maxSize int) {
 	//队列任务超时时间
 	QueueTimeout = 30
 
-	queue = new(QStruct)
-	queue.size = 0
-	queue.head = 0
-	queue.tail = 0
-	queue.data = make([]*QItem, maxQueueSize)
 	go queueCleaner()
 	return
 }
 
-// 定期清除队列中超时项
+func queueVisibilityTimeout() int64 {
+	return QueueTimeout * 1000
+}
+
+// 定期清除队列中已弃权及超时的项
 func queueCleaner() {
 	for true {
-		queue.lock.Lock()
-		for i := 0; i < maxQueueSize; i++ {
-			if queue.data[i] == nil {
-				continue
-			}
-			if time.Now().Unix()-queue.data[i].addTime > QueueTimeout {
-				queue.data[i].abort = true
-			}
-		}
-		queue.lock.Unlock()
-
-		p := queue.head
-		for queue.data[p] != nil && queue.data[p].abort == true {
-			queue.pop()
-			p = (p + 1) % maxQueueSize
+		if err := queueCleanScript.Run(ctx, rdb, queueKeys(), "").Err(); err != nil {
+			logger.Error.Println("[queueCleaner]failed to clean queue:", err)
 		}
-
 		time.Sleep(queueCleanerInterval)
 	}
 }
@@ -97,44 +211,36 @@ func queueCleaner() {
 //
 // 若队伍已满则返回ErrorQueueFull
 func EnQueue(UID int64) (*QItem, error) {
-	if queue.size == maxQueueSize {
-		return &QItem{}, ErrorQueueFull
-	}
 	item := &QItem{
 		UUID:    uuid.New().String(),
 		uid:     UID,
 		addTime: time.Now().Unix(),
-		abort:   false,
 	}
-	queue.push(item)
+	ok, err := enqueueScript.Run(ctx, rdb,
+		append(queueKeys(), queueSeqKey()),
+		item.UUID, maxQueueSize, fmt.Sprintf("%d:%d", UID, item.addTime), queueVisibilityTimeout(),
+	).Int()
+	if err != nil {
+		return &QItem{}, err
+	}
+	if ok == 0 {
+		return &QItem{}, ErrorQueueFull
+	}
 	return item, nil
 }
 
 // DeQueue 出队表示已完成等待
 func (q *QItem) DeQueue() error {
-	if queue.size == 0 {
-		return ErrorQueueEmpty
+	ret, err := dequeueScript.Run(ctx, rdb, queueKeys(), q.UUID).Int()
+	if err != nil {
+		return err
 	}
-	if queue.data[queue.head].UUID != q.UUID && queue.data[queue.head].abort != true {
+	switch ret {
+	case 0:
 		return ErrorNotAllowed
-	}
-	var popItem *QItem
-	success := false
-	for true {
-		if queue.size == 0 {
-			break
-		}
-		if queue.data[queue.head].UUID == q.UUID || queue.data[queue.head].abort == true {
-			//队首是自己 或 队首已弃权，则弹出
-			popItem = queue.pop()
-			if popItem.UUID == q.UUID {
-				success = true
-			}
-			continue
-		}
-		break
-	}
-	if success == false {
+	case -1:
+		return ErrorQueueEmpty
+	case -2:
 		return ErrorNotFound
 	}
 	return nil
@@ -146,15 +252,50 @@ func (q *QItem) DeQueue() error {
 //
 // 若已弃权返回ErrorAborted
 func FindQueueItemByUUID(UUID string) (*QItem, error) {
-	return queue.find(UUID)
+	if rdb.ZCard(ctx, queueKey()).Val() == 0 {
+		return nil, ErrorQueueEmpty
+	}
+	if rdb.ZScore(ctx, queueKey(), UUID).Err() != nil {
+		return nil, ErrorNotFound
+	}
+	ttl, info, err := queueItemState(UUID)
+	if err != nil || ttl < 0 {
+		return nil, ErrorAborted
+	}
+	item := &QItem{UUID: UUID}
+	item.uid, item.addTime = parseQueueItemInfo(info)
+	return item, nil
+}
+
+// 查询队列项的剩余可见性超时(ms)及信息
+func queueItemState(UUID string) (int64, string, error) {
+	ret, err := queueItemScript.Run(ctx, rdb, []string{queueDeadlineKey(), queueInfoKey()}, UUID).Slice()
+	if err != nil {
+		return -1, "", err
+	}
+	if len(ret) != 2 {
+		return -1, "", fmt.Errorf("unexpected queue item result: %v", ret)
+	}
+	ttl, _ := ret[0].(int64)
+	info, _ := ret[1].(string)
+	return ttl, info, nil
+}
+
+// 解析队列项信息中的UID及入队时间
+func parseQueueItemInfo(info string) (uid int64, addTime int64) {
+	uidStr, addTimeStr, _ := strings.Cut(info, ":")
+	uid, _ = strconv.ParseInt(uidStr, 10, 64)
+	addTime, _ = strconv.ParseInt(addTimeStr, 10, 64)
+	return
 }
 
 // QueryFront 查询前面的用户数
 //
 // 返回-1表示不存在或已弃权
 func (q *QItem) QueryFront() int {
-	front, exist := queue.findRelIndex(q.UUID)
-	if exist == false {
+	front, err := queryFrontScript.Run(ctx, rdb, queueKeys(), q.UUID, queueVisibilityTimeout()).Int()
+	if err != nil {
+		logger.Error.Println("[QueryFront]failed to query queue:", err)
 		return -1
 	}
 	return front
@@ -162,138 +303,55 @@ func (q *QItem) QueryFront() int {
 
 // Abort 弃权
 func (q *QItem) Abort() {
-	q.abort = true
+	//仅在队列项仍存在时标记，避免重建已失效的项
+	if err := rdb.ZAddXX(ctx, queueDeadlineKey(), &redis.Z{Score: 0, Member: q.UUID}).Err(); err != nil {
+		logger.Error.Println("[Abort]failed to abort queue item:", err)
+	}
 	return
 }
 
 // IsAbort 查询是否已弃权
+//
+// 已失效的项同样视为已弃权
 func (q *QItem) IsAbort() bool {
-	return q.abort
-}
-
-func (q *QStruct) push(item *QItem) {
-	q.lock.Lock()
-	defer q.lock.Unlock()
-	item.queueIndex = q.tail
-	q.data[q.tail] = item
-	q.size++
-	q.tail = (q.tail + 1) % maxQueueSize
-	return
-}
-
-func (q *QStruct) pop() *QItem {
-	q.lock.Lock()
-	defer q.lock.Unlock()
-	item := q.data[q.head]
-	q.data[q.head] = nil
-	q.size--
-	q.head = (q.head + 1) % maxQueueSize
-	if q.size == 0 {
-		q.head = 0
-		q.tail = 0
-	}
-	return item
+	ttl, _, err := queueItemState(q.UUID)
+	return err != nil || ttl < 0
 }
 
-func (q *QStruct) debugPrint() {
-	q.lock.Lock()
-	defer q.lock.Unlock()
-	text := ""
-	text += fmt.Sprintf("[Size=%d,head=%d,tail=%d]->[\n", q.size, q.head, q.tail)
-	for i := 0; i < maxQueueSize; i++ {
-		text += fmt.Sprintf("\t")
-		if q.data[i] == nil {
-			text += fmt.Sprintf("<nil>")
-		} else {
-			text += fmt.Sprintf("UUID=%s\tUID=%d\tabort=%v\tadd_time=%d\tqueueIndex=%d",
-				q.data[i].UUID, q.data[i].uid, q.data[i].abort, q.data[i].addTime, q.data[i].queueIndex,
-			)
-		}
-		text += "\n"
-	}
-	if logger.Debug == nil {
-		logger.New(&logger.Config{StdOutput: true})
-	}
-	logger.Debug.Println(text)
-	return
+// QueueLen 查询队列长度，包含尚未清除的已弃权项
+func QueueLen() int64 {
+	return rdb.ZCard(ctx, queueKey()).Val()
 }
 
-// 找相对于队头的索引
-// int为前面的个数
-// bool为是否找到
-func (q *QStruct) findRelIndex(UUID string) (int, bool) {
-	q.lock.Lock()
-	defer q.lock.Unlock()
-	if q.size == 0 {
-		return -1, false
-	}
-	i := 0
-	abortNum := 0
-	found := false
-	if q.data[q.head] != nil {
-		if q.data[q.head].UUID == UUID && q.data[q.head].abort != true {
-			return 0, true
-		}
-	}
-	if q.data[q.head] != nil && q.data[q.head].abort == true {
-		abortNum++
-	}
-	for i = (q.head + 1) % maxQueueSize; i != q.tail; i = (i + 1) % maxQueueSize {
-		if queue.data[i] == nil {
-			continue
-		}
-		if q.data[i].abort == true {
-			abortNum++
-		}
-		if q.data[i].UUID == UUID {
-			found = true
-			break
-		}
-	}
-	//未找到
-	if found == false {
-		return -1, false
-	}
-	//自身为弃权的
-	if q.data[i].abort == true {
-		return -1, true
-	}
-
-	i = (i - q.head + maxQueueSize) % maxQueueSize
-	return i - abortNum, true
+// QueueItemInfo 队列项的快照，供管理后台展示
+type QueueItemInfo struct {
+	UUID    string `json:"uuid"`
+	UID     int64  `json:"uid"`
+	AddTime int64  `json:"add_time"`
+	Abort   bool   `json:"abort"`
+	//剩余可见性超时(ms)，-1表示已失效
+	TTL int64 `json:"ttl"`
 }
 
-func (q *QStruct) find(UUID string) (*QItem, error) {
-	q.lock.Lock()
-	defer q.lock.Unlock()
-	if q.size == 0 {
-		return nil, ErrorQueueEmpty
+// QueueItems 按入队顺序返回队列中的所有项
+func QueueItems() ([]QueueItemInfo, error) {
+	members, err := rdb.ZRange(ctx, queueKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
 	}
-	if q.data[q.head] != nil && q.data[q.head].UUID == UUID {
-		if q.data[q.head].abort != true {
-			return q.data[q.head], nil
-		} else {
-			return nil, ErrorAborted
+	items := make([]QueueItemInfo, 0, len(members))
+	for _, UUID := range members {
+		item := QueueItemInfo{UUID: UUID, Abort: true, TTL: -1}
+		ttl, info, err := queueItemState(UUID)
+		if err != nil {
+			return nil, err
 		}
-	}
-	i := 0
-	found := false
-	for i = (q.head + 1) % maxQueueSize; i != q.tail; i = (i + 1) % maxQueueSize {
-		if queue.data[i] == nil {
-			continue
+		item.UID, item.AddTime = parseQueueItemInfo(info)
+		if ttl >= 0 {
+			item.Abort = false
+			item.TTL = ttl
 		}
-		if q.data[i].UUID == UUID {
-			found = true
-			break
-		}
-	}
-	//未找到
-	if found == false {
-		return nil, ErrorNotFound
-	}
-	//自身为弃权的
-	if q.data[i].abort == true {
-		return nil, ErrorAborted
+		items = append(items, item)
 	}
-	return q.data[i], nil
+	return items, nil
 }
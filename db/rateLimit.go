@@ -1,24 +1,29 @@
 package db
 
 import (
-	"fmt"
-	"time"
+	"github.com/rroy233/StickerDownloader/throttle"
+	"math"
 )
 
 // CheckUserRateLimit 检查用户访问频率
 //
-// 传入UID和最小允许访问间隔minInterval
+// 传入UID、所在群组chatID(私聊时与UID相同)和本次消耗的令牌数cost
 //
-// 返回int需要等待的时间(s)。若返回-1则无需等待即可放行，同时设置新的访问间隔minInterval
-func CheckUserRateLimit(UID int64, minInterval time.Duration) int {
-	key := fmt.Sprintf("%s:User_%d:RateLimit", ServicePrefix, UID)
+// 返回int需要等待的时间(s)。若返回-1则无需等待即可放行，同时扣除令牌
+//
+// 频繁触发用户限制的用户将被自动临时封禁
+func CheckUserRateLimit(UID int64, chatID int64, cost int) int {
+	buckets := []throttle.Bucket{throttle.User(UID)}
+	if chatID < 0 {
+		buckets = append(buckets, throttle.Chat(chatID))
+	}
 
-	data := rdb.Get(ctx, key).Val()
-	if data == "" {
-		rdb.Set(ctx, key, time.Now().Unix(), minInterval)
+	wait, bucket := throttle.Take(ctx, cost, buckets...)
+	if wait == 0 {
 		return -1
 	}
-
-	return int(rdb.TTL(ctx, key).Val() / time.Second)
-
+	if bucket.Key == buckets[0].Key {
+		recordRateLimitTrip(UID)
+	}
+	return int(math.Ceil(wait.Seconds()))
 }
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"time"
+)
+
+func setArchiveCacheKey(hash string) string {
+	return fmt.Sprintf("%s:Set_Cache:%s", ServicePrefix, hash)
+}
+
+// FindSetArchiveCache 查询表情包压缩包的缓存
+//
+// 传入由贴纸列表及选项计算的hash，若不存在，则返回CacheErrorNotExist
+func FindSetArchiveCache(hash string) (*SetArchiveItem, error) {
+	if cacheEnabled == false {
+		return nil, CacheErrorDisabled
+	}
+	data := rdb.Get(ctx, setArchiveCacheKey(hash)).Val()
+	if data == "" {
+		return nil, CacheErrorNotExist
+	}
+
+	item := new(SetArchiveItem)
+	if err := json.Unmarshal([]byte(data), item); err != nil || len(item.FileIDs) == 0 {
+		return nil, CacheErrorNotExist
+	}
+	return item, nil
+}
+
+// CacheSetArchive 缓存已上传的表情包压缩包的file_id
+func CacheSetArchive(setName string, hash string, fileIDs []string, stickers int) error {
+	if cacheEnabled == false {
+		return errors.New("cache is DISABLED")
+	}
+	item := &SetArchiveItem{
+		SetName:       setName,
+		Hash:          hash,
+		FileIDs:       fileIDs,
+		Stickers:      stickers,
+		SaveTimeStamp: time.Now().Unix(),
+	}
+	out, err := json.Marshal(item)
+	if err != nil {
+		return errors.New("json.Marshal(item) error:" + err.Error())
+	}
+	return rdb.Set(ctx, setArchiveCacheKey(hash), string(out), CacheExpire).Err()
+}
+
+// RemoveSetArchiveCache 删除表情包压缩包的缓存，用于file_id失效时
+func RemoveSetArchiveCache(hash string) {
+	rdb.Del(ctx, setArchiveCacheKey(hash))
+}
+
+// 表情包任务锁的有效期，持有的实例需在到期前续期，实例退出后自动释放
+const SetJobLockExpire = time.Minute
+
+func setJobLockKey(jobKey string) string {
+	return fmt.Sprintf("%s:Set_Job_Lock:%s", ServicePrefix, utils.MD5Short(jobKey))
+}
+
+// 锁仍属于token时续期
+//
+// KEYS[1] 锁
+// ARGV[1] token ARGV[2] 有效期(ms)
+var renewSetJobLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+`)
+
+// 锁仍属于token时释放
+//
+// KEYS[1] 锁
+// ARGV[1] token
+var unlockSetJobScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// TryLockSetJob 尝试获取表情包任务在多个实例间的锁，同一任务同时只在一个实例中转换
+//
+// 成功时返回用于续期及释放的token，锁被其他实例持有时返回空字符串
+func TryLockSetJob(jobKey string) (string, error) {
+	token := uuid.New().String()
+	ok, err := rdb.SetNX(ctx, setJobLockKey(jobKey), token, SetJobLockExpire).Result()
+	if err != nil || !ok {
+		return "", err
+	}
+	return token, nil
+}
+
+// RenewSetJobLock 续期表情包任务的锁，锁已过期或被其他实例持有时返回false
+func RenewSetJobLock(jobKey string, token string) (bool, error) {
+	n, err := renewSetJobLockScript.Run(ctx, rdb, []string{setJobLockKey(jobKey)}, token, SetJobLockExpire.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// UnlockSetJob 释放表情包任务的锁
+func UnlockSetJob(jobKey string, token string) {
+	if err := unlockSetJobScript.Run(ctx, rdb, []string{setJobLockKey(jobKey)}, token).Err(); err != nil {
+		logger.Error.Println("[UnlockSetJob]failed to release lock:", err)
+	}
+}
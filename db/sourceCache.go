@@ -0,0 +1,115 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"os"
+	"time"
+)
+
+// 原始文件在redis中的key，仅由FileUniqueID决定
+func sourceCacheKey(uniqueID string) string {
+	return fmt.Sprintf("%s:Source_Cache:%s", ServicePrefix, utils.MD5Short(uniqueID))
+}
+
+// FindSourceCache 查询贴纸原始文件的缓存
+// 返回本地文件地址，扩展名与原始文件一致
+//
+// 若不存在，则返回CacheErrorNotExist
+func FindSourceCache(uniqueID string) (string, error) {
+	if cacheEnabled == false {
+		return "", CacheErrorDisabled
+	}
+	key := sourceCacheKey(uniqueID)
+	data := rdb.Get(ctx, key).Val()
+	if data == "" {
+		return "", CacheErrorNotExist
+	}
+
+	item := new(SourceItem)
+	if err := json.Unmarshal([]byte(data), item); err != nil {
+		return "", CacheErrorNotExist
+	}
+
+	//复制一份到tmp
+	newFilePath := fmt.Sprintf("./storage/tmp/upload_%s_source.%s", utils.RandString(), item.FileExt)
+	err := cacheStore.Get(item.FileName, newFilePath)
+	if err != nil {
+		utils.RemoveFile(newFilePath)
+		if err != CacheErrorNotExist {
+			logger.Error.Println("[FindSourceCache]cacheStore.Get error", err)
+		}
+		return "", CacheErrorNotExist
+	}
+
+	//校验
+	fileMd5, err := utils.MD5File(newFilePath)
+	if err != nil || fileMd5 != item.MD5 {
+		logger.Error.Printf("Source cache MD5 mismatch!! redis[%s]=%s file[%s]=%s", utils.JsonEncode(item), item.MD5, item.FileName, fileMd5)
+		utils.RemoveFile(newFilePath)
+		cacheEvict(key)
+		return "", CacheErrorVerifyFailed
+	}
+
+	cacheIndexTouch(key, 1)
+	return newFilePath, nil
+}
+
+// CacheSource 缓存贴纸的原始文件，已存在时不重复保存
+//
+// 与转码后的文件共用容量及淘汰策略
+func CacheSource(uniqueID string, sourceFilePath string) error {
+	if cacheEnabled == false {
+		return errors.New("cache is DISABLED")
+	}
+	key := sourceCacheKey(uniqueID)
+	if rdb.Exists(ctx, key).Val() != 0 {
+		return nil
+	}
+	//记录已过期但尚未被清理时，先删除旧文件及索引
+	cacheEvict(key)
+
+	item := new(SourceItem)
+	item.FileUniqueID = uniqueID
+	item.SaveTimeStamp = time.Now().Unix()
+	item.FileExt = utils.GetFileExtName(sourceFilePath)
+	item.FileName = fmt.Sprintf("%d_%s.source.%s", item.SaveTimeStamp, utils.MD5(uniqueID), item.FileExt)
+
+	stat, err := os.Stat(sourceFilePath)
+	if err != nil {
+		return errors.New("os.Stat(sourceFilePath) error:" + err.Error())
+	}
+	item.Size = stat.Size()
+
+	fileMd5, err := utils.MD5File(sourceFilePath)
+	if err != nil {
+		return errors.New("utils.MD5File(sourceFilePath) error:" + err.Error())
+	}
+	item.MD5 = fileMd5
+
+	err = cacheStore.Put(item.FileName, sourceFilePath)
+	if err != nil {
+		return errors.New("Failed to store file:" + err.Error())
+	}
+
+	out, err := json.Marshal(item)
+	if err != nil {
+		return errors.New("json.Marshal(item) error:" + err.Error())
+	}
+	err = rdb.Set(ctx, key, string(out), CacheExpire).Err()
+	if err != nil {
+		return errors.New("Failed to store redis:" + err.Error())
+	}
+
+	err = cacheIndexAdd(key, item.SaveTimeStamp, item.Size, item.FileName)
+	if err != nil {
+		logger.Error.Println("[CacheSource]Failed to add index:", err)
+	}
+	//记录statistic(+)
+	statistics.Statistics.Record("StorageChange", int32(item.Size))
+	return nil
+}
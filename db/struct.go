@@ -3,14 +3,18 @@ package db
 import (
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/rroy233/StickerDownloader/utils"
 )
 
 type StickerItem struct {
 	//telegram sticker type
 	Info tgbotapi.Sticker `json:"info"`
 
-	//path of local-cached file
-	SavePath string `json:"save_path"`
+	//path of local-cached file, only in records of older versions
+	SavePath string `json:"save_path,omitempty"`
+
+	//name of cached file in the cache store
+	FileName string `json:"file_name"`
 
 	//file_id of converted sticker file
 	ConvertedFileID string `json:"converted_file_id"`
@@ -18,6 +22,9 @@ type StickerItem struct {
 	//time of caching
 	SaveTimeStamp int64 `json:"save_time_stamp"`
 
+	//options used to convert the sticker
+	utils.ConvertOptions
+
 	//extension of local-cached file
 	FileExt string `json:"file_ext"`
 
@@ -27,3 +34,42 @@ type StickerItem struct {
 	//size of local-cached file
 	Size int64 `json:"size"`
 }
+
+// SetArchiveItem 已上传的表情包压缩包
+type SetArchiveItem struct {
+	//name of sticker set
+	SetName string `json:"set_name"`
+
+	//hash of the sticker list and options
+	Hash string `json:"hash"`
+
+	//file_id of uploaded archive parts, in order
+	FileIDs []string `json:"file_ids"`
+
+	//number of stickers in the archives
+	Stickers int `json:"stickers"`
+
+	//time of caching
+	SaveTimeStamp int64 `json:"save_time_stamp"`
+}
+
+// SourceItem 贴纸的原始文件(webm/tgs/webp)，各转码选项共用
+type SourceItem struct {
+	//file_unique_id of sticker
+	FileUniqueID string `json:"file_unique_id"`
+
+	//name of cached file in the cache store
+	FileName string `json:"file_name"`
+
+	//time of caching
+	SaveTimeStamp int64 `json:"save_time_stamp"`
+
+	//extension of source file
+	FileExt string `json:"file_ext"`
+
+	//md5 of source file
+	MD5 string `json:"md5"`
+
+	//size of source file
+	Size int64 `json:"size"`
+}
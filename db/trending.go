@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"time"
+)
+
+// 表情包的请求次数按天记录，保留的天数
+const setTrendKeepDays = 30
+
+// SetTrend 表情包在统计周期内的请求次数
+type SetTrend struct {
+	Name     string
+	Requests int64
+}
+
+func setTrendKey(day time.Time) string {
+	return fmt.Sprintf("%s:Set_Trend:%s", ServicePrefix, day.Format("20060102"))
+}
+
+func warmupLockKey() string {
+	return fmt.Sprintf("%s:Cache_Warmup_Lock", ServicePrefix)
+}
+
+// RecordSetRequest 记录一次对表情包的请求，用于统计热门表情包
+func RecordSetRequest(setName string) {
+	if setName == "" {
+		return
+	}
+	key := setTrendKey(time.Now())
+	pipe := rdb.TxPipeline()
+	pipe.ZIncrBy(ctx, key, 1, setName)
+	pipe.Expire(ctx, key, setTrendKeepDays*24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error.Println("[RecordSetRequest]failed to record:", err)
+	}
+}
+
+// TopStickerSets 最近days天内请求次数最多的n个表情包，按请求次数倒序
+func TopStickerSets(days int, n int) ([]SetTrend, error) {
+	days = min(max(days, 1), setTrendKeepDays)
+	keys := make([]string, 0, days)
+	now := time.Now()
+	for i := 0; i < days; i++ {
+		keys = append(keys, setTrendKey(now.AddDate(0, 0, -i)))
+	}
+
+	//合并到临时key后排序
+	dest := fmt.Sprintf("%s:Set_Trend:Top_%s", ServicePrefix, utils.RandString())
+	pipe := rdb.TxPipeline()
+	pipe.ZUnionStore(ctx, dest, &redis.ZStore{Keys: keys})
+	result := pipe.ZRevRangeWithScores(ctx, dest, 0, int64(n)-1)
+	pipe.Del(ctx, dest)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	trends := make([]SetTrend, 0, len(result.Val()))
+	for _, z := range result.Val() {
+		name, _ := z.Member.(string)
+		trends = append(trends, SetTrend{Name: name, Requests: int64(z.Score)})
+	}
+	return trends, nil
+}
+
+// TryStartWarmup 多个实例中仅有一个在interval内执行预热
+func TryStartWarmup(interval time.Duration) bool {
+	ok, err := rdb.SetNX(ctx, warmupLockKey(), time.Now().Unix(), interval).Result()
+	if err != nil {
+		logger.Error.Println("[TryStartWarmup]failed to acquire lock:", err)
+		return false
+	}
+	return ok
+}
@@ -9,77 +9,236 @@ import (
 	"github.com/rroy233/StickerDownloader/utils"
 	"gopkg.in/rroy233/logger.v2"
 	"strconv"
+	"sync"
 	"time"
 )
 
-// CheckLimit Determines if the user has reached today's limit
-func CheckLimit(update *tgbotapi.Update) bool {
-	UID := int64(0)
-	if update.Message != nil {
-		UID = update.Message.Chat.ID
-	} else if update.CallbackQuery != nil {
-		UID = update.CallbackQuery.Message.Chat.ID
-	} else {
-		return true
-	}
-	if UID == config.Get().General.AdminUID {
-		return false
+// 配额统计窗口
+//
+// 每个窗口自首次使用时开始计时，到期后重新计算
+const (
+	WindowDaily   = "daily"
+	WindowWeekly  = "weekly"
+	WindowMonthly = "monthly"
+)
+
+var quotaWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{WindowDaily, 24 * time.Hour},
+	{WindowWeekly, 7 * 24 * time.Hour},
+	{WindowMonthly, 30 * 24 * time.Hour},
+}
+
+// WindowUsage 单个统计窗口的使用情况
+type WindowUsage struct {
+	Window string `json:"window"`
+	Used   int    `json:"used"`
+	//0 for unlimited
+	Limit int `json:"limit"`
+	//seconds until reset, -1 if the window has not started
+	ResetIn int64 `json:"reset_in"`
+}
+
+// Remaining 剩余可用次数，不限制时返回-1
+func (w WindowUsage) Remaining() int {
+	if w.Limit == 0 {
+		return -1
 	}
-	limit := rdb.Get(ctx, fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID)).Val()
-	if limit == "" {
-		rdb.Set(ctx, fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID), 1, 24*time.Hour)
-		return false
+	return max(w.Limit-w.Used, 0)
+}
+
+// 每日窗口沿用旧的key
+func usageKey(UID int64, window string) string {
+	if window == WindowDaily {
+		return fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID)
 	}
+	return fmt.Sprintf("%s:UserLimit:%d:%s", ServicePrefix, UID, window)
+}
 
-	limitTimes, _ := strconv.Atoi(limit)
-	if limitTimes > config.Get().General.UserDailyLimit {
-		return true
+func windowLimit(limits config.QuotaPlan, window string) int {
+	switch window {
+	case WindowWeekly:
+		return limits.Weekly
+	case WindowMonthly:
+		return limits.Monthly
 	}
-	return false
+	return limits.Daily
 }
 
-// ConsumeLimit Consume the current user's daily limit
-func ConsumeLimit(update *tgbotapi.Update) error {
-	UID := int64(0)
+var ErrorReachLimit = errors.New("ErrorReachLimit")
+
+// KEYS 各窗口的计数
+//
+// ARGV[1] 消耗的次数 ARGV[2i] KEYS[i]的有效期(s) ARGV[2i+1] KEYS[i]的上限，0为不限制
+//
+// 任一窗口超出上限时返回0且不做修改，否则全部窗口增加消耗并返回1
+var reserveScript = redis.NewScript(`
+local cost = tonumber(ARGV[1])
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[2 * i + 1])
+	if limit > 0 and tonumber(redis.call('GET', key) or '0') + cost > limit then
+		return 0
+	end
+end
+for i, key in ipairs(KEYS) do
+	redis.call('INCRBY', key, cost)
+	if redis.call('TTL', key) < 0 then
+		redis.call('EXPIRE', key, ARGV[2 * i])
+	end
+end
+return 1
+`)
+
+// KEYS 各窗口的计数
+//
+// ARGV[1] 退还的次数
+//
+// 窗口已过期重置的不再退还
+var refundScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('DECRBY', key, ARGV[1])
+	end
+end
+return 1
+`)
+
+// KEYS[1] 奖励标记 KEYS[2] 每日窗口计数
+//
+// ARGV[1] 奖励的次数 ARGV[2] 每日窗口有效期(s)
+//
+// 已奖励过返回0，否则减少当日消耗并返回1，不改变已有窗口的重置时间
+var rewardScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], '1', 'NX', 'EX', ARGV[2]) then
+	return 0
+end
+redis.call('DECRBY', KEYS[2], ARGV[1])
+if redis.call('TTL', KEYS[2]) < 0 then
+	redis.call('EXPIRE', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// 管理员不受配额限制
+func isQuotaExempt(UID int64) bool {
+	return config.HasAdminRole(UID, config.RoleOperator)
+}
+
+func getQuotaUID(update *tgbotapi.Update) (int64, error) {
 	if update.Message != nil {
-		UID = update.Message.Chat.ID
+		return update.Message.Chat.ID, nil
 	} else if update.CallbackQuery != nil {
-		UID = update.CallbackQuery.Message.Chat.ID
-	} else {
-		return errors.New("failed to get uid")
+		return update.CallbackQuery.Message.Chat.ID, nil
+	} else if update.InlineQuery != nil {
+		return update.InlineQuery.From.ID, nil
 	}
+	return 0, errors.New("failed to get uid")
+}
+
+// Reservation 预扣的使用次数
+//
+// 处理成功后调用Commit()确认，失败时调用Refund()退还；
+// 已确认或已退还后再次调用均无效果，可直接 defer Refund()
+type Reservation struct {
+	UID     int64
+	cost    int
+	keys    []string
+	settled bool
+	lock    sync.Mutex
+}
 
-	limit := rdb.Get(ctx, fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID)).Val()
-	if limit == "" {
-		rdb.Set(ctx, fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID), 1, 24*time.Hour)
-		return nil
+// ReserveLimit 原子地检查并预扣当前用户各统计窗口的次数
+//
+// 任一窗口超出上限时返回ErrorReachLimit
+func ReserveLimit(update *tgbotapi.Update, cost int) (*Reservation, error) {
+	UID, err := getQuotaUID(update)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reservation{UID: UID, cost: cost}
+	if isQuotaExempt(UID) {
+		//不计数
+		r.settled = true
+		return r, nil
 	}
 
-	limitTimes, _ := strconv.Atoi(limit)
-	rdb.Set(ctx, fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID), limitTimes+1, redis.KeepTTL)
-	return nil
+	limits := GetPlanLimits(GetPlan(UID))
+	args := make([]interface{}, 0, 2*len(quotaWindows)+1)
+	args = append(args, cost)
+	for _, window := range quotaWindows {
+		r.keys = append(r.keys, usageKey(UID, window.name))
+		args = append(args, int64(window.duration/time.Second), windowLimit(limits, window.name))
+	}
+	ok, err := reserveScript.Run(ctx, rdb, r.keys, args...).Int()
+	if err != nil {
+		return nil, err
+	}
+	if ok == 0 {
+		return nil, ErrorReachLimit
+	}
+	return r, nil
 }
 
-// 获取该用户已使用的次数
-func getUsed(UID int64) int {
-	limit := rdb.Get(ctx, fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID)).Val()
-	if limit == "" {
-		return -1
+// Commit 确认预扣的次数
+func (r *Reservation) Commit() {
+	r.Settle(r.cost)
+}
+
+// Refund 退还预扣的全部次数
+func (r *Reservation) Refund() {
+	r.Settle(0)
+}
+
+// Settle 按实际消耗used确认，退还多预扣的部分
+func (r *Reservation) Settle(used int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.settled {
+		return
+	}
+	r.settled = true
+	if refund := r.cost - max(used, 0); refund > 0 {
+		if err := refundScript.Run(ctx, rdb, r.keys, refund).Err(); err != nil {
+			logger.Error.Printf("[Reservation]failed to refund %d of %d: %s", refund, r.UID, err)
+		}
+	}
+}
+
+// GetUsage 获取用户在各统计窗口内的使用情况
+func GetUsage(UID int64) []WindowUsage {
+	limits := GetPlanLimits(GetPlan(UID))
+	list := make([]WindowUsage, 0, len(quotaWindows))
+	for _, window := range quotaWindows {
+		usage := WindowUsage{
+			Window:  window.name,
+			Limit:   windowLimit(limits, window.name),
+			ResetIn: -1,
+		}
+		usage.Used, _ = strconv.Atoi(rdb.Get(ctx, usageKey(UID, window.name)).Val())
+		if ttl := rdb.TTL(ctx, usageKey(UID, window.name)).Val(); ttl > 0 {
+			usage.ResetIn = int64(ttl.Seconds())
+		}
+		list = append(list, usage)
 	}
-	limitTimes, _ := strconv.Atoi(limit)
-	return limitTimes
+	return list
 }
 
-// GetLimit 获取该用户今日剩余可用次数
+// GetLimit 获取该用户剩余可用次数，取各窗口中的最小值
+//
+// 不受限制时返回-1
 func GetLimit(UID int64) int {
-	if UID == config.Get().General.AdminUID {
+	if isQuotaExempt(UID) {
 		return -1
 	}
-	limitTimes := getUsed(UID)
-	if limitTimes == -1 {
-		return config.Get().General.UserDailyLimit
+	remaining := -1
+	for _, usage := range GetUsage(UID) {
+		if r := usage.Remaining(); r != -1 && (remaining == -1 || r < remaining) {
+			remaining = r
+		}
 	}
-	return config.Get().General.UserDailyLimit - limitTimes
+	return remaining
 }
 
 // RewardDailyOnce increases user's usage limit once per day (if not already rewarded)
@@ -87,27 +246,36 @@ func RewardDailyOnce(update *tgbotapi.Update, reward int) int {
 	UID := utils.GetUID(update)
 
 	rewardKey := fmt.Sprintf("%s:DailyRewarded:%d", ServicePrefix, UID)
-	rewarded, err := rdb.Get(ctx, rewardKey).Result()
-	if err == nil && rewarded == "1" {
-		// Already rewarded today
+	ok, err := rewardScript.Run(ctx, rdb, []string{rewardKey, usageKey(UID, WindowDaily)}, reward, int64(quotaWindows[0].duration/time.Second)).Int()
+	if err != nil {
+		logger.Error.Println("[RewardDailyOnce]failed to reward:", err)
 		return 0
 	}
-
-	// Mark as rewarded today with 24h expiry
-	rdb.Set(ctx, rewardKey, "1", 24*time.Hour)
-
-	// Increase usage limit
-	limitKey := fmt.Sprintf("%s:UserLimit:%d", ServicePrefix, UID)
-	limit := rdb.Get(ctx, limitKey).Val()
-	if limit == "" {
-		rdb.Set(ctx, limitKey, reward, 24*time.Hour)
+	if ok == 0 {
+		// Already rewarded today
 		return 0
 	}
 
-	limitTimes, _ := strconv.Atoi(limit)
-	rdb.Set(ctx, limitKey, limitTimes+reward, 24*time.Hour)
-
-	logger.Info.Printf("%s [RewardDailyOnce] ADD [%d] -> [%d]", utils.LogUserInfo(update), reward, limitTimes+reward)
-
+	logger.Info.Printf("%s [RewardDailyOnce] ADD [%d]", utils.LogUserInfo(update), reward)
 	return reward
 }
+
+// SetUsed 修改用户在统计窗口内已使用的次数
+//
+// 保留原有的重置时间，used为0时直接删除记录
+func SetUsed(UID int64, window string, used int) error {
+	for _, w := range quotaWindows {
+		if w.name != window {
+			continue
+		}
+		key := usageKey(UID, window)
+		if used <= 0 {
+			return rdb.Del(ctx, key).Err()
+		}
+		if rdb.Exists(ctx, key).Val() == 0 {
+			return rdb.Set(ctx, key, used, w.duration).Err()
+		}
+		return rdb.Set(ctx, key, used, redis.KeepTTL).Err()
+	}
+	return fmt.Errorf("unknown window: %s", window)
+}
@@ -6,20 +6,19 @@ toolchain go1.23.9
 
 require (
 	github.com/OvyFlash/telegram-bot-api v0.0.0-20250501121306-e13ca08617c9
+	github.com/caarlos0/env/v11 v11.3.1
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/go-sql-driver/mysql v1.7.0
 	github.com/google/uuid v1.3.0
-	go.uber.org/ratelimit v0.2.0
+	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.17.11
 	gopkg.in/rroy233/logger.v2 v2.0.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/andres-erbsen/clock v0.0.0-20160526145045-9e14626cd129 // indirect
-	github.com/caarlos0/env/v11 v11.3.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	golang.org/x/sys v0.10.0 // indirect
 )
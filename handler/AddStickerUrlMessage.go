@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/rroy233/StickerDownloader/config"
@@ -39,13 +40,7 @@ func AddStickerUrlMessage(update tgbotapi.Update) {
 
 	if config.Get().General.SupportTGSFile == false {
 		//try to download one
-		remoteFile, err := utils.BotGetFile(tgbotapi.FileConfig{
-			FileID: stickerSet.Stickers[0].FileID,
-		})
-		if err != nil {
-			logger.Error.Println(userInfo+"failed to get file:", err)
-		}
-		tempFilePath, err := utils.DownloadFile(remoteFile.Link(config.Get().General.BotToken))
+		tempFilePath, err := downloadSticker(context.Background(), stickerSet.Stickers[0])
 		if err != nil {
 			logger.Error.Println(userInfo+"failed to download file:", err)
 		}
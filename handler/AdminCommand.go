@@ -4,16 +4,19 @@ import (
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/rroy233/StickerDownloader/config"
-	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/utils"
 )
 
 func AdminCommand(update tgbotapi.Update) {
-	if update.Message.Chat.ID != config.Get().General.AdminUID {
-		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrNoPermission)
-		return
-	}
+	role := config.GetAdminRole(update.Message.From.ID)
 
-	utils.SendPlainText(&update, fmt.Sprintf("Admin Command\n\nReload Config /reload\nClear Cache /clearcache\nWeek Statistics /statistics"))
+	text := fmt.Sprintf("Admin Command (%s)\n\nWeek Statistics /statistics\nTop Sticker Sets /topsets", role)
+	if role >= config.RoleOperator {
+		text += "\nClear Cache /clearcache\nSet Quota Plan /setplan <uid> <free|supporter|vip> [30d]"
+	}
+	if role >= config.RoleOwner {
+		text += "\nReload Config /reload\nBan User /ban <uid> [30m|12h|7d] [reason]\nUnban User /unban <uid>\nBan List /banlist"
+	}
+	utils.SendPlainText(&update, text)
 	return
 }
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
-	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/converter"
 	"github.com/rroy233/StickerDownloader/db"
 	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/utils"
@@ -15,6 +15,13 @@ import (
 func AnimationMessage(update tgbotapi.Update) {
 	userInfo := utils.GetLogPrefixMessage(&update)
 
+	//预扣次数，处理失败时退还
+	reservation, quit := reserveLimit(&update, db.AnimationCost())
+	if quit == true {
+		return
+	}
+	defer reservation.Refund()
+
 	oMsg := tgbotapi.NewMessage(update.Message.Chat.ID, languages.Get(&update).BotMsg.Processing)
 	oMsg.ReplyParameters.MessageID = update.Message.MessageID
 	msg, err := utils.BotSend(oMsg)
@@ -37,7 +44,7 @@ func AnimationMessage(update tgbotapi.Update) {
 		logger.Error.Println(userInfo+"failed to get file:", err)
 	}
 
-	tempFilePath, err := utils.DownloadFile(remoteFile.Link(config.Get().General.BotToken))
+	tempFilePath, err := utils.DownloadFile(context.Background(), remoteFile)
 	if err != nil {
 		logger.Error.Println(userInfo+"failed to download file:", err)
 	}
@@ -54,7 +61,8 @@ func AnimationMessage(update tgbotapi.Update) {
 	}
 
 	//path to save converted file
-	outPath := fmt.Sprintf("./storage/tmp/convert_%d.gif", time.Now().UnixMicro())
+	opts := getUserPreference(&update).ConvertOptions()
+	outPath := fmt.Sprintf("./storage/tmp/convert_%d.%s", time.Now().UnixMicro(), opts.OutputFormat.Ext())
 	defer func() {
 		utils.RemoveFile(outPath)
 	}()
@@ -64,10 +72,11 @@ func AnimationMessage(update tgbotapi.Update) {
 		InputFilePath:  tempFilePath,
 		InputExtension: "mp4",
 		OutputFilePath: outPath,
+		ConvertOptions: opts,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	err = convertTask.Run(ctx)
+	err = converter.Convert(ctx, &convertTask)
 	cancel()
 	if err != nil {
 		logger.Error.Println(userInfo+"failed to convert:", err)
@@ -90,10 +99,8 @@ func AnimationMessage(update tgbotapi.Update) {
 		return
 	}
 
-	//Consume the current user's daily limit
-	if err = db.ConsumeLimit(&update); err != nil {
-		logger.Error.Println(userInfo + err.Error())
-	}
+	//Consume the current user's limit
+	reservation.Commit()
 
 	utils.EditMsgText(update.Message.Chat.ID, msg.MessageID, languages.Get(&update).BotMsg.ConvertCompleted)
 	if err != nil {
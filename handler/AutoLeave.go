@@ -2,6 +2,7 @@ package handler
 
 import (
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/utils"
 	"gopkg.in/rroy233/logger.v2"
 )
@@ -12,7 +13,7 @@ func AutoLeave(update tgbotapi.Update) {
 	var ChatUsername string
 	if update.MyChatMember != nil && (update.MyChatMember.Chat.Type == "channel" || update.MyChatMember.Chat.Type == "group" || update.MyChatMember.Chat.Type == "supergroup") {
 		//add to channel or group
-		if update.MyChatMember.NewChatMember.Status == "left" && update.MyChatMember.NewChatMember.User.UserName == utils.BotGetSelf().UserName {
+		if (update.MyChatMember.NewChatMember.Status == "left" || update.MyChatMember.NewChatMember.Status == "kicked") && update.MyChatMember.NewChatMember.User.UserName == utils.BotGetSelf().UserName {
 			logger.Info.Println("AutoLeave - Response Got!!!," + utils.JsonEncode(update))
 			return
 		}
@@ -26,9 +27,9 @@ func AutoLeave(update tgbotapi.Update) {
 		//edit channel post
 		chatID = update.EditedChannelPost.SenderChat.ID
 		ChatUsername = update.EditedChannelPost.SenderChat.UserName
-	} else if update.Message != nil && update.Message.LeftChatMember != nil && (update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup") {
+	} else if update.Message != nil && (update.Message.Chat.Type == "group" || update.Message.Chat.Type == "supergroup") {
 		//group message
-		if update.Message.LeftChatMember.UserName == utils.BotGetSelf().UserName {
+		if update.Message.LeftChatMember != nil && update.Message.LeftChatMember.UserName == utils.BotGetSelf().UserName {
 			logger.Info.Println("AutoLeave - Response Got!!!," + utils.JsonEncode(update))
 			return
 		}
@@ -41,8 +42,7 @@ func AutoLeave(update tgbotapi.Update) {
 	}
 
 	//notice
-	text := "StickerDownloader currently does not support groups/channels. For more details, please visit https://github.com/rroy233/StickerDownloader."
-	msg := tgbotapi.NewMessage(chatID, text)
+	msg := tgbotapi.NewMessage(chatID, languages.Get(&update).BotMsg.GroupNotSupported)
 	nMsg, err := utils.BotSend(msg)
 	if err != nil {
 		logger.Error.Printf("AutoLeave - Failed to send notice:%s,%s", err.Error(), utils.JsonEncode(update))
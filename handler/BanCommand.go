@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const banUsage = "Usage: /ban <uid> [30m|12h|7d] [reason]\nBan permanently if duration is omitted"
+
+// BanCommand /ban <uid> [duration] [reason]
+func BanCommand(update tgbotapi.Update) {
+	args := strings.Fields(update.Message.CommandArguments())
+	if len(args) == 0 {
+		utils.SendPlainText(&update, banUsage)
+		return
+	}
+	UID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || UID <= 0 {
+		utils.SendPlainText(&update, banUsage)
+		return
+	}
+	if config.GetAdminRole(UID) != config.RoleNone {
+		utils.SendPlainText(&update, "Admins can not be banned")
+		return
+	}
+
+	duration := time.Duration(0)
+	args = args[1:]
+	if len(args) != 0 {
+		if d, err := parseDurationArg(args[0]); err == nil {
+			duration = d
+			args = args[1:]
+		}
+	}
+
+	info, err := db.Ban(UID, duration, strings.Join(args, " "), update.Message.From.ID)
+	if err != nil {
+		logger.Error.Println(utils.LogUserInfo(&update)+"[BanCommand]failed to ban:", err)
+		utils.SendPlainText(&update, "Failed: "+err.Error())
+		return
+	}
+	logger.Info.Printf("%s[BanCommand]banned %d until %s", utils.LogUserInfo(&update), UID, formatBanExpire(info))
+	utils.SendPlainText(&update, fmt.Sprintf("Banned %d until %s", UID, formatBanExpire(info)))
+	return
+}
+
+// UnbanCommand /unban <uid>
+func UnbanCommand(update tgbotapi.Update) {
+	UID, err := strconv.ParseInt(strings.TrimSpace(update.Message.CommandArguments()), 10, 64)
+	if err != nil {
+		utils.SendPlainText(&update, "Usage: /unban <uid>")
+		return
+	}
+	banned, err := db.Unban(UID)
+	if err != nil {
+		logger.Error.Println(utils.LogUserInfo(&update)+"[UnbanCommand]failed to unban:", err)
+		utils.SendPlainText(&update, "Failed: "+err.Error())
+		return
+	}
+	if !banned {
+		utils.SendPlainText(&update, fmt.Sprintf("%d is not banned", UID))
+		return
+	}
+	logger.Info.Printf("%s[UnbanCommand]unbanned %d", utils.LogUserInfo(&update), UID)
+	utils.SendPlainText(&update, fmt.Sprintf("Unbanned %d", UID))
+	return
+}
+
+func BanListCommand(update tgbotapi.Update) {
+	list, err := db.BanList()
+	if err != nil {
+		utils.SendPlainText(&update, "Failed: "+err.Error())
+		return
+	}
+	if len(list) == 0 {
+		utils.SendPlainText(&update, "Ban List\n\nempty")
+		return
+	}
+
+	text := strings.Builder{}
+	text.WriteString(fmt.Sprintf("Ban List (%d)\n", len(list)))
+	for _, info := range list {
+		by := "auto"
+		if info.By != 0 {
+			by = strconv.FormatInt(info.By, 10)
+		}
+		text.WriteString(fmt.Sprintf("\n%d until %s by %s", info.UID, formatBanExpire(info), by))
+		if info.Reason != "" {
+			text.WriteString("\n  " + info.Reason)
+		}
+	}
+	utils.SendPlainText(&update, text.String())
+	return
+}
+
+// 解析命令中的时长，支持time.ParseDuration的格式及以d结尾的天数
+func parseDurationArg(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return d, nil
+}
+
+func formatBanExpire(info *db.BanInfo) string {
+	if info.ExpireAt == 0 {
+		return "forever"
+	}
+	return time.Unix(info.ExpireAt, 0).Format("2006-01-02 15:04:05")
+}
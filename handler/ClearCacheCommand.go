@@ -2,7 +2,6 @@ package handler
 
 import (
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
-	"github.com/rroy233/StickerDownloader/config"
 	"github.com/rroy233/StickerDownloader/db"
 	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/utils"
@@ -10,11 +9,6 @@ import (
 )
 
 func ClearCacheCommand(update tgbotapi.Update) {
-	if update.Message.Chat.ID != config.Get().General.AdminUID {
-		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrNoPermission)
-		return
-	}
-
 	out, err := db.ClearCache()
 	if err != nil {
 		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrSysFailureOccurred)
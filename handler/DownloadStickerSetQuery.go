@@ -7,11 +7,12 @@ import (
 	"github.com/rroy233/StickerDownloader/config"
 	"github.com/rroy233/StickerDownloader/db"
 	"github.com/rroy233/StickerDownloader/languages"
-	"github.com/rroy233/StickerDownloader/statistics"
 	"github.com/rroy233/StickerDownloader/utils"
 	"gopkg.in/rroy233/logger.v2"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,13 +22,16 @@ const MB = 1 << 20
 const Hour = int64(3600)
 
 type downloadTask struct {
+	//已加入分包的贴纸数量
 	finished      int32
-	failed        int32
 	total         int32
 	folderName    string
 	batchManager  *batchManager
 	update        *tgbotapi.Update
 	msgID         int
+	preference    *db.UserPreference
+	manifest      *manifestRecorder
+	job           *setJob
 	uploadWg      sync.WaitGroup
 }
 
@@ -38,12 +42,15 @@ type batchManager struct {
 	batchIndex        int
 	maxBatchSize      int64
 	uploadedParts     int
+	failedParts       int
+	//各分包上传后的file_id
+	fileIDs map[int]string
 }
 
 func DownloadStickerSetQuery(update tgbotapi.Update) {
 	userInfo := utils.GetLogPrefixCallbackQuery(&update)
 
-	if update.CallbackQuery.Message.ReplyToMessage == nil {
+	if update.CallbackQuery.Message.ReplyToMessage == nil || update.CallbackQuery.Message.ReplyToMessage.Sticker == nil {
 		logger.Error.Println(userInfo+"DownloadStickerSetQuery-failed to GetStickerSet:", "Msg deleted")
 		utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(&update).BotMsg.ErrFailedToDownload)
 		return
@@ -57,6 +64,7 @@ func DownloadStickerSetQuery(update tgbotapi.Update) {
 		utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(&update).BotMsg.ErrFailedToDownload)
 		return
 	}
+	db.RecordSetRequest(stickerSet.Name)
 
 	if len(stickerSet.Stickers) > config.Get().General.MaxAmountPerReq {
 		logger.Info.Println(userInfo + "DownloadStickerSetQuery- amount > max_amount_per_req")
@@ -64,6 +72,13 @@ func DownloadStickerSetQuery(update tgbotapi.Update) {
 		return
 	}
 
+	//按贴纸数量预扣次数，处理失败时退还
+	reservation, quit := reserveLimit(&update, db.StickerSetCost(len(stickerSet.Stickers)))
+	if quit == true {
+		return
+	}
+	defer reservation.Refund()
+
 	if time.Now().Unix()-int64(update.CallbackQuery.Message.Date) < 48*Hour {
 		utils.DeleteMsg(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID)
 	} else {
@@ -72,6 +87,18 @@ func DownloadStickerSetQuery(update tgbotapi.Update) {
 
 	utils.CallBack(update.CallbackQuery.ID, "ok")
 
+	//整套表情包已上传过时直接通过file_id发送
+	pref := getUserPreference(&update)
+	archiveHash := setArchiveHash(stickerSet, pref)
+	if archive, err := db.FindSetArchiveCache(archiveHash); err == nil {
+		if sendCachedSetArchive(&update, archive) {
+			logger.Info.Printf("%sDownloadStickerSetQuery-sent %d cached parts of %s", userInfo, len(archive.FileIDs), stickerSet.Name)
+			reservation.Settle(db.StickerSetCost(archive.Stickers))
+			return
+		}
+		db.RemoveSetArchiveCache(archiveHash)
+	}
+
 	oMsg := tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, languages.Get(&update).BotMsg.Processing)
 	oMsg.ReplyParameters.MessageID = update.CallbackQuery.Message.ReplyToMessage.MessageID
 	msg, err := utils.BotSend(oMsg)
@@ -100,25 +127,26 @@ func DownloadStickerSetQuery(update tgbotapi.Update) {
 		}
 	}()
 
-	cancelCtx, cancel := context.WithCancel(context.Background())
-	queue := make(chan tgbotapi.Sticker, 10)
 	task := &downloadTask{
 		total:        int32(len(stickerSet.Stickers)),
 		folderName:   folderPath,
 		batchManager: newBatchManager(),
 		update:       &update,
 		msgID:        msg.MessageID,
+		preference:   pref,
+		manifest:     newManifestRecorder(stickerSet),
 	}
-	for i := 0; i < config.Get().General.DownloadWorkerNum; i++ {
-		go downloadWorker(cancelCtx, queue, task)
+
+	//相同的表情包正在下载时共享同一任务，超时中断的任务再次请求时继续
+	job, attached := attachSetJob(stickerSet, task.preference)
+	defer job.detach()
+	task.job = job
+	if attached {
+		logger.Info.Printf("%sDownloadStickerSetQuery-attached to job %s", userInfo, job.key)
 	}
 	timeStart := time.Now()
-	go func() {
-		for _, sticker := range stickerSet.Stickers {
-			queue <- sticker
-		}
-	}()
 
+	cancelCtx, cancel := context.WithCancel(context.Background())
 	var progressWg sync.WaitGroup
 	progressWg.Add(1)
 	go func() {
@@ -131,9 +159,9 @@ func DownloadStickerSetQuery(update tgbotapi.Update) {
 			case <-cancelCtx.Done():
 				return
 			case <-ticker.C:
-				newText := fmt.Sprintf(languages.Get(&update).BotMsg.DownloadingWithProgress, task.finished+task.failed, task.total)
+				newText := fmt.Sprintf(languages.Get(&update).BotMsg.DownloadingWithProgress, job.progress(), task.total)
 				if text != newText {
-					utils.EditMsgText(update.CallbackQuery.Message.Chat.ID, msg.MessageID, newText)
+					utils.EditMsgProgress(update.CallbackQuery.Message.Chat.ID, msg.MessageID, newText)
 					text = newText
 				}
 			}
@@ -143,18 +171,25 @@ func DownloadStickerSetQuery(update tgbotapi.Update) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 	success := true
+	next := 0
 loop:
 	for {
+		outputs, running, changed := job.outputsFrom(next)
+		next += len(outputs)
+		for _, output := range outputs {
+			task.deliver(output)
+		}
+		if !running {
+			break
+		}
 		select {
+		case <-changed:
 		case <-ticker.C:
 			if int(time.Now().Sub(timeStart).Seconds()) > ProcessTimeout {
 				success = false
 				logger.Error.Println(userInfo+"DownloadStickerSetQuery-Task Timeout:", task)
 				break loop
 			}
-			if task.finished+task.failed == task.total {
-				break loop
-			}
 		}
 	}
 	cancel()
@@ -162,12 +197,36 @@ loop:
 	progressWg.Wait()
 
 	if !success {
-		utils.EditMsgText(update.CallbackQuery.Message.Chat.ID, msg.MessageID, fmt.Sprintf(languages.Get(&update).BotMsg.ErrTimeout))
+		//超时前已完成的贴纸仍上传并扣除，其余退还
+		task.flushBatch()
+		task.settle(reservation)
+		utils.EditMsgText(update.CallbackQuery.Message.Chat.ID, msg.MessageID,
+			fmt.Sprintf(languages.Get(&update).BotMsg.ErrTimeoutResumable, job.progress(), task.total, int(setJobKeep.Minutes())))
 		return
 	}
 
 	dequeue(qItem)
 
+	task.flushBatch()
+
+	text := fmt.Sprintf(languages.Get(&update).BotMsg.UploadedParts, stickerSet.Name, task.batchManager.uploadedParts)
+	utils.EditMsgText(update.CallbackQuery.Message.Chat.ID, msg.MessageID, text, utils.EntityBold(text, stickerSet.Name))
+	logger.Info.Printf("%sDownloadStickerSetQuery-streaming upload completed successfully (%d parts)", userInfo, task.batchManager.uploadedParts)
+
+	//全部贴纸均已上传时缓存各分包的file_id
+	if config.Get().Cache.Enabled == true && task.finished == task.total {
+		if fileIDs := task.batchManager.archiveFileIDs(); fileIDs != nil {
+			if err := db.CacheSetArchive(stickerSet.Name, archiveHash, fileIDs, int(task.finished)); err != nil {
+				logger.Error.Println(userInfo+"DownloadStickerSetQuery-failed to cache archive:", err)
+			}
+		}
+	}
+
+	task.settle(reservation)
+}
+
+// 上传最后一个未满的分包
+func (task *downloadTask) flushBatch() {
 	task.batchManager.Lock()
 	finalFiles := make([]string, len(task.batchManager.currentBatchFiles))
 	copy(finalFiles, task.batchManager.currentBatchFiles)
@@ -183,112 +242,56 @@ loop:
 			task.batchManager.Unlock()
 		}
 	}
+}
 
-	text := fmt.Sprintf("上传成功！！\n表情包名:%s\n已上传 %d 个文件包", stickerSet.Name, task.batchManager.uploadedParts)
-	utils.EditMsgText(update.CallbackQuery.Message.Chat.ID, msg.MessageID, text, utils.EntityBold(text, stickerSet.Name))
-	logger.Info.Printf("%sDownloadStickerSetQuery-streaming upload completed successfully (%d parts)", userInfo, task.batchManager.uploadedParts)
-
-	if err = db.ConsumeLimit(&update); err != nil {
-		logger.Error.Println(userInfo + "DownloadStickerSetQuery - " + err.Error())
+// 按成功转换的贴纸数量扣除，其余退还
+func (task *downloadTask) settle(reservation *db.Reservation) {
+	if task.batchManager.uploadedParts != 0 && task.finished != 0 {
+		reservation.Settle(db.StickerSetCost(int(task.finished)))
 	}
 }
 
-func downloadWorker(ctx context.Context, queue chan tgbotapi.Sticker, task *downloadTask) {
-	var sticker tgbotapi.Sticker
-	for {
-		select {
-		case <-ctx.Done():
+// 将任务中完成的贴纸复制到本次请求的目录并加入分包
+func (task *downloadTask) deliver(output *setJobOutput) {
+	userInfo := utils.GetLogPrefixCallbackQuery(task.update)
+	for i, file := range output.files {
+		filePath := filepath.Join(task.folderName, filepath.Base(file))
+		if err := utils.CopyFile(file, filePath); err != nil {
+			logger.Error.Printf("%sDownloadStickerSetQuery-failed to copy：%s", userInfo, err.Error())
 			return
-		case sticker = <-queue:
-			i := task.finished + task.failed
-			sum := task.total
-			stickerInfo := utils.JsonEncode(sticker)
-			var outputFilePath string
-			var fileExt string
-
-			cacheTmpFile, err := db.FindStickerCache(sticker.FileUniqueID)
-			if err == nil {
-				statistics.Statistics.Record("CacheHit", 1)
-				fileExt = utils.GetFileExtName(cacheTmpFile)
-				outputFilePath = fmt.Sprintf("%s/%s.%s", task.folderName, sticker.FileUniqueID, fileExt)
-				err := utils.CopyFile(cacheTmpFile, outputFilePath)
-				utils.RemoveFile(cacheTmpFile)
-				if err != nil {
-					logger.Error.Printf("DownloadStickerSetQuery[%d/%d]-failed to copy：%s,%s", i, sum, err.Error(), stickerInfo)
-					atomic.AddInt32(&task.failed, 1)
-					continue
-				}
-			} else {
-				statistics.Statistics.Record("CacheMiss", 1)
-				remoteFile, err := utils.BotGetFile(tgbotapi.FileConfig{
-					FileID: sticker.FileID,
-				})
-				if err != nil {
-					logger.Error.Printf("DownloadStickerSetQuery[%d/%d]-failed to get file:%s,%s", i, sum, err.Error(), stickerInfo)
-					atomic.AddInt32(&task.failed, 1)
-					continue
-				}
-
-				tempFilePath, err := utils.DownloadFile(remoteFile.Link(config.Get().General.BotToken))
-				if err != nil {
-					logger.Error.Printf("DownloadStickerSetQuery[%d/%d]-failed to download:%s,%s", i, sum, err.Error(), stickerInfo)
-					atomic.AddInt32(&task.failed, 1)
-					continue
-				}
-
-				fileExt = "gif"
-				if utils.GetFileExtName(tempFilePath) == "webp" {
-					fileExt = "png"
-				}
-
-				outputFilePath = fmt.Sprintf("%s/%s.%s", task.folderName, sticker.FileUniqueID, fileExt)
-
-				convertTask := utils.ConvertTask{
-					InputFilePath:  tempFilePath,
-					InputExtension: utils.GetFileExtName(tempFilePath),
-					OutputFilePath: outputFilePath,
-				}
-
-				if utils.GetFileExtName(tempFilePath) == "tgs" && config.Get().General.SupportTGSFile {
-					convertTask.PreserveJsonPath = fmt.Sprintf("%s/%s.json", task.folderName, sticker.FileUniqueID)
-				}
-
-				err = convertTask.Run(ctx)
-				utils.RemoveFile(tempFilePath)
-				if err != nil {
-					logger.Error.Printf("DownloadStickerSetQuery[%d/%d]-failed to convert：%s,%s\n", i, sum, err.Error(), stickerInfo)
-					atomic.AddInt32(&task.failed, 1)
-					continue
-				}
-				if config.Get().Cache.Enabled == true {
-					if _, err := db.CacheSticker(sticker, convertTask.OutputFilePath); err != nil {
-						logger.Error.Printf("DownloadStickerSetQuery[%d/%d]-failed to Save Cache:%s,%s", i, sum, err.Error(), stickerInfo)
-					}
-				}
-			}
-
-			if task.batchManager != nil {
-				if fileInfo, err := os.Stat(outputFilePath); err == nil {
-					for {
-						if !task.batchManager.addFileAndCheckAtomic(outputFilePath, fileInfo.Size()) {
-							break
-						}
-						task.uploadWg.Add(1)
-						task.batchManager.uploadBatch(task)
-						task.uploadWg.Done()
-					}
-				}
-			}
+		}
+		if i == 0 {
+			task.manifest.add(output.sticker, filePath, output.format)
+		}
+		task.addToBatch(filePath)
+	}
+	atomic.AddInt32(&task.finished, 1)
+}
 
-			atomic.AddInt32(&task.finished, 1)
+// 将文件加入当前分包，分包将超出大小时先上传当前分包
+func (task *downloadTask) addToBatch(filePath string) {
+	if task.batchManager == nil {
+		return
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	for {
+		if !task.batchManager.addFileAndCheckAtomic(filePath, fileInfo.Size()) {
+			break
 		}
+		task.uploadWg.Add(1)
+		task.batchManager.uploadBatch(task)
+		task.uploadWg.Done()
 	}
 }
 
 func newBatchManager() *batchManager {
 	return &batchManager{
 		currentBatchFiles: []string{},
-		maxBatchSize:      50 * MB,
+		maxBatchSize:      utils.MaxUploadSize(),
+		fileIDs:           make(map[int]string),
 	}
 }
 
@@ -322,8 +325,8 @@ func (bm *batchManager) uploadBatch(task *downloadTask) {
 		bm.Lock()
 		bm.uploadedParts++
 		bm.Unlock()
-		utils.EditMsgText(task.update.CallbackQuery.Message.Chat.ID, task.msgID,
-			fmt.Sprintf(languages.Get(task.update).BotMsg.DownloadingWithProgress, task.finished+task.failed, task.total))
+		utils.EditMsgProgress(task.update.CallbackQuery.Message.Chat.ID, task.msgID,
+			fmt.Sprintf(languages.Get(task.update).BotMsg.DownloadingWithProgress, task.job.progress(), task.total))
 	}
 }
 
@@ -360,19 +363,64 @@ func (bm *batchManager) uploadBatchFiles(task *downloadTask, filePaths []string,
 	}
 	logger.Info.Printf("%sUploading batch %d (%.2f MB, %d files)", userInfo, batchIndex, float64(actualSize)/(1024*1024), len(filePaths))
 
-	zipFilePath := fmt.Sprintf("%s_part-%d.zip", task.folderName, batchIndex)
-	if err := utils.Compress(batchFolder, zipFilePath); err != nil {
+	if err := task.manifest.write(batchFolder, batchIndex+1); err != nil {
+		logger.Error.Printf("%sFailed to write manifest: %v", userInfo, err)
+	}
+
+	zipFilePath := fmt.Sprintf("%s_part-%d.%s", task.folderName, batchIndex, task.preference.ArchiveFormat)
+	if err := utils.Archive(task.preference.ArchiveFormat, batchFolder, zipFilePath); err != nil {
 		logger.Error.Printf("%sFailed to compress batch: %v", userInfo, err)
 		return false
 	}
 	defer utils.RemoveFile(zipFilePath)
 
 	utils.SendAction(task.update.CallbackQuery.Message.Chat.ID, utils.ChatActionSendDocument)
-	if _, err := utils.SendFileByPath(task.update, zipFilePath); err != nil {
+	sentMsg, err := utils.SendFileByPath(task.update, zipFilePath)
+	if err != nil {
 		logger.Error.Printf("%sFailed to upload batch: %v", userInfo, err)
+		bm.Lock()
+		bm.failedParts++
+		bm.Unlock()
 		return false
 	}
+	if sentMsg.Document != nil {
+		bm.Lock()
+		bm.fileIDs[batchIndex] = sentMsg.Document.FileID
+		bm.Unlock()
+	}
 
 	logger.Info.Printf("%sBatch %d uploaded successfully", userInfo, batchIndex)
 	return true
 }
+
+// 所有分包均上传成功时按顺序返回file_id，否则返回nil
+func (bm *batchManager) archiveFileIDs() []string {
+	bm.Lock()
+	defer bm.Unlock()
+	if bm.failedParts != 0 || bm.uploadedParts == 0 || len(bm.fileIDs) != bm.uploadedParts {
+		return nil
+	}
+	fileIDs := make([]string, 0, len(bm.fileIDs))
+	for _, index := range slices.Sorted(maps.Keys(bm.fileIDs)) {
+		fileIDs = append(fileIDs, bm.fileIDs[index])
+	}
+	return fileIDs
+}
+
+// 通过file_id发送缓存的各分包，任一分包发送失败时返回false
+func sendCachedSetArchive(update *tgbotapi.Update, archive *db.SetArchiveItem) bool {
+	userInfo := utils.GetLogPrefixCallbackQuery(update)
+	for i, fileID := range archive.FileIDs {
+		if err := utils.SendFileByFileID(update, fileID); err != nil {
+			logger.Error.Printf("%sFailed to send cached part %d: %v", userInfo, i, err)
+			return false
+		}
+	}
+
+	text := fmt.Sprintf(languages.Get(update).BotMsg.UploadedParts, archive.SetName, len(archive.FileIDs))
+	msg := tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, text)
+	msg.Entities = []tgbotapi.MessageEntity{utils.EntityBold(text, archive.SetName)}
+	msg.ReplyParameters.MessageID = update.CallbackQuery.Message.ReplyToMessage.MessageID
+	_, _ = utils.BotSend(msg)
+	return true
+}
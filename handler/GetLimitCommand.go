@@ -6,14 +6,45 @@ import (
 	"github.com/rroy233/StickerDownloader/db"
 	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/utils"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func GetLimitCommand(update tgbotapi.Update) {
-	num := db.GetLimit(update.Message.From.ID)
-	text := fmt.Sprintf(languages.Get(&update).BotMsg.GetLimitCommand, num)
+	UID := utils.GetUID(&update)
+	msg := languages.Get(&update).BotMsg
+	plan := db.GetPlan(UID)
+
+	windows := strings.Builder{}
+	for _, usage := range db.GetUsage(UID) {
+		windows.WriteString(fmt.Sprintf(msg.GetLimitWindow, quotaWindowName(&update, usage.Window), formatQuota(&update, usage.Remaining()), max(usage.Used, 0)))
+		if usage.ResetIn > 0 {
+			windows.WriteString(fmt.Sprintf(msg.GetLimitReset, time.Duration(usage.ResetIn)*time.Second))
+		}
+	}
+	text := fmt.Sprintf(msg.GetLimitCommand, plan, windows.String())
 	utils.SendPlainText(&update,
 		text,
-		utils.EntityBold(fmt.Sprintf(languages.Get(&update).BotMsg.GetLimitCommand, num), fmt.Sprintf("%d", num)),
+		utils.EntityBold(text, plan),
 	)
 	return
 }
+
+func quotaWindowName(update *tgbotapi.Update, window string) string {
+	switch window {
+	case db.WindowWeekly:
+		return languages.Get(update).BotMsg.QuotaWindowWeekly
+	case db.WindowMonthly:
+		return languages.Get(update).BotMsg.QuotaWindowMonthly
+	}
+	return languages.Get(update).BotMsg.QuotaWindowDaily
+}
+
+// n<0表示不限制
+func formatQuota(update *tgbotapi.Update, n int) string {
+	if n < 0 {
+		return languages.Get(update).BotMsg.QuotaUnlimited
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"strings"
+)
+
+// 群组中每次转换消耗的令牌数
+const groupRateCost = 1
+
+// GroupMessage 处理群组消息
+//
+// 回复表情并发送 /get 或@bot 时进行转换，其余消息忽略
+func GroupMessage(update tgbotapi.Update) {
+	if update.Message.IsCommand() {
+		//忽略发给其他bot的命令
+		if _, at, ok := strings.Cut(update.Message.CommandWithAt(), "@"); ok && !strings.EqualFold(at, utils.BotGetSelf().UserName) {
+			return
+		}
+		switch update.Message.Command() {
+		case "get":
+			groupConvert(update)
+		case "start", "help":
+			GroupHelpCommand(update)
+		case "getlimit":
+			GetLimitCommand(update)
+		case "settings":
+			if !isGroupAdmin(&update, update.Message.From.ID) {
+				utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrNoPermission)
+				return
+			}
+			SettingsCommand(update)
+		default:
+			return
+		}
+		statistics.Statistics.RecordCommand(update.Message.Command())
+		return
+	}
+
+	if isBotMentioned(update.Message) {
+		groupConvert(update)
+	}
+	return
+}
+
+// GroupJoined bot被拉入群组时发送使用帮助
+func GroupJoined(update tgbotapi.Update) {
+	status := update.MyChatMember.NewChatMember.Status
+	if status != "member" && status != "administrator" {
+		return
+	}
+	oldStatus := update.MyChatMember.OldChatMember.Status
+	if oldStatus == "member" || oldStatus == "administrator" {
+		return
+	}
+	logger.Info.Printf("[GroupJoined]Joined group (%s) %d %s", update.MyChatMember.Chat.Type, update.MyChatMember.Chat.ID, update.MyChatMember.Chat.Title)
+	utils.BotSend(tgbotapi.NewMessage(update.MyChatMember.Chat.ID, groupHelpText(&update, update.MyChatMember.Chat.ID)))
+	return
+}
+
+func GroupHelpCommand(update tgbotapi.Update) {
+	utils.SendPlainText(&update, groupHelpText(&update, update.Message.Chat.ID))
+	return
+}
+
+func groupHelpText(update *tgbotapi.Update, chatID int64) string {
+	return fmt.Sprintf(languages.Get(update).BotMsg.GroupHelpCommand, db.GetDailyLimit(chatID))
+}
+
+// 转换所回复的表情或gif
+func groupConvert(update tgbotapi.Update) {
+	target := update.Message.ReplyToMessage
+	if target == nil || (target.Sticker == nil && target.Animation == nil) {
+		utils.SendPlainText(&update, languages.Get(&update).BotMsg.GroupGetUsage)
+		return
+	}
+
+	//访问频率控制，按用户及群组计算
+	if limitLast := db.CheckUserRateLimit(update.Message.From.ID, update.Message.Chat.ID, groupRateCost); limitLast != -1 {
+		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrRateReachLimit)
+		return
+	}
+
+	//以被回复的表情替换当前消息的内容，结果回复到被转换的表情，以便后续下载整套表情包
+	msg := *update.Message
+	msg.MessageID = target.MessageID
+	msg.Sticker = target.Sticker
+	msg.Animation = target.Animation
+	update.Message = &msg
+
+	if msg.Sticker != nil {
+		StickerMessage(update)
+		statistics.Statistics.Record("MsgStickerNum", 1)
+	} else {
+		AnimationMessage(update)
+		statistics.Statistics.Record("MsgAnimationNum", 1)
+	}
+	return
+}
+
+func isBotMentioned(msg *tgbotapi.Message) bool {
+	mention := "@" + strings.ToLower(utils.BotGetSelf().UserName)
+	return strings.Contains(strings.ToLower(msg.Text), mention) || strings.Contains(strings.ToLower(msg.Caption), mention)
+}
+
+// 群组设置仅允许群组管理员及bot管理员修改
+func isGroupAdmin(update *tgbotapi.Update, userID int64) bool {
+	if config.HasAdminRole(userID, config.RoleOperator) {
+		return true
+	}
+	return utils.IsChatAdmin(utils.GetChatID(update), userID)
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/converter"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//每页返回的贴纸数，同时限制了单次请求需要即时转码的数量
+	inlinePageSize = 20
+	//即时转码的并发数
+	inlineConvertConcurrency = 3
+	//Telegram要求在10秒内应答，超时未完成的转码在后台继续，完成后写入缓存
+	inlineAnswerTimeout = 7 * time.Second
+	//全部命中缓存时结果的缓存时间(秒)
+	inlineCacheTime = 300
+)
+
+// InlineQuery 处理 @bot <表情包名称或链接>
+//
+// 以文件形式列出表情包中已转码的贴纸，未命中缓存的贴纸即时转码
+func InlineQuery(update tgbotapi.Update) {
+	userInfo := utils.GetLogPrefixInlineQuery(&update) + "[InlineQuery]"
+	query := update.InlineQuery
+
+	setName := parseStickerSetName(query.Query)
+	if setName == "" {
+		answerInlineButton(&update, languages.Get(&update).BotMsg.InlineUsage)
+		return
+	}
+
+	stickerSet, err := utils.BotGetStickerSet(tgbotapi.GetStickerSetConfig{
+		Name: setName,
+	})
+	if err != nil || len(stickerSet.Stickers) == 0 {
+		logger.Info.Println(userInfo+"failed to GetStickerSet:", setName, err)
+		answerInlineButton(&update, languages.Get(&update).BotMsg.InlineSetNotFound)
+		return
+	}
+
+	offset, _ := strconv.Atoi(query.Offset)
+	if offset < 0 || offset >= len(stickerSet.Stickers) {
+		answerInline(&update, nil, "", inlineCacheTime)
+		return
+	}
+	end := min(offset+inlinePageSize, len(stickerSet.Stickers))
+	stickers := stickerSet.Stickers[offset:end]
+
+	//查询缓存
+	opts := getUserPreference(&update).ConvertOptions()
+	fileIDs := make([]string, len(stickers))
+	misses := make([]int, 0)
+	for i, sticker := range stickers {
+		cacheItem, err := db.FindStickerCacheItem(sticker.FileUniqueID, opts.ForSticker(sticker))
+		if err == nil && cacheItem.ConvertedFileID != "" {
+			statistics.Statistics.Record("CacheHit", 1)
+			fileIDs[i] = cacheItem.ConvertedFileID
+			continue
+		}
+		statistics.Statistics.Record("CacheMiss", 1)
+		misses = append(misses, i)
+	}
+
+	//即时转码，未启用时仅列出已缓存的贴纸
+	if len(misses) != 0 && config.Get().General.InlineConvert {
+		reservation, err := db.ReserveLimit(&update, db.StickerSetCost(len(misses)))
+		if err != nil {
+			logger.Info.Println(userInfo+"failed to reserve limit, only cached stickers will be listed:", err)
+		} else {
+			for i, fileID := range convertInlineMisses(&update, userInfo, stickers, misses, reservation) {
+				fileIDs[i] = fileID
+			}
+		}
+	}
+
+	results := make([]interface{}, 0, len(stickers))
+	pending := false
+	for i, sticker := range stickers {
+		if fileIDs[i] == "" {
+			pending = true
+			continue
+		}
+		results = append(results, tgbotapi.NewInlineQueryResultCachedDocument(
+			sticker.FileUniqueID,
+			fileIDs[i],
+			fmt.Sprintf("%s %s #%d", stickerSet.Title, sticker.Emoji, offset+i+1),
+		))
+	}
+
+	nextOffset := ""
+	if end < len(stickerSet.Stickers) {
+		nextOffset = strconv.Itoa(end)
+	}
+	cacheTime := inlineCacheTime
+	if pending {
+		//仍有贴纸在转码，不缓存结果，便于用户稍后重试
+		cacheTime = 0
+	}
+	answerInline(&update, results, nextOffset, cacheTime)
+	return
+}
+
+// 解析表情包名称，支持直接输入名称或 https://t.me/addstickers/xxx 链接
+func parseStickerSetName(query string) string {
+	query = strings.TrimSpace(query)
+	for _, prefix := range []string{addStickersUrlPrefix, "http://t.me/addstickers/", "t.me/addstickers/"} {
+		if strings.HasPrefix(query, prefix) {
+			query = query[len(prefix):]
+			break
+		}
+	}
+	query, _, _ = strings.Cut(query, "?")
+	return strings.Trim(query, "/ ")
+}
+
+// 并发转码未命中缓存的贴纸，返回下标到file_id的映射
+//
+// 最多等待inlineAnswerTimeout，之后未完成的转码在后台继续，全部完成后按成功的数量扣除预扣的次数
+func convertInlineMisses(update *tgbotapi.Update, userInfo string, stickers []tgbotapi.Sticker, misses []int, reservation *db.Reservation) map[int]string {
+	opts := getUserPreference(update).ConvertOptions()
+	fileIDs := make(map[int]string)
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, inlineConvertConcurrency)
+	deadline := time.After(inlineAnswerTimeout)
+
+	for _, i := range misses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			fileID, err := convertInlineSticker(stickers[i], opts.ForSticker(stickers[i]))
+			if err != nil {
+				logger.Error.Println(userInfo+"failed to convert sticker:", stickers[i].FileUniqueID, err)
+				return
+			}
+			lock.Lock()
+			fileIDs[i] = fileID
+			lock.Unlock()
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+
+		//Consume the current user's limit
+		lock.Lock()
+		converted := len(fileIDs)
+		lock.Unlock()
+		if converted != 0 {
+			reservation.Settle(db.StickerSetCost(converted))
+		} else {
+			reservation.Refund()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-deadline:
+		logger.Info.Println(userInfo + "convert timeout, answer with converted stickers")
+	}
+
+	//后台goroutine仍可能写入，返回一份副本
+	lock.Lock()
+	defer lock.Unlock()
+	snapshot := make(map[int]string, len(fileIDs))
+	for i, fileID := range fileIDs {
+		snapshot[i] = fileID
+	}
+	return snapshot
+}
+
+// 下载并转码单个贴纸，上传后返回file_id并写入缓存
+func convertInlineSticker(sticker tgbotapi.Sticker, opts utils.ConvertOptions) (string, error) {
+	tempFilePath, err := downloadSticker(context.Background(), sticker)
+	if err != nil {
+		return "", err
+	}
+	defer utils.RemoveFile(tempFilePath)
+
+	convertTask := utils.ConvertTask{
+		InputFilePath:  tempFilePath,
+		InputExtension: utils.GetFileExtName(tempFilePath),
+	}
+	if config.Get().General.SupportTGSFile == false && convertTask.InputExtension == "tgs" {
+		return "", errors.New("tgs is not supported")
+	}
+	opts = opts.ForInput(convertTask.InputExtension)
+	convertTask.OutputFilePath = fmt.Sprintf("./storage/tmp/convert_%s.%s", utils.RandString(), opts.OutputFormat.Ext())
+	convertTask.ConvertOptions = opts
+	defer utils.RemoveFile(convertTask.OutputFilePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	err = converter.Convert(ctx, &convertTask)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+
+	//inline结果只能引用已上传的文件，先上传至指定会话以获取file_id
+	sentMsg, err := utils.SendFileToChat(config.Get().General.InlineUploadChatID, convertTask.OutputFilePath)
+	if err != nil {
+		return "", err
+	}
+	if sentMsg.Document == nil {
+		return "", errors.New("uploaded message has no document")
+	}
+
+	//CacheSticker
+	if config.Get().Cache.Enabled == true {
+		cacheItem, err := db.CacheSticker(sticker, opts, convertTask.OutputFilePath)
+		if err != nil {
+			logger.Error.Println("[InlineQuery]CacheSticker Error ", err)
+		} else {
+			cacheItem.ConvertedFileID = sentMsg.Document.FileID
+			if err := cacheItem.Update(); err != nil {
+				logger.Error.Println("[InlineQuery]failed to update cache:", err)
+			}
+		}
+	}
+	return sentMsg.Document.FileID, nil
+}
+
+// InlineQueryThrottled 超出访问频率时返回空结果，且不缓存
+func InlineQueryThrottled(update tgbotapi.Update) {
+	answerInline(&update, nil, "", 0)
+}
+
+func answerInline(update *tgbotapi.Update, results []interface{}, nextOffset string, cacheTime int) {
+	if results == nil {
+		results = make([]interface{}, 0)
+	}
+	err := utils.BotRequest(tgbotapi.InlineConfig{
+		InlineQueryID: update.InlineQuery.ID,
+		Results:       results,
+		CacheTime:     cacheTime,
+		IsPersonal:    true,
+		NextOffset:    nextOffset,
+	})
+	if err != nil {
+		logger.Error.Println(utils.GetLogPrefixInlineQuery(update)+"failed to answer inline query:", err)
+	}
+}
+
+// 无结果时在结果列表上方显示按钮，点击后打开与bot的私聊
+func answerInlineButton(update *tgbotapi.Update, text string) {
+	err := utils.BotRequest(tgbotapi.InlineConfig{
+		InlineQueryID: update.InlineQuery.ID,
+		Results:       make([]interface{}, 0),
+		IsPersonal:    true,
+		Button: &tgbotapi.InlineQueryResultsButton{
+			Text:       text,
+			StartParam: "inline",
+		},
+	})
+	if err != nil {
+		logger.Error.Println(utils.GetLogPrefixInlineQuery(update)+"failed to answer inline query:", err)
+	}
+}
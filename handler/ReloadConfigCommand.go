@@ -8,11 +8,6 @@ import (
 )
 
 func ReloadConfigCommand(update tgbotapi.Update) {
-	if update.Message.Chat.ID != config.Get().General.AdminUID {
-		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrNoPermission)
-		return
-	}
-
 	config.Init()
 	languages.Init()
 	utils.SendPlainText(&update, languages.Get(&update).BotMsg.ReloadConfigSuccess)
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const setPlanUsage = "Usage: /setplan <uid> <free|supporter|vip> [30d]\nThe plan is permanent if duration is omitted"
+
+// SetPlanCommand /setplan <uid> <plan> [duration]
+func SetPlanCommand(update tgbotapi.Update) {
+	args := strings.Fields(update.Message.CommandArguments())
+	if len(args) < 2 {
+		utils.SendPlainText(&update, setPlanUsage)
+		return
+	}
+	UID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || UID <= 0 {
+		utils.SendPlainText(&update, setPlanUsage)
+		return
+	}
+	plan := strings.ToLower(args[1])
+	duration := time.Duration(0)
+	if len(args) > 2 {
+		if duration, err = parseDurationArg(args[2]); err != nil {
+			utils.SendPlainText(&update, setPlanUsage)
+			return
+		}
+	}
+
+	if err = db.SetPlan(UID, plan, duration); err != nil {
+		if errors.Is(err, db.ErrorUnknownPlan) {
+			utils.SendPlainText(&update, setPlanUsage)
+			return
+		}
+		logger.Error.Println(utils.LogUserInfo(&update)+"[SetPlanCommand]failed to set plan:", err)
+		utils.SendPlainText(&update, "Failed: "+err.Error())
+		return
+	}
+
+	expire := "forever"
+	if duration > 0 && plan != db.PlanFree {
+		expire = time.Now().Add(duration).Format("2006-01-02 15:04:05")
+	}
+	logger.Info.Printf("%s[SetPlanCommand]set plan of %d to %s until %s", utils.LogUserInfo(&update), UID, plan, expire)
+	utils.SendPlainText(&update, fmt.Sprintf("Plan of %d is set to %s until %s", UID, plan, expire))
+	return
+}
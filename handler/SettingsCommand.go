@@ -0,0 +1,21 @@
+package handler
+
+import (
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+)
+
+func SettingsCommand(update tgbotapi.Update) {
+	pref := getUserPreference(&update)
+
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, settingsMenuText(&update, pref))
+	msg.ReplyParameters.MessageID = update.Message.MessageID
+	msg.ReplyMarkup = settingsMenuMarkup(&update)
+	if _, err := utils.BotSend(msg); err != nil {
+		logger.Error.Println(utils.GetLogPrefixMessage(&update)+"[SettingsCommand]failed to send menu:", err)
+		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrSysFailureOccurred)
+	}
+	return
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"strconv"
+	"strings"
+)
+
+// 设置项，对应回调数据 SETTINGS_<item> 及 SETTINGS_<item>:<value>
+const (
+	settingsItemMenu          = "menu"
+	settingsItemOutputFormat  = "format"
+	settingsItemMaxFPS        = "fps"
+	settingsItemTargetSize    = "size"
+	settingsItemLanguage      = "lang"
+	settingsItemArchiveFormat = "archive"
+	settingsItemTGSJson       = "tgsjson"
+)
+
+var settingsMaxFPSOptions = []int{0, 10, 15, 20, 30, 40}
+var settingsTargetSizeOptions = []int{0, 128, 256, 512}
+
+func SettingsQuery(update tgbotapi.Update) {
+	userInfo := utils.GetLogPrefixCallbackQuery(&update)
+	chatID := update.CallbackQuery.Message.Chat.ID
+	msgID := update.CallbackQuery.Message.MessageID
+
+	//群组设置仅允许管理员修改
+	if utils.IsGroupChat(&update) && !isGroupAdmin(&update, update.CallbackQuery.From.ID) {
+		utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(&update).BotMsg.ErrNoPermission)
+		return
+	}
+
+	UID := utils.GetUID(&update)
+	pref := db.GetUserPreference(UID)
+
+	item, value, isSet := strings.Cut(update.CallbackQuery.Data[len(SettingsCallbackQueryPrefix):], ":")
+	if !isSet {
+		switch item {
+		case settingsItemMenu:
+			utils.CallBack(update.CallbackQuery.ID, "")
+			utils.EditMsgTextAndMarkup(chatID, msgID, settingsMenuText(&update, pref), settingsMenuMarkup(&update))
+		case settingsItemTGSJson:
+			pref.IncludeTGSJson = !pref.IncludeTGSJson
+			saveSettings(&update, pref)
+		case settingsItemOutputFormat, settingsItemMaxFPS, settingsItemTargetSize, settingsItemLanguage, settingsItemArchiveFormat:
+			utils.CallBack(update.CallbackQuery.ID, "")
+			utils.EditMsgTextAndMarkup(chatID, msgID,
+				fmt.Sprintf(languages.Get(&update).BotMsg.SettingsChoose, settingsItemName(&update, item)),
+				settingsOptionMarkup(&update, item, pref),
+			)
+		default:
+			utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(&update).BotMsg.ErrFailed)
+		}
+		return
+	}
+
+	valid := false
+	switch item {
+	case settingsItemOutputFormat:
+		pref.OutputFormat, valid = utils.ParseOutputFormat(value)
+	case settingsItemMaxFPS:
+		pref.MaxFPS, valid = parseSettingsInt(value, settingsMaxFPSOptions)
+	case settingsItemTargetSize:
+		pref.TargetSize, valid = parseSettingsInt(value, settingsTargetSizeOptions)
+	case settingsItemLanguage:
+		if value == "" {
+			pref.Language, valid = "", true
+		}
+		for _, code := range languages.Available() {
+			if code == value {
+				pref.Language, valid = code, true
+			}
+		}
+	case settingsItemArchiveFormat:
+		pref.ArchiveFormat, valid = utils.ParseArchiveFormat(value)
+	}
+	if !valid {
+		logger.Warn.Println(userInfo+"[SettingsQuery]invalid data:", update.CallbackQuery.Data)
+		utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(&update).BotMsg.ErrFailed)
+		return
+	}
+	saveSettings(&update, pref)
+	return
+}
+
+// 保存设置并返回主菜单
+func saveSettings(update *tgbotapi.Update, pref *db.UserPreference) {
+	if err := pref.Save(utils.GetUID(update)); err != nil {
+		logger.Error.Println(utils.GetLogPrefixCallbackQuery(update)+"[SettingsQuery]failed to save preference:", err)
+		utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(update).BotMsg.ErrSysFailureOccurred)
+		return
+	}
+	languages.ForgetUserLanguage(utils.GetUID(update))
+	utils.CallBack(update.CallbackQuery.ID, languages.Get(update).BotMsg.SettingsSaved)
+	utils.EditMsgTextAndMarkup(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID,
+		settingsMenuText(update, pref), settingsMenuMarkup(update))
+}
+
+func parseSettingsInt(value string, options []int) (int, bool) {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	for _, option := range options {
+		if option == v {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func settingsMenuText(update *tgbotapi.Update, pref *db.UserPreference) string {
+	botMsg := languages.Get(update).BotMsg
+	maxFPS, targetSize, language, tgsJson := botMsg.SettingsDefault, botMsg.SettingsDefault, botMsg.SettingsDefault, botMsg.SettingsOff
+	if pref.MaxFPS > 0 {
+		maxFPS = strconv.Itoa(pref.MaxFPS)
+	}
+	if pref.TargetSize > 0 {
+		targetSize = fmt.Sprintf("%dpx", pref.TargetSize)
+	}
+	if pref.Language != "" {
+		language = pref.Language
+	}
+	if pref.IncludeTGSJson {
+		tgsJson = botMsg.SettingsOn
+	}
+	return fmt.Sprintf(botMsg.SettingsMenu, pref.OutputFormat, maxFPS, targetSize, language, pref.ArchiveFormat, tgsJson)
+}
+
+func settingsMenuMarkup(update *tgbotapi.Update) tgbotapi.InlineKeyboardMarkup {
+	button := func(item string) tgbotapi.InlineKeyboardButton {
+		return tgbotapi.NewInlineKeyboardButtonData(settingsItemName(update, item), SettingsCallbackQueryPrefix+item)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(button(settingsItemOutputFormat), button(settingsItemMaxFPS)),
+		tgbotapi.NewInlineKeyboardRow(button(settingsItemTargetSize), button(settingsItemLanguage)),
+		tgbotapi.NewInlineKeyboardRow(button(settingsItemArchiveFormat), button(settingsItemTGSJson)),
+	)
+}
+
+func settingsOptionMarkup(update *tgbotapi.Update, item string, pref *db.UserPreference) tgbotapi.InlineKeyboardMarkup {
+	botMsg := languages.Get(update).BotMsg
+
+	//选项值及其显示文本
+	var values, labels []string
+	current := ""
+	switch item {
+	case settingsItemOutputFormat:
+		for _, f := range utils.OutputFormats {
+			values = append(values, string(f))
+		}
+		labels = values
+		current = string(pref.OutputFormat)
+	case settingsItemMaxFPS:
+		for _, fps := range settingsMaxFPSOptions {
+			values = append(values, strconv.Itoa(fps))
+			labels = append(labels, strconv.Itoa(fps))
+		}
+		labels[0] = botMsg.SettingsDefault
+		current = strconv.Itoa(pref.MaxFPS)
+	case settingsItemTargetSize:
+		for _, size := range settingsTargetSizeOptions {
+			values = append(values, strconv.Itoa(size))
+			labels = append(labels, fmt.Sprintf("%dpx", size))
+		}
+		labels[0] = botMsg.SettingsDefault
+		current = strconv.Itoa(pref.TargetSize)
+	case settingsItemLanguage:
+		values = append([]string{""}, languages.Available()...)
+		labels = append([]string{botMsg.SettingsDefault}, languages.Available()...)
+		current = pref.Language
+	case settingsItemArchiveFormat:
+		for _, f := range utils.ArchiveFormats {
+			values = append(values, string(f))
+		}
+		labels = values
+		current = string(pref.ArchiveFormat)
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for i, value := range values {
+		label := labels[i]
+		if value == current {
+			label = "✓ " + label
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, SettingsCallbackQueryPrefix+item+":"+value))
+		if len(row) == 3 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) != 0 {
+		rows = append(rows, row)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(botMsg.SettingsBack, SettingsCallbackQueryPrefix+settingsItemMenu),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func settingsItemName(update *tgbotapi.Update, item string) string {
+	botMsg := languages.Get(update).BotMsg
+	switch item {
+	case settingsItemOutputFormat:
+		return botMsg.SettingsOutputFormat
+	case settingsItemMaxFPS:
+		return botMsg.SettingsMaxFPS
+	case settingsItemTargetSize:
+		return botMsg.SettingsTargetSize
+	case settingsItemLanguage:
+		return botMsg.SettingsLanguage
+	case settingsItemArchiveFormat:
+		return botMsg.SettingsArchiveFormat
+	case settingsItemTGSJson:
+		return botMsg.SettingsIncludeTGSJson
+	}
+	return item
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/converter"
 	"github.com/rroy233/StickerDownloader/db"
 	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/statistics"
@@ -16,6 +17,13 @@ import (
 func StickerMessage(update tgbotapi.Update) {
 	userInfo := utils.GetLogPrefixMessage(&update)
 
+	//预扣次数，处理失败时退还
+	reservation, quit := reserveLimit(&update, db.StickerCost())
+	if quit == true {
+		return
+	}
+	defer reservation.Refund()
+
 	oMsg := tgbotapi.NewMessage(update.Message.Chat.ID, languages.Get(&update).BotMsg.Processing)
 	oMsg.ReplyParameters.MessageID = update.Message.MessageID
 	msg, err := utils.BotSend(oMsg)
@@ -34,14 +42,9 @@ func StickerMessage(update tgbotapi.Update) {
 	defer dequeue(qItem)
 	//Dequeue
 
-	remoteFile, err := utils.BotGetFile(tgbotapi.FileConfig{
-		FileID: update.Message.Sticker.FileID,
-	})
-	if err != nil {
-		logger.Error.Println(userInfo+"failed to get file:", err)
-	}
-
-	cacheItem, err := db.FindStickerCacheItem(update.Message.Sticker.FileUniqueID)
+	db.RecordSetRequest(update.Message.Sticker.SetName)
+	opts := getUserPreference(&update).ConvertOptions().ForSticker(*update.Message.Sticker)
+	cacheItem, err := db.FindStickerCacheItem(update.Message.Sticker.FileUniqueID, opts)
 	if err == nil && cacheItem.ConvertedFileID != "" {
 		//缓存存在
 		statistics.Statistics.Record("CacheHit", 1)
@@ -58,7 +61,7 @@ func StickerMessage(update tgbotapi.Update) {
 	} else {
 		//缓存不存在
 		statistics.Statistics.Record("CacheMiss", 1)
-		tempFilePath, err := utils.DownloadFile(remoteFile.Link(config.Get().General.BotToken))
+		tempFilePath, err := downloadSticker(context.Background(), *update.Message.Sticker)
 		if err != nil {
 			logger.Error.Println(userInfo+"failed to download file:", err)
 		}
@@ -81,16 +84,14 @@ func StickerMessage(update tgbotapi.Update) {
 		}
 
 		//generate output file path
-		fileExt := "gif"
-		if convertTask.InputExtension == "webp" {
-			fileExt = "png"
-		}
-		outPath := fmt.Sprintf("./storage/tmp/convert_%s.%s", utils.RandString(), fileExt)
+		opts = opts.ForInput(convertTask.InputExtension)
+		outPath := fmt.Sprintf("./storage/tmp/convert_%s.%s", utils.RandString(), opts.OutputFormat.Ext())
 		convertTask.OutputFilePath = outPath
+		convertTask.ConvertOptions = opts
 
 		//start to convert
 		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-		err = convertTask.Run(ctx)
+		err = converter.Convert(ctx, &convertTask)
 		cancel()
 		if err != nil {
 			logger.Error.Println(userInfo+"failed to convert:", err, convertTask.OutputFilePath)
@@ -112,7 +113,7 @@ func StickerMessage(update tgbotapi.Update) {
 
 		//CacheSticker
 		if config.Get().Cache.Enabled == true {
-			cacheItem, err = db.CacheSticker(*update.Message.Sticker, convertTask.OutputFilePath)
+			cacheItem, err = db.CacheSticker(*update.Message.Sticker, opts, convertTask.OutputFilePath)
 			if err != nil {
 				logger.Error.Println(userInfo+"CacheSticker Error ", err)
 			} else {
@@ -125,10 +126,8 @@ func StickerMessage(update tgbotapi.Update) {
 		utils.RemoveFile(outPath)
 	}
 
-	//Consume the current user's daily limit
-	if err = db.ConsumeLimit(&update); err != nil {
-		logger.Error.Println(userInfo + err.Error())
-	}
+	//Consume the current user's limit
+	reservation.Commit()
 
 	err = utils.BotRequest(tgbotapi.NewEditMessageTextAndMarkup(update.Message.Chat.ID, msg.MessageID, languages.Get(&update).BotMsg.ConvertCompleted, tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(languages.Get(&update).BotMsg.DownloadStickerSet, DownloadStickerSetCallbackQuery)),
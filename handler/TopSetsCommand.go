@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/utils"
+	"time"
+)
+
+// TopSetsCommand 列出热门表情包及其在默认转码选项下的缓存覆盖率
+func TopSetsCommand(update tgbotapi.Update) {
+	days := config.Get().Cache.Warmup.Days
+	trends, err := db.TopStickerSets(days, config.Get().Cache.Warmup.TopSets)
+	if err != nil {
+		utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrSysFailureOccurred)
+		time.Sleep(100 * time.Millisecond)
+		utils.SendPlainText(&update, err.Error())
+		return
+	}
+
+	text := fmt.Sprintf("Top Sticker Sets (%d days)\n", days)
+	if len(trends) == 0 {
+		text += "\nNo data"
+	}
+	opts := db.DefaultUserPreference().ConvertOptions()
+	totalCached, total := 0, 0
+	for i, trend := range trends {
+		text += fmt.Sprintf("\n%d. %s - %d requests", i+1, trend.Name, trend.Requests)
+		stickerSet, err := utils.BotGetStickerSet(tgbotapi.GetStickerSetConfig{
+			Name: trend.Name,
+		})
+		if err != nil {
+			continue
+		}
+		cached, err := db.StickerCacheCoverage(stickerSet.Stickers, opts)
+		if err != nil {
+			continue
+		}
+		text += fmt.Sprintf(", cached %d/%d", cached, len(stickerSet.Stickers))
+		totalCached += cached
+		total += len(stickerSet.Stickers)
+	}
+	if total != 0 {
+		text += fmt.Sprintf("\n\nCoverage: %d/%d (%.1f%%)", totalCached, total, float64(totalCached)*100/float64(total))
+	}
+	if usage, max := db.CacheDiskUsage(); max != 0 {
+		text += fmt.Sprintf("\nCache Usage: %dMB/%dMB", usage>>20, max>>20)
+	}
+	text += fmt.Sprintf("\nWarmup: %t", config.Get().Cache.Warmup.Enabled)
+
+	utils.SendPlainText(&update, text)
+	return
+}
@@ -3,5 +3,6 @@ package handler
 var (
 	DownloadStickerSetCallbackQuery = "DOWNLOAD_STICKERS_SET"
 	QuitQueueCallbackQueryPrefix    = "QUIT_"
+	SettingsCallbackQueryPrefix     = "SETTINGS_"
 	ProcessTimeout                  = 60
 )
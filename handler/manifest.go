@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	manifestJsonName = "manifest.json"
+	manifestCsvName  = "manifest.csv"
+)
+
+// manifestEntry 清单中的一个贴纸
+type manifestEntry struct {
+	//position in the sticker set, starting from 1
+	Position        int    `json:"position"`
+	Emoji           string `json:"emoji"`
+	FileUniqueID    string `json:"file_unique_id"`
+	OriginalFormat  string `json:"original_format"`
+	ConvertedFormat string `json:"converted_format"`
+	//file name in the archive
+	FileName string `json:"file_name"`
+}
+
+type manifest struct {
+	Name     string           `json:"name"`
+	Title    string           `json:"title"`
+	Part     int              `json:"part"`
+	Stickers []*manifestEntry `json:"stickers"`
+}
+
+// 记录转码后文件对应的清单项，打包时写入每个分包
+type manifestRecorder struct {
+	sync.Mutex
+	name      string
+	title     string
+	positions map[string]int
+	entries   map[string]*manifestEntry
+}
+
+func newManifestRecorder(stickerSet tgbotapi.StickerSet) *manifestRecorder {
+	m := &manifestRecorder{
+		name:      stickerSet.Name,
+		title:     stickerSet.Title,
+		positions: make(map[string]int, len(stickerSet.Stickers)),
+		entries:   make(map[string]*manifestEntry, len(stickerSet.Stickers)),
+	}
+	for i, sticker := range stickerSet.Stickers {
+		m.positions[sticker.FileUniqueID] = i + 1
+	}
+	return m
+}
+
+// add 记录贴纸及其转码后的文件
+func (m *manifestRecorder) add(sticker tgbotapi.Sticker, convertedFilePath, convertedFormat string) {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[filepath.Base(convertedFilePath)] = &manifestEntry{
+		Position:        m.positions[sticker.FileUniqueID],
+		Emoji:           sticker.Emoji,
+		FileUniqueID:    sticker.FileUniqueID,
+		OriginalFormat:  stickerOriginalFormat(sticker),
+		ConvertedFormat: convertedFormat,
+		FileName:        filepath.Base(convertedFilePath),
+	}
+}
+
+// write 为folder中的文件生成manifest.json及manifest.csv
+func (m *manifestRecorder) write(folder string, part int) error {
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	mf := manifest{
+		Name:     m.name,
+		Title:    m.title,
+		Part:     part,
+		Stickers: make([]*manifestEntry, 0, len(files)),
+	}
+	m.Lock()
+	for _, file := range files {
+		if entry := m.entries[file.Name()]; entry != nil {
+			mf.Stickers = append(mf.Stickers, entry)
+		}
+	}
+	m.Unlock()
+	sort.Slice(mf.Stickers, func(i, j int) bool {
+		return mf.Stickers[i].Position < mf.Stickers[j].Position
+	})
+
+	data, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(folder, manifestJsonName), data, 0644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(folder, manifestCsvName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	_ = w.Write([]string{"position", "emoji", "file_unique_id", "original_format", "converted_format", "file_name"})
+	for _, entry := range mf.Stickers {
+		_ = w.Write([]string{strconv.Itoa(entry.Position), entry.Emoji, entry.FileUniqueID, entry.OriginalFormat, entry.ConvertedFormat, entry.FileName})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// 贴纸在Telegram中的原始格式
+func stickerOriginalFormat(sticker tgbotapi.Sticker) string {
+	switch {
+	case sticker.IsAnimated:
+		return "tgs"
+	case sticker.IsVideo:
+		return "webm"
+	}
+	return "webp"
+}
@@ -0,0 +1,12 @@
+package handler
+
+import (
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/utils"
+)
+
+// 获取发起本次请求的用户的偏好设置
+func getUserPreference(update *tgbotapi.Update) *db.UserPreference {
+	return db.GetUserPreference(utils.GetUID(update))
+}
@@ -40,6 +40,7 @@ func enqueue(update *tgbotapi.Update, queueEditMsg *tgbotapi.Message) (*db.QItem
 	for true {
 		//timeout
 		if time.Now().Sub(beginTime).Seconds() > float64(db.QueueTimeout) {
+			qItem.Abort()
 			utils.EditMsgText(queueEditMsg.Chat.ID, queueEditMsg.MessageID, languages.Get(update).BotMsg.ErrTimeout)
 			return nil, true
 		}
@@ -70,7 +71,7 @@ func enqueue(update *tgbotapi.Update, queueEditMsg *tgbotapi.Message) (*db.QItem
 		}
 		if waitingNum != qItem.QueryFront() {
 			waitingNum = qItem.QueryFront()
-			utils.EditMsgTextAndMarkup(queueEditMsg.Chat.ID, queueEditMsg.MessageID, fmt.Sprintf(languages.Get(update).BotMsg.QueueProcess, waitingNum),
+			utils.EditMsgProgressAndMarkup(queueEditMsg.Chat.ID, queueEditMsg.MessageID, fmt.Sprintf(languages.Get(update).BotMsg.QueueProcess, waitingNum),
 				tgbotapi.NewInlineKeyboardMarkup(
 					tgbotapi.NewInlineKeyboardRow(
 						tgbotapi.NewInlineKeyboardButtonData(languages.Get(update).BotMsg.QueueAbortBtn, QuitQueueCallbackQueryPrefix+qItem.UUID),
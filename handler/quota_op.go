@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"errors"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+)
+
+// 封装预扣次数操作，超出限制或失败时回复用户
+// bool 用于告知调用方是否要return结束
+//
+// 调用方法示例：
+//
+// reservation, quit := reserveLimit(&update, db.StickerCost())
+// if quit == true {
+// return
+// }
+// defer reservation.Refund()
+func reserveLimit(update *tgbotapi.Update, cost int) (*db.Reservation, bool) {
+	reservation, err := db.ReserveLimit(update, cost)
+	if err == nil {
+		return reservation, false
+	}
+
+	text := languages.Get(update).BotMsg.ErrReachLimit
+	if !errors.Is(err, db.ErrorReachLimit) {
+		logger.Error.Println(utils.LogUserInfo(update)+"[handler.reserveLimit]failed to reserve:", err)
+		text = languages.Get(update).BotMsg.ErrSysFailureOccurred
+	}
+	if update.CallbackQuery != nil {
+		utils.CallBackWithAlert(update.CallbackQuery.ID, text)
+	} else if update.Message != nil {
+		utils.SendPlainText(update, text)
+	}
+	return nil, true
+}
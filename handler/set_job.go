@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/converter"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// 没有请求等待后，任务及已完成的贴纸保留的时间，期间再次请求将从中断处继续
+const setJobKeep = 30 * time.Minute
+
+// 任务锁被其他实例持有时重试的间隔
+const setJobLockRetry = 2 * time.Second
+
+// setJob 表情包的下载转码任务
+//
+// 同一表情包(名称及贴纸版本相同)且转码选项相同的请求共享同一任务，
+// 所有请求离开后暂停，已完成的贴纸保留setJobKeep
+//
+// 任务及已完成的贴纸仅在当前进程内共享，多个实例间通过redis锁保证同一任务同时只在一个实例中转换，
+// 其余实例等待其结束后从贴纸缓存中取得结果
+type setJob struct {
+	sync.Mutex
+	key         string
+	stickerSet  tgbotapi.StickerSet
+	opts        utils.ConvertOptions
+	includeJson bool
+	folder      string
+
+	//已完成的贴纸，按完成顺序排列
+	outputs  []*setJobOutput
+	finished map[string]bool
+	//本轮转换失败的数量，继续任务时重试
+	failed int32
+
+	running     bool
+	cancel      context.CancelFunc
+	subscribers int
+	//任务有更新时关闭并替换
+	changed chan struct{}
+	expire  *time.Timer
+}
+
+// setJobOutput 转换完成的贴纸
+type setJobOutput struct {
+	sticker tgbotapi.Sticker
+	format  string
+	//转换后的文件，以及可能存在的tgs json
+	files []string
+}
+
+var setJobs = struct {
+	sync.Mutex
+	m map[string]*setJob
+}{m: make(map[string]*setJob)}
+
+// 表情包的贴纸版本，贴纸增删或调整顺序后改变
+func stickerSetVersion(stickerSet tgbotapi.StickerSet) string {
+	h := sha1.New()
+	for _, sticker := range stickerSet.Stickers {
+		h.Write([]byte(sticker.FileUniqueID))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// 表情包及转码选项相同的任务共享同一key
+func setJobKey(stickerSet tgbotapi.StickerSet, pref *db.UserPreference) string {
+	opts := pref.ConvertOptions()
+	includeJson := config.Get().General.SupportTGSFile && pref.IncludeTGSJson
+	return fmt.Sprintf("%s:%s:%s%s:%t", stickerSet.Name, stickerSetVersion(stickerSet), opts.OutputFormat, opts.Variant(), includeJson)
+}
+
+// 表情包压缩包缓存的hash，在任务的基础上区分压缩格式
+func setArchiveHash(stickerSet tgbotapi.StickerSet, pref *db.UserPreference) string {
+	return utils.MD5(setJobKey(stickerSet, pref) + ":" + string(pref.ArchiveFormat))
+}
+
+// attachSetJob 加入相同的任务，不存在则创建；任务未在运行且有未完成的贴纸时开始转换
+//
+// 返回的bool表示是否加入了已有的任务
+func attachSetJob(stickerSet tgbotapi.StickerSet, pref *db.UserPreference) (*setJob, bool) {
+	opts := pref.ConvertOptions()
+	includeJson := config.Get().General.SupportTGSFile && pref.IncludeTGSJson
+	key := setJobKey(stickerSet, pref)
+
+	setJobs.Lock()
+	defer setJobs.Unlock()
+	job, existed := setJobs.m[key]
+	if !existed {
+		job = &setJob{
+			key:         key,
+			stickerSet:  stickerSet,
+			opts:        opts,
+			includeJson: includeJson,
+			folder:      fmt.Sprintf("./storage/tmp/setjob_%s", utils.RandString()),
+			finished:    make(map[string]bool, len(stickerSet.Stickers)),
+			changed:     make(chan struct{}),
+		}
+		if err := os.Mkdir(job.folder, 0777); err != nil {
+			logger.Error.Println("[setJob]create folder failed:", err)
+		}
+		setJobs.m[key] = job
+	}
+
+	job.Lock()
+	defer job.Unlock()
+	job.subscribers++
+	if job.expire != nil {
+		job.expire.Stop()
+		job.expire = nil
+	}
+	if !job.running && len(job.finished) < len(job.stickerSet.Stickers) {
+		job.start()
+	}
+	return job, existed
+}
+
+// detach 离开任务，没有请求等待时暂停转换
+func (j *setJob) detach() {
+	j.Lock()
+	defer j.Unlock()
+	j.subscribers--
+	if j.subscribers > 0 {
+		return
+	}
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.expire = time.AfterFunc(setJobKeep, j.remove)
+}
+
+// 移除过期的任务及其文件
+func (j *setJob) remove() {
+	setJobs.Lock()
+	defer setJobs.Unlock()
+	j.Lock()
+	defer j.Unlock()
+	if j.subscribers > 0 {
+		return
+	}
+	if j.running {
+		j.expire = time.AfterFunc(setJobKeep, j.remove)
+		return
+	}
+	delete(setJobs.m, j.key)
+	if err := os.RemoveAll(j.folder); err != nil {
+		logger.Error.Println("[setJob]delete folder failed:", j.folder, err)
+	}
+}
+
+// 转换尚未完成的贴纸，调用时需持有锁
+func (j *setJob) start() {
+	pending := make([]tgbotapi.Sticker, 0, len(j.stickerSet.Stickers)-len(j.finished))
+	for _, sticker := range j.stickerSet.Stickers {
+		if !j.finished[sticker.FileUniqueID] {
+			pending = append(pending, sticker)
+		}
+	}
+	if len(j.finished) != 0 {
+		logger.Info.Printf("[setJob]resume %s, %d/%d finished", j.stickerSet.Name, len(j.finished), len(j.stickerSet.Stickers))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j.running = true
+	j.cancel = cancel
+	j.failed = 0
+	j.notify()
+	go j.run(ctx, pending)
+}
+
+func (j *setJob) run(ctx context.Context, pending []tgbotapi.Sticker) {
+	if unlock, ok := j.lock(ctx); ok {
+		defer unlock()
+	} else {
+		pending = nil
+	}
+
+	queue := make(chan tgbotapi.Sticker)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Get().General.DownloadWorkerNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sticker := range queue {
+				output, err := j.convert(ctx, sticker)
+				j.Lock()
+				if err == nil {
+					j.outputs = append(j.outputs, output)
+					j.finished[sticker.FileUniqueID] = true
+				} else if ctx.Err() == nil {
+					j.failed++
+				}
+				j.notify()
+				j.Unlock()
+			}
+		}()
+	}
+loop:
+	for _, sticker := range pending {
+		select {
+		case queue <- sticker:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	j.Lock()
+	defer j.Unlock()
+	j.cancel()
+	j.cancel = nil
+	j.running = false
+	//暂停期间又有请求加入
+	if ctx.Err() != nil && j.subscribers > 0 {
+		j.start()
+		return
+	}
+	j.notify()
+}
+
+// 获取任务在多个实例间的锁，其他实例正在转换同一任务时等待其结束，期间转换完成的贴纸已写入缓存
+//
+// 未启用缓存时实例间无法共享结果，不加锁；redis出错时不加锁继续转换；ctx结束时返回false
+func (j *setJob) lock(ctx context.Context) (func(), bool) {
+	if config.Get().Cache.Enabled == false {
+		return func() {}, true
+	}
+	for {
+		token, err := db.TryLockSetJob(j.key)
+		if err != nil {
+			logger.Error.Println("[setJob]failed to acquire lock:", err)
+			return func() {}, true
+		}
+		if token != "" {
+			return j.keepLock(token), true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(setJobLockRetry):
+		}
+	}
+}
+
+// 转换期间定时续期任务锁，返回释放锁的方法
+func (j *setJob) keepLock(token string) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(db.SetJobLockExpire / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if ok, err := db.RenewSetJobLock(j.key, token); err != nil || !ok {
+					logger.Error.Printf("[setJob]failed to renew lock of %s: %v", j.stickerSet.Name, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		db.UnlockSetJob(j.key, token)
+	}
+}
+
+// 通知等待的请求，调用时需持有锁
+func (j *setJob) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// outputsFrom 获取第from个之后完成的贴纸
+//
+// 返回的bool表示任务是否仍在运行，chan在任务有更新时关闭
+func (j *setJob) outputsFrom(from int) ([]*setJobOutput, bool, <-chan struct{}) {
+	j.Lock()
+	defer j.Unlock()
+	return j.outputs[from:], j.running, j.changed
+}
+
+// progress 已处理(完成及本轮失败)的贴纸数量
+func (j *setJob) progress() int32 {
+	j.Lock()
+	defer j.Unlock()
+	return int32(len(j.outputs)) + j.failed
+}
+
+// 下载并转换单个贴纸，优先使用缓存
+func (j *setJob) convert(ctx context.Context, sticker tgbotapi.Sticker) (*setJobOutput, error) {
+	stickerInfo := utils.JsonEncode(sticker)
+	opts := j.opts.ForSticker(sticker)
+	output := &setJobOutput{sticker: sticker}
+
+	cacheTmpFile, err := db.FindStickerCache(sticker.FileUniqueID, opts)
+	if err == nil {
+		statistics.Statistics.Record("CacheHit", 1)
+		output.format = utils.GetFileExtName(cacheTmpFile)
+		outputFilePath := fmt.Sprintf("%s/%s.%s", j.folder, sticker.FileUniqueID, output.format)
+		err := utils.CopyFile(cacheTmpFile, outputFilePath)
+		utils.RemoveFile(cacheTmpFile)
+		if err != nil {
+			logger.Error.Printf("DownloadStickerSetQuery[%s]-failed to copy：%s,%s", j.stickerSet.Name, err.Error(), stickerInfo)
+			return nil, err
+		}
+		output.files = []string{outputFilePath}
+		return output, nil
+	}
+
+	statistics.Statistics.Record("CacheMiss", 1)
+	tempFilePath, err := downloadSticker(ctx, sticker)
+	if err != nil {
+		logger.Error.Printf("DownloadStickerSetQuery[%s]-failed to download:%s,%s", j.stickerSet.Name, err.Error(), stickerInfo)
+		return nil, err
+	}
+
+	opts = opts.ForInput(utils.GetFileExtName(tempFilePath))
+	output.format = opts.OutputFormat.Ext()
+
+	convertTask := utils.ConvertTask{
+		InputFilePath:  tempFilePath,
+		InputExtension: utils.GetFileExtName(tempFilePath),
+		OutputFilePath: fmt.Sprintf("%s/%s.%s", j.folder, sticker.FileUniqueID, output.format),
+		ConvertOptions: opts,
+	}
+
+	jsonPath := ""
+	if utils.GetFileExtName(tempFilePath) == "tgs" && j.includeJson {
+		jsonPath = fmt.Sprintf("%s/%s.json", j.folder, sticker.FileUniqueID)
+		convertTask.PreserveJsonPath = jsonPath
+	}
+
+	err = converter.Convert(ctx, &convertTask)
+	utils.RemoveFile(tempFilePath)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error.Printf("DownloadStickerSetQuery[%s]-failed to convert：%s,%s\n", j.stickerSet.Name, err.Error(), stickerInfo)
+		}
+		return nil, err
+	}
+	if config.Get().Cache.Enabled == true {
+		if _, err := db.CacheSticker(sticker, opts, convertTask.OutputFilePath); err != nil {
+			logger.Error.Printf("DownloadStickerSetQuery[%s]-failed to Save Cache:%s,%s", j.stickerSet.Name, err.Error(), stickerInfo)
+		}
+	}
+
+	output.files = []string{convertTask.OutputFilePath}
+	if jsonPath != "" && utils.IsExist(jsonPath) {
+		output.files = append(output.files, jsonPath)
+	}
+	return output, nil
+}
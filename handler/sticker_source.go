@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"context"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+)
+
+// 获取贴纸的原始文件，优先使用缓存，从Telegram下载后写入缓存
+//
+// 返回本地文件地址，由调用方删除；ctx取消时停止下载
+func downloadSticker(ctx context.Context, sticker tgbotapi.Sticker) (string, error) {
+	if sourceFilePath, err := db.FindSourceCache(sticker.FileUniqueID); err == nil {
+		return sourceFilePath, nil
+	}
+
+	remoteFile, err := utils.BotGetFile(tgbotapi.FileConfig{
+		FileID: sticker.FileID,
+	})
+	if err != nil {
+		return "", err
+	}
+	tempFilePath, err := utils.DownloadFile(ctx, remoteFile)
+	if err != nil {
+		return "", err
+	}
+
+	if config.Get().Cache.Enabled == true {
+		if err := db.CacheSource(sticker.FileUniqueID, tempFilePath); err != nil {
+			logger.Error.Println("[downloadSticker]failed to cache source file:", err)
+		}
+	}
+	return tempFilePath, nil
+}
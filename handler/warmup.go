@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"time"
+)
+
+// CacheWarmup 在低负载时段按默认转码选项预先转换热门表情包，并保持其缓存不被淘汰
+//
+// 转换通过setJob进行，期间用户请求相同的表情包将直接加入
+func CacheWarmup(stopCtx context.Context) {
+	if config.Get().Cache.Warmup.Enabled == false {
+		return
+	}
+	interval := time.Duration(config.Get().Cache.Warmup.Interval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		if warmupAllowed() == false || db.TryStartWarmup(interval) == false {
+			continue
+		}
+		warmupTopSets(stopCtx)
+	}
+}
+
+// 是否处于低负载时段：当前时间在配置的时段内且排队人数不超过MaxQueueLen
+//
+// StartHour与EndHour相同时全天均可
+func warmupAllowed() bool {
+	cf := config.Get().Cache.Warmup
+	hour := time.Now().Hour()
+	inWindow := true
+	if cf.StartHour < cf.EndHour {
+		inWindow = hour >= cf.StartHour && hour < cf.EndHour
+	} else if cf.StartHour > cf.EndHour {
+		//跨越0点
+		inWindow = hour >= cf.StartHour || hour < cf.EndHour
+	}
+	return inWindow && db.QueueLen() <= int64(cf.MaxQueueLen)
+}
+
+func warmupTopSets(stopCtx context.Context) {
+	loggerPrefix := "[CacheWarmup]"
+	trends, err := db.TopStickerSets(config.Get().Cache.Warmup.Days, config.Get().Cache.Warmup.TopSets)
+	if err != nil {
+		logger.Error.Println(loggerPrefix+"failed to get top sets:", err)
+		return
+	}
+
+	pref := db.DefaultUserPreference()
+	opts := pref.ConvertOptions()
+	warmed := 0
+	for _, trend := range trends {
+		if stopCtx.Err() != nil || warmupAllowed() == false {
+			logger.Info.Println(loggerPrefix + "out of low-load window, stopped")
+			break
+		}
+		stickerSet, err := utils.BotGetStickerSet(tgbotapi.GetStickerSetConfig{
+			Name: trend.Name,
+		})
+		if err != nil {
+			logger.Error.Printf("%sfailed to GetStickerSet[%s]:%s", loggerPrefix, trend.Name, err.Error())
+			continue
+		}
+		if len(stickerSet.Stickers) > config.Get().General.MaxAmountPerReq {
+			continue
+		}
+
+		cached, err := db.StickerCacheCoverage(stickerSet.Stickers, opts)
+		if err != nil {
+			logger.Error.Println(loggerPrefix+"failed to get coverage:", err)
+			continue
+		}
+		if cached < len(stickerSet.Stickers) {
+			logger.Info.Printf("%swarming up %s, %d/%d cached", loggerPrefix, stickerSet.Name, cached, len(stickerSet.Stickers))
+			if warmupStickerSet(stopCtx, stickerSet, pref) == false {
+				logger.Info.Println(loggerPrefix + "out of low-load window, stopped")
+				break
+			}
+			warmed++
+		}
+		db.KeepStickerCache(stickerSet.Stickers, opts)
+	}
+	logger.Info.Printf("%s%d top sets checked, %d warmed up", loggerPrefix, len(trends), warmed)
+}
+
+// 加入表情包的任务并等待完成，离开低负载时段时退出
+//
+// 返回false表示未完成
+func warmupStickerSet(stopCtx context.Context, stickerSet tgbotapi.StickerSet, pref *db.UserPreference) bool {
+	job, _ := attachSetJob(stickerSet, pref)
+	defer job.detach()
+
+	check := time.NewTicker(time.Minute)
+	defer check.Stop()
+	for {
+		_, running, changed := job.outputsFrom(0)
+		if running == false {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-check.C:
+			if warmupAllowed() == false {
+				return false
+			}
+		case <-stopCtx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Package s3fake 进程内的S3兼容服务，仅实现缓存所需的接口，用于测试
+//
+//	server := httptest.NewServer(s3fake.New("access-key", "secret-key"))
+//	store := db.NewS3CacheStore(db.S3Config{Endpoint: server.URL, Bucket: "test", AccessKey: "access-key", ...})
+package s3fake
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server 以path-style访问，bucket在首次写入时自动创建
+//
+// 每个请求均按AWS Signature V4校验签名
+type Server struct {
+	sync.Mutex
+	accessKey string
+	secretKey string
+	buckets   map[string]map[string][]byte
+
+	// PageSize 列出对象时每页的最大数量，默认1000
+	PageSize int
+}
+
+// New 创建服务，拒绝未使用accessKey及secretKey正确签名的请求
+func New(accessKey string, secretKey string) *Server {
+	return &Server{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		buckets:   make(map[string]map[string][]byte),
+		PageSize:  1000,
+	}
+}
+
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string   `xml:"Name"`
+	Prefix                string   `xml:"Prefix"`
+	KeyCount              int      `xml:"KeyCount"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	Contents              []object `xml:"Contents"`
+}
+
+type object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+// Objects 返回bucket中所有对象的名称
+func (s *Server) Objects(bucket string) []string {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if code := s.verify(r, body); code != "" {
+		writeError(w, http.StatusForbidden, code)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		writeError(w, http.StatusBadRequest, "InvalidBucketName")
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	objects := s.buckets[bucket]
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, r.URL.Query())
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	case r.Method == http.MethodPut:
+		if objects == nil {
+			objects = make(map[string][]byte)
+			s.buckets[bucket] = objects
+		}
+		objects[key] = body
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// 按ListObjectsV2分页，continuation-token为上一页最后一个对象的名称
+func (s *Server) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	pageSize := s.PageSize
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys > 0 {
+		pageSize = min(pageSize, maxKeys)
+	}
+
+	keys := make([]string, 0)
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listResult{Name: bucket, Prefix: prefix}
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{Key: key, Size: int64(len(s.buckets[bucket][key]))})
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// 校验SigV4签名，返回错误码，通过时返回空字符串
+func (s *Server) verify(r *http.Request, body []byte) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return "AccessDenied"
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[name] = value
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != s.accessKey || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return "InvalidAccessKeyId"
+	}
+	date, region := credential[1], credential[2]
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if payloadHash != hashHex(body) {
+		return "XAmzContentSHA256Mismatch"
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	if !strings.HasPrefix(amzDate, date) {
+		return "AccessDenied"
+	}
+
+	//签名的请求头
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signedHeaders) {
+		return "AccessDenied"
+	}
+	var headers bytes.Buffer
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		if value == "" {
+			return "AccessDenied"
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	//与S3一致，将路径解码后按SigV4规则重新编码，客户端编码不规范时签名不一致
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+	key := hmacSum([]byte("AWS4"+s.secretKey), date)
+	key = hmacSum(key, region)
+	key = hmacSum(key, "s3")
+	key = hmacSum(key, "aws4_request")
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSum(key, stringToSign))), []byte(fields["Signature"])) {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+// 按编码后的参数名排序，同名参数按值排序
+func canonicalQuery(query url.Values) string {
+	type param struct{ name, value string }
+	params := make([]param, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, param{uriEncode(name), uriEncode(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].name != params[j].name {
+			return params[i].name < params[j].name
+		}
+		return params[i].value < params[j].value
+	})
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.name + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+// SigV4的URI编码，仅保留A-Z a-z 0-9 - _ . ~
+func uriEncode(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, "<Error><Code>"+code+"</Code></Error>")
+}
@@ -7,7 +7,11 @@ import (
 	"github.com/rroy233/StickerDownloader/config"
 	"gopkg.in/rroy233/logger.v2"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type LanguageStruct struct {
@@ -17,7 +21,6 @@ type LanguageStruct struct {
 		DbRedisStartFailed string `json:"db_redis_start_failed"`
 		DbRedisConnected   string `json:"db_redis_connected"`
 		FfmpegNotExist     string `json:"ffmpeg_not_exist"`
-		RlottieNotExist    string `json:"rlottie_not_exist"`
 	} `json:"system"`
 	BotMsg struct {
 		Processing                    string `json:"processing"`
@@ -25,7 +28,14 @@ type LanguageStruct struct {
 		DownloadingWithProgress       string `json:"downloading_with_progress"`
 		UploadedThirdParty            string `json:"uploaded_third_party"`
 		UploadedTelegram              string `json:"uploaded_telegram"`
+		UploadedParts                 string `json:"uploaded_parts"`
 		GetLimitCommand               string `json:"get_limit_command"`
+		GetLimitWindow                string `json:"get_limit_window"`
+		GetLimitReset                 string `json:"get_limit_reset"`
+		QuotaWindowDaily              string `json:"quota_window_daily"`
+		QuotaWindowWeekly             string `json:"quota_window_weekly"`
+		QuotaWindowMonthly            string `json:"quota_window_monthly"`
+		QuotaUnlimited                string `json:"quota_unlimited"`
 		StartCommand                  string `json:"start_command"`
 		HelpCommand                   string `json:"help_command"`
 		ConvertCompleted              string `json:"convert_completed"`
@@ -46,15 +56,54 @@ type LanguageStruct struct {
 		ErrSysFailureOccurred         string `json:"err_sys_failure_occurred"`
 		ErrFailed                     string `json:"err_failed"`
 		ErrTimeout                    string `json:"err_timeout"`
+		ErrTimeoutResumable           string `json:"err_timeout_resumable"`
 		ErrUploadFailed               string `json:"err_upload_failed"`
 		ErrStickerNotSupport          string `json:"err_sticker_not_support"`
 		ErrConvertFailed              string `json:"err_convert_failed"`
 		ErrSendFileFailed             string `json:"err_send_file_failed"`
 		ErrStickerSetAmountReachLimit string `json:"err_sticker_set_amount_reach_limit"`
+		SettingsMenu                  string `json:"settings_menu"`
+		SettingsChoose                string `json:"settings_choose"`
+		SettingsOutputFormat          string `json:"settings_output_format"`
+		SettingsMaxFPS                string `json:"settings_max_fps"`
+		SettingsTargetSize            string `json:"settings_target_size"`
+		SettingsLanguage              string `json:"settings_language"`
+		SettingsArchiveFormat         string `json:"settings_archive_format"`
+		SettingsIncludeTGSJson        string `json:"settings_include_tgs_json"`
+		SettingsDefault               string `json:"settings_default"`
+		SettingsOn                    string `json:"settings_on"`
+		SettingsOff                   string `json:"settings_off"`
+		SettingsBack                  string `json:"settings_back"`
+		SettingsSaved                 string `json:"settings_saved"`
+		InlineSetNotFound             string `json:"inline_set_not_found"`
+		InlineUsage                   string `json:"inline_usage"`
+		GroupNotSupported             string `json:"group_not_supported"`
+		GroupGetUsage                 string `json:"group_get_usage"`
+		GroupHelpCommand              string `json:"group_help_command"`
 	} `json:"bot_msg"`
 }
 
-var lang map[string]*LanguageStruct
+// 已加载的语言包，重新加载时整体替换，避免与读取方产生数据竞争
+var langs atomic.Pointer[map[string]*LanguageStruct]
+
+// 获取用户语言偏好的方法，由db模块注入，避免循环引用
+var userLanguageFunc func(UID int64) string
+
+// 用户语言偏好的本地缓存，处理一次消息会多次调用Get，避免每次都查询redis
+//
+// 其他实例上的修改最多延迟userLanguageTTL生效
+const userLanguageTTL = 30 * time.Second
+
+type userLanguageItem struct {
+	code   string
+	expire time.Time
+}
+
+var (
+	userLanguageCache     = make(map[int64]userLanguageItem)
+	userLanguageLock      sync.Mutex
+	userLanguageLastSweep time.Time
+)
 
 func Init() {
 	dir, err := os.ReadDir("./languages")
@@ -62,7 +111,7 @@ func Init() {
 		logger.Error.Fatalln(fmt.Sprintf("failed to read language folder! \n"))
 	}
 
-	lang = make(map[string]*LanguageStruct)
+	lang := make(map[string]*LanguageStruct)
 	for _, entry := range dir {
 		if strings.HasSuffix(entry.Name(), ".json") != true {
 			continue
@@ -90,6 +139,7 @@ func Init() {
 		logger.Error.Fatalln(fmt.Sprintf("default language config NOT exist! "))
 	}
 
+	langs.Store(&lang)
 	return
 }
 
@@ -97,18 +147,90 @@ func Init() {
 //
 // if pass a nil, then it will return default language config
 func Get(update *tgbotapi.Update) *LanguageStruct {
+	lang := *langs.Load()
 	if update == nil {
 		return lang[config.Get().General.Language]
 	}
 
+	//user preference
+	//与utils.GetUID一致，群组中使用群组的设置
+	if userLanguageFunc != nil {
+		UID := int64(0)
+		if update.Message != nil {
+			UID = update.Message.Chat.ID
+		} else if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+			UID = update.CallbackQuery.Message.Chat.ID
+		} else if update.InlineQuery != nil {
+			UID = update.InlineQuery.From.ID
+		}
+		if code := userLanguage(UID); code != "" && lang[code] != nil {
+			return lang[code]
+		}
+	}
+
 	languageCode := ""
 	if update.Message != nil && lang[update.Message.From.LanguageCode] != nil {
 		languageCode = update.Message.From.LanguageCode
 	} else if update.CallbackQuery != nil && lang[update.CallbackQuery.From.LanguageCode] != nil {
 		languageCode = update.CallbackQuery.From.LanguageCode
+	} else if update.InlineQuery != nil && lang[update.InlineQuery.From.LanguageCode] != nil {
+		languageCode = update.InlineQuery.From.LanguageCode
 	} else {
 		//no matched language, return default language
 		languageCode = config.Get().General.Language
 	}
 	return lang[languageCode]
 }
+
+// SetUserLanguageFunc 设置获取用户语言偏好的方法
+func SetUserLanguageFunc(f func(UID int64) string) {
+	userLanguageFunc = f
+}
+
+// 查询用户语言偏好，优先使用缓存
+func userLanguage(UID int64) string {
+	if UID == 0 {
+		return ""
+	}
+	now := time.Now()
+	userLanguageLock.Lock()
+	item, ok := userLanguageCache[UID]
+	userLanguageLock.Unlock()
+	if ok && now.Before(item.expire) {
+		return item.code
+	}
+
+	code := userLanguageFunc(UID)
+
+	userLanguageLock.Lock()
+	defer userLanguageLock.Unlock()
+	//顺便清除过期的缓存
+	if now.Sub(userLanguageLastSweep) > userLanguageTTL {
+		for id, item := range userLanguageCache {
+			if now.After(item.expire) {
+				delete(userLanguageCache, id)
+			}
+		}
+		userLanguageLastSweep = now
+	}
+	userLanguageCache[UID] = userLanguageItem{code: code, expire: now.Add(userLanguageTTL)}
+	return code
+}
+
+// ForgetUserLanguage 清除用户语言偏好的缓存，用户修改设置后调用
+func ForgetUserLanguage(UID int64) {
+	userLanguageLock.Lock()
+	delete(userLanguageCache, UID)
+	userLanguageLock.Unlock()
+}
+
+// Available 返回已加载的语言
+func Available() []string {
+	lang := *langs.Load()
+	codes := make([]string, 0, len(lang))
+	for code := range lang {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
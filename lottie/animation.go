@@ -0,0 +1,128 @@
+// Package lottie 纯Go实现的Lottie渲染器
+//
+// 仅覆盖Telegram TGS格式允许使用的子集：形状、填充、描边、渐变、变换、蒙版、遮罩及路径裁剪
+package lottie
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Animation Lottie动画
+type Animation struct {
+	Version   string  `json:"v"`
+	FrameRate float64 `json:"fr"`
+	InPoint   float64 `json:"ip"`
+	OutPoint  float64 `json:"op"`
+	Width     int     `json:"w"`
+	Height    int     `json:"h"`
+	Layers    []layer `json:"layers"`
+	Assets    []asset `json:"assets"`
+}
+
+type asset struct {
+	ID     string  `json:"id"`
+	Layers []layer `json:"layers"`
+}
+
+// 图层类型
+const (
+	layerPrecomp = 0
+	layerSolid   = 1
+	layerNull    = 3
+	layerShape   = 4
+)
+
+// 遮罩类型
+const (
+	matteNone         = 0
+	matteAlpha        = 1
+	matteAlphaInvert  = 2
+	matteLuma         = 3
+	matteLumaInverted = 4
+)
+
+type layer struct {
+	Type     int         `json:"ty"`
+	Index    *int        `json:"ind"`
+	Parent   *int        `json:"parent"`
+	Hidden   bool        `json:"hd"`
+	InPoint  float64     `json:"ip"`
+	OutPoint float64     `json:"op"`
+	Start    float64     `json:"st"`
+	Stretch  float64     `json:"sr"`
+	Ks       transform   `json:"ks"`
+	Shapes   shapeList   `json:"shapes"`
+	RefID    string      `json:"refId"`
+	Masks    []layerMask `json:"masksProperties"`
+	Matte    int         `json:"tt"`
+	IsMatte  int         `json:"td"`
+
+	//solid
+	SolidColor  string  `json:"sc"`
+	SolidWidth  float64 `json:"sw"`
+	SolidHeight float64 `json:"sh"`
+}
+
+type layerMask struct {
+	Mode    string    `json:"mode"`
+	Path    shapeProp `json:"pt"`
+	Opacity valueProp `json:"o"`
+	Inverse bool      `json:"inv"`
+}
+
+type transform struct {
+	Anchor   valueProp    `json:"a"`
+	Position positionProp `json:"p"`
+	Scale    valueProp    `json:"s"`
+	Rotation valueProp    `json:"r"`
+	Opacity  valueProp    `json:"o"`
+	Skew     valueProp    `json:"sk"`
+	SkewAxis valueProp    `json:"sa"`
+}
+
+// Parse 解析Lottie JSON
+func Parse(data []byte) (*Animation, error) {
+	anim := new(Animation)
+	if err := json.Unmarshal(data, anim); err != nil {
+		return nil, err
+	}
+	if anim.Width <= 0 || anim.Height <= 0 {
+		return nil, errors.New("lottie: invalid canvas size")
+	}
+	if anim.FrameRate <= 0 {
+		return nil, errors.New("lottie: invalid frame rate")
+	}
+	if anim.OutPoint <= anim.InPoint {
+		return nil, errors.New("lottie: invalid frame range")
+	}
+	return anim, nil
+}
+
+// Duration 动画时长(s)
+func (a *Animation) Duration() float64 {
+	return (a.OutPoint - a.InPoint) / a.FrameRate
+}
+
+// matrix 计算变换矩阵
+func (t *transform) matrix(frame float64) matrix {
+	anchor := t.Anchor.at(frame, 0, 0)
+	position := t.Position.at(frame)
+	scale := t.Scale.at(frame, 100, 100)
+	rotation := t.Rotation.at(frame, 0)[0]
+
+	m := translate(position[0], position[1])
+	m = m.mul(rotate(rotation))
+	if skew := t.Skew.at(frame, 0)[0]; skew != 0 {
+		axis := t.SkewAxis.at(frame, 0)[0]
+		m = m.mul(rotate(-axis)).mul(skewX(-skew)).mul(rotate(axis))
+	}
+	m = m.mul(scaleMatrix(scale[0]/100, scale[1]/100))
+	m = m.mul(translate(-anchor[0], -anchor[1]))
+	return m
+}
+
+// opacity 不透明度(0-1)
+func (t *transform) opacity(frame float64) float64 {
+	return clamp01(t.Opacity.at(frame, 100)[0] / 100)
+}
@@ -0,0 +1,128 @@
+package lottie
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "更新testdata中的golden图片")
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "非JSON", data: `not json`, want: "invalid character"},
+		{name: "截断", data: `{"w":512,"h":512`, want: "unexpected end"},
+		{name: "缺少尺寸", data: `{"fr":60,"ip":0,"op":60}`, want: "invalid canvas size"},
+		{name: "负数尺寸", data: `{"w":-1,"h":512,"fr":60,"ip":0,"op":60}`, want: "invalid canvas size"},
+		{name: "帧率为0", data: `{"w":512,"h":512,"fr":0,"ip":0,"op":60}`, want: "invalid frame rate"},
+		{name: "帧范围为空", data: `{"w":512,"h":512,"fr":60,"ip":60,"op":60}`, want: "invalid frame range"},
+		{name: "shapes类型错误", data: `{"w":512,"h":512,"fr":60,"ip":0,"op":60,"layers":[{"ty":4,"shapes":{}}]}`, want: "cannot unmarshal"},
+		{name: "属性类型错误", data: `{"w":512,"h":512,"fr":60,"ip":0,"op":60,"layers":[{"ty":4,"ks":{"p":{"k":[{"t":"0"}]}}}]}`, want: "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anim, err := Parse([]byte(tt.data))
+			if err == nil {
+				t.Fatalf("Parse() = %+v, want error", anim)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Parse() error = %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	anim := loadTestAnimation(t, "square.json")
+	if anim.Width != 64 || anim.Height != 64 || len(anim.Layers) != 1 {
+		t.Fatalf("Parse() = %+v", anim)
+	}
+	if d := anim.Duration(); d != 1 {
+		t.Fatalf("Duration() = %v, want 1", d)
+	}
+	//不支持的图层及形状类型被忽略
+	if len(anim.Layers[0].Shapes) != 2 {
+		t.Fatalf("shapes = %d, want 2", len(anim.Layers[0].Shapes))
+	}
+}
+
+// TestRenderGolden 与testdata中的图片逐像素比较，渲染结果有意变更时以-update重新生成
+func TestRenderGolden(t *testing.T) {
+	anim := loadTestAnimation(t, "square.json")
+	r := NewRenderer(anim, 64, 64)
+	for _, frame := range []float64{0, 15} {
+		t.Run(fmt.Sprint(frame), func(t *testing.T) {
+			img := r.Render(frame)
+			golden := filepath.Join("testdata", fmt.Sprintf("square_%v.png", frame))
+			if *update {
+				buf := new(bytes.Buffer)
+				if err := png.Encode(buf, img); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			f, err := os.Open(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareImage(t, img, want)
+		})
+	}
+}
+
+func loadTestAnimation(t *testing.T, name string) *Animation {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return anim
+}
+
+// 允许每个通道±1的舍入误差
+func compareImage(t *testing.T, got *image.RGBA, want image.Image) {
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds = %v, want %v", got.Bounds(), want.Bounds())
+	}
+	diff := 0
+	for y := got.Rect.Min.Y; y < got.Rect.Max.Y; y++ {
+		for x := got.Rect.Min.X; x < got.Rect.Max.X; x++ {
+			r, g, b, a := want.At(x, y).RGBA()
+			w := [4]int{int(r >> 8), int(g >> 8), int(b >> 8), int(a >> 8)}
+			p := got.Pix[got.PixOffset(x, y):]
+			for i := range w {
+				if d := int(p[i]) - w[i]; d > 1 || d < -1 {
+					if diff < 5 {
+						t.Errorf("pixel (%d,%d) = %v, want %v", x, y, p[:4], w)
+					}
+					diff++
+					break
+				}
+			}
+		}
+	}
+	if diff != 0 {
+		t.Fatalf("%d pixels differ", diff)
+	}
+}
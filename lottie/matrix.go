@@ -0,0 +1,103 @@
+package lottie
+
+import "math"
+
+type point struct {
+	X, Y float64
+}
+
+func (p point) add(q point) point {
+	return point{p.X + q.X, p.Y + q.Y}
+}
+
+func (p point) sub(q point) point {
+	return point{p.X - q.X, p.Y - q.Y}
+}
+
+func (p point) scale(k float64) point {
+	return point{p.X * k, p.Y * k}
+}
+
+func (p point) length() float64 {
+	return math.Hypot(p.X, p.Y)
+}
+
+func lerpPoint(a, b point, t float64) point {
+	return point{a.X + (b.X-a.X)*t, a.Y + (b.Y-a.Y)*t}
+}
+
+// matrix 2D仿射变换
+//
+// x' = A*x + C*y + E
+// y' = B*x + D*y + F
+type matrix struct {
+	A, B, C, D, E, F float64
+}
+
+var identity = matrix{A: 1, D: 1}
+
+func translate(x, y float64) matrix {
+	return matrix{A: 1, D: 1, E: x, F: y}
+}
+
+func scaleMatrix(sx, sy float64) matrix {
+	return matrix{A: sx, D: sy}
+}
+
+// rotate 顺时针旋转(角度)，与Lottie保持一致
+func rotate(deg float64) matrix {
+	rad := deg * math.Pi / 180
+	sin, cos := math.Sincos(rad)
+	return matrix{A: cos, B: sin, C: -sin, D: cos}
+}
+
+func skewX(deg float64) matrix {
+	return matrix{A: 1, C: math.Tan(deg * math.Pi / 180), D: 1}
+}
+
+// mul 返回 m*n，即先应用n再应用m
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		A: m.A*n.A + m.C*n.B,
+		B: m.B*n.A + m.D*n.B,
+		C: m.A*n.C + m.C*n.D,
+		D: m.B*n.C + m.D*n.D,
+		E: m.A*n.E + m.C*n.F + m.E,
+		F: m.B*n.E + m.D*n.F + m.F,
+	}
+}
+
+func (m matrix) apply(p point) point {
+	return point{m.A*p.X + m.C*p.Y + m.E, m.B*p.X + m.D*p.Y + m.F}
+}
+
+// invert 逆矩阵，不可逆时返回false
+func (m matrix) invert() (matrix, bool) {
+	det := m.A*m.D - m.B*m.C
+	if det == 0 {
+		return matrix{}, false
+	}
+	return matrix{
+		A: m.D / det,
+		B: -m.B / det,
+		C: -m.C / det,
+		D: m.A / det,
+		E: (m.C*m.F - m.D*m.E) / det,
+		F: (m.B*m.E - m.A*m.F) / det,
+	}, true
+}
+
+// scaleFactor 变换的平均缩放系数，用于描边宽度
+func (m matrix) scaleFactor() float64 {
+	return math.Sqrt(math.Abs(m.A*m.D - m.B*m.C))
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,406 @@
+package lottie
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+)
+
+// valueProp 可动画的数值属性(标量或向量)
+type valueProp struct {
+	static []float64
+	keys   []valueKey
+}
+
+type valueKey struct {
+	t          float64
+	s, e       []float64
+	outX, outY []float64
+	inX, inY   []float64
+	hold       bool
+	to, ti     []float64
+}
+
+type rawProp struct {
+	K json.RawMessage `json:"k"`
+}
+
+type rawKeyframe struct {
+	T  float64         `json:"t"`
+	S  json.RawMessage `json:"s"`
+	E  json.RawMessage `json:"e"`
+	I  *rawEase        `json:"i"`
+	O  *rawEase        `json:"o"`
+	H  int             `json:"h"`
+	To []float64       `json:"to"`
+	Ti []float64       `json:"ti"`
+}
+
+type rawEase struct {
+	X json.RawMessage `json:"x"`
+	Y json.RawMessage `json:"y"`
+}
+
+// parseFloats 解析数字或数字数组
+func parseFloats(raw json.RawMessage) []float64 {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	if raw[0] == '[' {
+		var v []float64
+		if json.Unmarshal(raw, &v) == nil {
+			return v
+		}
+		return nil
+	}
+	var v float64
+	if json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	return []float64{v}
+}
+
+// 判断k是否为关键帧数组
+func isKeyframes(k json.RawMessage) bool {
+	k = bytes.TrimSpace(k)
+	if len(k) < 2 || k[0] != '[' {
+		return false
+	}
+	return bytes.TrimSpace(k[1:])[0] == '{'
+}
+
+func (p *valueProp) UnmarshalJSON(b []byte) error {
+	raw := rawProp{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if !isKeyframes(raw.K) {
+		p.static = parseFloats(raw.K)
+		return nil
+	}
+
+	var frames []rawKeyframe
+	if err := json.Unmarshal(raw.K, &frames); err != nil {
+		return err
+	}
+	p.keys = make([]valueKey, len(frames))
+	for i, f := range frames {
+		key := valueKey{
+			t:    f.T,
+			s:    parseFloats(f.S),
+			e:    parseFloats(f.E),
+			hold: f.H == 1,
+			to:   f.To,
+			ti:   f.Ti,
+		}
+		if f.O != nil {
+			key.outX, key.outY = parseFloats(f.O.X), parseFloats(f.O.Y)
+		}
+		if f.I != nil {
+			key.inX, key.inY = parseFloats(f.I.X), parseFloats(f.I.Y)
+		}
+		p.keys[i] = key
+	}
+	return nil
+}
+
+// at 计算frame时的属性值
+//
+// def为属性缺失时的默认值，返回值长度不小于len(def)
+func (p *valueProp) at(frame float64, def ...float64) []float64 {
+	var v []float64
+	if len(p.keys) == 0 {
+		v = p.static
+	} else {
+		v = p.interpolate(frame)
+	}
+	if len(v) >= len(def) {
+		return v
+	}
+	out := make([]float64, len(def))
+	copy(out, def)
+	copy(out, v)
+	return out
+}
+
+func (p *valueProp) interpolate(frame float64) []float64 {
+	keys := p.keys
+	if frame <= keys[0].t || len(keys) == 1 {
+		return keys[0].s
+	}
+	last := len(keys) - 1
+	if frame >= keys[last].t {
+		if keys[last].s != nil {
+			return keys[last].s
+		}
+		return keys[last-1].endValue(keys[last])
+	}
+
+	i := 0
+	for i < last-1 && frame >= keys[i+1].t {
+		i++
+	}
+	k := keys[i]
+	start := k.s
+	end := k.endValue(keys[i+1])
+	if k.hold || len(end) < len(start) {
+		return start
+	}
+	progress := (frame - k.t) / (keys[i+1].t - k.t)
+
+	out := make([]float64, len(start))
+	for d := range start {
+		e := k.ease(d, progress)
+		out[d] = start[d] + (end[d]-start[d])*e
+	}
+
+	//spatial bezier
+	if len(k.to) >= 2 && len(k.ti) >= 2 && len(start) >= 2 && (k.to[0] != 0 || k.to[1] != 0 || k.ti[0] != 0 || k.ti[1] != 0) {
+		e := k.ease(0, progress)
+		p0 := point{start[0], start[1]}
+		p3 := point{end[0], end[1]}
+		pt := cubicPoint(p0, p0.add(point{k.to[0], k.to[1]}), p3.add(point{k.ti[0], k.ti[1]}), p3, e)
+		out[0], out[1] = pt.X, pt.Y
+	}
+	return out
+}
+
+func (k valueKey) endValue(next valueKey) []float64 {
+	if k.e != nil {
+		return k.e
+	}
+	if next.s != nil {
+		return next.s
+	}
+	return k.s
+}
+
+// ease 计算第d维的缓动进度
+func (k valueKey) ease(d int, progress float64) float64 {
+	if len(k.outX) == 0 || len(k.outY) == 0 || len(k.inX) == 0 || len(k.inY) == 0 {
+		return progress
+	}
+	pick := func(v []float64) float64 {
+		if d < len(v) {
+			return v[d]
+		}
+		return v[0]
+	}
+	return bezierEase(pick(k.outX), pick(k.outY), pick(k.inX), pick(k.inY), progress)
+}
+
+// bezierEase 求解三次贝塞尔缓动曲线(0,0)-(x1,y1)-(x2,y2)-(1,1)在x处的y值
+func bezierEase(x1, y1, x2, y2, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	if x1 == y1 && x2 == y2 {
+		return x
+	}
+	x1, x2 = clamp01(x1), clamp01(x2)
+
+	curve := func(a1, a2, t float64) float64 {
+		return 3*a1*t*(1-t)*(1-t) + 3*a2*t*t*(1-t) + t*t*t
+	}
+
+	//牛顿迭代，失败时退回二分
+	t := x
+	for i := 0; i < 8; i++ {
+		dx := curve(x1, x2, t) - x
+		if math.Abs(dx) < 1e-6 {
+			return curve(y1, y2, t)
+		}
+		slope := 3*x1*(1-t)*(1-t) + 6*(x2-x1)*t*(1-t) + 3*(1-x2)*t*t
+		if math.Abs(slope) < 1e-6 {
+			break
+		}
+		t -= dx / slope
+	}
+	lo, hi := 0.0, 1.0
+	t = x
+	for i := 0; i < 32; i++ {
+		v := curve(x1, x2, t)
+		if math.Abs(v-x) < 1e-6 {
+			break
+		}
+		if v < x {
+			lo = t
+		} else {
+			hi = t
+		}
+		t = (lo + hi) / 2
+	}
+	return curve(y1, y2, t)
+}
+
+func cubicPoint(p0, p1, p2, p3 point, t float64) point {
+	mt := 1 - t
+	a := mt * mt * mt
+	b := 3 * mt * mt * t
+	c := 3 * mt * t * t
+	d := t * t * t
+	return point{
+		a*p0.X + b*p1.X + c*p2.X + d*p3.X,
+		a*p0.Y + b*p1.Y + c*p2.Y + d*p3.Y,
+	}
+}
+
+// positionProp 位置属性，可能拆分为x、y两个属性
+type positionProp struct {
+	split bool
+	x, y  valueProp
+	valueProp
+}
+
+func (p *positionProp) UnmarshalJSON(b []byte) error {
+	split := struct {
+		S bool            `json:"s"`
+		X json.RawMessage `json:"x"`
+		Y json.RawMessage `json:"y"`
+	}{}
+	if err := json.Unmarshal(b, &split); err != nil {
+		return err
+	}
+	if !split.S {
+		return p.valueProp.UnmarshalJSON(b)
+	}
+	p.split = true
+	if err := p.x.UnmarshalJSON(split.X); err != nil {
+		return err
+	}
+	return p.y.UnmarshalJSON(split.Y)
+}
+
+func (p *positionProp) at(frame float64) []float64 {
+	if p.split {
+		return []float64{p.x.at(frame, 0)[0], p.y.at(frame, 0)[0]}
+	}
+	return p.valueProp.at(frame, 0, 0)
+}
+
+// bezierShape 贝塞尔路径，i、o为相对于顶点的控制点
+type bezierShape struct {
+	Closed bool        `json:"c"`
+	V      [][]float64 `json:"v"`
+	I      [][]float64 `json:"i"`
+	O      [][]float64 `json:"o"`
+}
+
+// shapeProp 可动画的路径属性
+type shapeProp struct {
+	static *bezierShape
+	keys   []shapeKey
+}
+
+type shapeKey struct {
+	valueKey
+	shape, end *bezierShape
+}
+
+func (p *shapeProp) UnmarshalJSON(b []byte) error {
+	raw := rawProp{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if !isKeyframes(raw.K) {
+		p.static = new(bezierShape)
+		return json.Unmarshal(raw.K, p.static)
+	}
+
+	var frames []rawKeyframe
+	if err := json.Unmarshal(raw.K, &frames); err != nil {
+		return err
+	}
+	p.keys = make([]shapeKey, len(frames))
+	for i, f := range frames {
+		key := shapeKey{valueKey: valueKey{t: f.T, hold: f.H == 1}}
+		if f.O != nil {
+			key.outX, key.outY = parseFloats(f.O.X), parseFloats(f.O.Y)
+		}
+		if f.I != nil {
+			key.inX, key.inY = parseFloats(f.I.X), parseFloats(f.I.Y)
+		}
+		key.shape = parseKeyShape(f.S)
+		key.end = parseKeyShape(f.E)
+		p.keys[i] = key
+	}
+	return nil
+}
+
+// 关键帧中的路径以单元素数组的形式保存
+func parseKeyShape(raw json.RawMessage) *bezierShape {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	var shapes []bezierShape
+	if json.Unmarshal(raw, &shapes) == nil && len(shapes) > 0 {
+		return &shapes[0]
+	}
+	shape := new(bezierShape)
+	if json.Unmarshal(raw, shape) != nil {
+		return nil
+	}
+	return shape
+}
+
+func (p *shapeProp) at(frame float64) *bezierShape {
+	if len(p.keys) == 0 {
+		return p.static
+	}
+	keys := p.keys
+	if frame <= keys[0].t || len(keys) == 1 {
+		return keys[0].shape
+	}
+	last := len(keys) - 1
+	if frame >= keys[last].t {
+		if keys[last].shape != nil {
+			return keys[last].shape
+		}
+		return keys[last-1].endShape(keys[last])
+	}
+
+	i := 0
+	for i < last-1 && frame >= keys[i+1].t {
+		i++
+	}
+	k := keys[i]
+	start := k.shape
+	end := k.endShape(keys[i+1])
+	if k.hold || start == nil || end == nil || len(start.V) != len(end.V) || len(start.I) != len(end.I) || len(start.O) != len(end.O) {
+		return start
+	}
+	e := k.ease(0, (frame-k.t)/(keys[i+1].t-k.t))
+
+	lerp := func(a, b [][]float64) [][]float64 {
+		out := make([][]float64, len(a))
+		for j := range a {
+			if len(a[j]) < 2 || len(b[j]) < 2 {
+				out[j] = a[j]
+				continue
+			}
+			out[j] = []float64{a[j][0] + (b[j][0]-a[j][0])*e, a[j][1] + (b[j][1]-a[j][1])*e}
+		}
+		return out
+	}
+	return &bezierShape{
+		Closed: start.Closed,
+		V:      lerp(start.V, end.V),
+		I:      lerp(start.I, end.I),
+		O:      lerp(start.O, end.O),
+	}
+}
+
+func (k shapeKey) endShape(next shapeKey) *bezierShape {
+	if k.end != nil {
+		return k.end
+	}
+	if next.shape != nil {
+		return next.shape
+	}
+	return k.shape
+}
@@ -0,0 +1,374 @@
+package lottie
+
+import (
+	"math"
+	"sort"
+)
+
+// 每个像素行的垂直采样数
+const subsamples = 5
+
+// coverage 覆盖率缓冲，只有[x0,x1)×[y0,y1)范围内有效
+type coverage struct {
+	w, h           int
+	a              []float32
+	x0, y0, x1, y1 int
+}
+
+func newCoverage(w, h int) *coverage {
+	return &coverage{w: w, h: h, a: make([]float32, w*h)}
+}
+
+// reset 清空上次使用的区域
+func (c *coverage) reset() {
+	for y := c.y0; y < c.y1; y++ {
+		row := c.a[y*c.w : (y+1)*c.w]
+		for x := c.x0; x < c.x1; x++ {
+			row[x] = 0
+		}
+	}
+	c.x0, c.y0, c.x1, c.y1 = 0, 0, 0, 0
+}
+
+// fillAll 整个画布完全覆盖
+func (c *coverage) fillAll(v float32) {
+	for i := range c.a {
+		c.a[i] = v
+	}
+	c.x0, c.y0, c.x1, c.y1 = 0, 0, c.w, c.h
+}
+
+func (c *coverage) empty() bool {
+	return c.x1 <= c.x0 || c.y1 <= c.y0
+}
+
+type edge struct {
+	x0, y0, x1, y1 float64
+	dir            int
+}
+
+type crossing struct {
+	x   float64
+	dir int
+}
+
+// rasterizer 扫描线光栅化器
+type rasterizer struct {
+	w, h      int
+	edges     []edge
+	active    []int
+	crossings []crossing
+	diff      []float32
+}
+
+func newRasterizer(w, h int) *rasterizer {
+	return &rasterizer{w: w, h: h, diff: make([]float32, w+2)}
+}
+
+// fill 将路径填充到覆盖率缓冲，cov需已reset
+func (r *rasterizer) fill(paths []path, evenOdd bool, cov *coverage) {
+	r.edges = r.edges[:0]
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range paths {
+		n := len(p.pts)
+		if n < 2 {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			a := p.pts[i]
+			b := p.pts[(i+1)%n]
+			minX, maxX = math.Min(minX, a.X), math.Max(maxX, a.X)
+			minY, maxY = math.Min(minY, a.Y), math.Max(maxY, a.Y)
+			if a.Y == b.Y || math.IsNaN(a.Y) || math.IsNaN(b.Y) {
+				continue
+			}
+			if a.Y < b.Y {
+				r.edges = append(r.edges, edge{a.X, a.Y, b.X, b.Y, 1})
+			} else {
+				r.edges = append(r.edges, edge{b.X, b.Y, a.X, a.Y, -1})
+			}
+		}
+	}
+	if len(r.edges) == 0 {
+		return
+	}
+
+	x0 := clampInt(int(math.Floor(minX)), 0, r.w)
+	x1 := clampInt(int(math.Ceil(maxX))+1, 0, r.w)
+	y0 := clampInt(int(math.Floor(minY)), 0, r.h)
+	y1 := clampInt(int(math.Ceil(maxY))+1, 0, r.h)
+	if x1 <= x0 || y1 <= y0 {
+		return
+	}
+	cov.x0, cov.y0, cov.x1, cov.y1 = x0, y0, x1, y1
+
+	sort.Slice(r.edges, func(i, j int) bool {
+		return r.edges[i].y0 < r.edges[j].y0
+	})
+
+	const weight = 1.0 / subsamples
+	next := 0
+	r.active = r.active[:0]
+	for y := y0; y < y1; y++ {
+		row := cov.a[y*r.w : (y+1)*r.w]
+		diff := r.diff
+		for s := 0; s < subsamples; s++ {
+			sy := float64(y) + (float64(s)+0.5)/subsamples
+
+			//更新活动边
+			for next < len(r.edges) && r.edges[next].y0 <= sy {
+				r.active = append(r.active, next)
+				next++
+			}
+			r.crossings = r.crossings[:0]
+			kept := r.active[:0]
+			for _, i := range r.active {
+				e := &r.edges[i]
+				if e.y1 <= sy {
+					continue
+				}
+				kept = append(kept, i)
+				if e.y0 > sy {
+					continue
+				}
+				x := e.x0 + (sy-e.y0)*(e.x1-e.x0)/(e.y1-e.y0)
+				r.crossings = append(r.crossings, crossing{x, e.dir})
+			}
+			r.active = kept
+			if len(r.crossings) < 2 {
+				continue
+			}
+			sortCrossings(r.crossings)
+
+			winding := 0
+			for i := 0; i < len(r.crossings)-1; i++ {
+				if evenOdd {
+					winding ^= 1
+				} else {
+					winding += r.crossings[i].dir
+				}
+				if winding != 0 {
+					r.addSpan(row, diff, r.crossings[i].x, r.crossings[i+1].x, weight)
+				}
+			}
+		}
+
+		//累加整像素区间
+		acc := float32(0)
+		for x := x0; x < x1; x++ {
+			acc += diff[x]
+			diff[x] = 0
+			v := row[x] + acc
+			if v > 1 {
+				v = 1
+			}
+			row[x] = v
+		}
+		diff[x1], diff[x1+1] = 0, 0
+	}
+}
+
+// addSpan 累加[xa,xb)的覆盖率，两端按面积计算
+func (r *rasterizer) addSpan(row, diff []float32, xa, xb, weight float64) {
+	if xa < 0 {
+		xa = 0
+	}
+	if xb > float64(r.w) {
+		xb = float64(r.w)
+	}
+	if xb <= xa {
+		return
+	}
+	ia, ib := int(xa), int(xb)
+	w := float32(weight)
+	if ia == ib {
+		row[ia] += float32(xb-xa) * w
+		return
+	}
+	row[ia] += float32(float64(ia+1)-xa) * w
+	if ib > ia+1 {
+		diff[ia+1] += w
+		diff[ib] -= w
+	}
+	if ib < r.w {
+		row[ib] += float32(xb-float64(ib)) * w
+	}
+}
+
+// 交点数量通常很少，插入排序更快
+func sortCrossings(c []crossing) {
+	for i := 1; i < len(c); i++ {
+		v := c[i]
+		j := i - 1
+		for j >= 0 && c[j].x > v.x {
+			c[j+1] = c[j]
+			j--
+		}
+		c[j+1] = v
+	}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// stroker 将描边转换为可按非零规则填充的多边形
+type stroker struct {
+	halfWidth  float64
+	join       int
+	cap        int
+	miterLimit float64
+	out        []path
+}
+
+// stroke 生成描边多边形，width为画布坐标系下的线宽
+func stroke(paths []path, width float64, style *strokeStyle) []path {
+	if width <= 0 {
+		return nil
+	}
+	s := &stroker{
+		halfWidth:  width / 2,
+		join:       style.LineJoin,
+		cap:        style.LineCap,
+		miterLimit: style.MiterLimit,
+	}
+	if s.miterLimit <= 0 {
+		s.miterLimit = 4
+	}
+	for _, p := range paths {
+		s.strokePath(p)
+	}
+	return s.out
+}
+
+func (s *stroker) strokePath(p path) {
+	//去除重复点
+	pts := make([]point, 0, len(p.pts))
+	for _, pt := range p.pts {
+		if len(pts) == 0 || pt.sub(pts[len(pts)-1]).length() > 1e-6 {
+			pts = append(pts, pt)
+		}
+	}
+	closed := p.closed
+	if closed && len(pts) > 1 && pts[0].sub(pts[len(pts)-1]).length() <= 1e-6 {
+		pts = pts[:len(pts)-1]
+	}
+	n := len(pts)
+	if n < 2 {
+		if n == 1 && !closed && s.cap == lineCapRound {
+			s.addCircle(pts[0])
+		}
+		return
+	}
+
+	segments := n - 1
+	if closed {
+		segments = n
+	}
+	dirs := make([]point, segments)
+	for i := 0; i < segments; i++ {
+		a, b := pts[i], pts[(i+1)%n]
+		d := b.sub(a)
+		dirs[i] = d.scale(1 / d.length())
+		nrm := point{-dirs[i].Y, dirs[i].X}.scale(s.halfWidth)
+		s.addPolygon(a.add(nrm), b.add(nrm), b.sub(nrm), a.sub(nrm))
+	}
+
+	//连接处
+	for i := 1; i < segments; i++ {
+		s.addJoin(pts[i], dirs[i-1], dirs[i])
+	}
+	if closed {
+		s.addJoin(pts[0], dirs[segments-1], dirs[0])
+		return
+	}
+
+	//端点
+	s.addCap(pts[0], dirs[0].scale(-1))
+	s.addCap(pts[n-1], dirs[segments-1])
+}
+
+func (s *stroker) addJoin(v, d0, d1 point) {
+	cross := d0.X*d1.Y - d0.Y*d1.X
+	dot := d0.X*d1.X + d0.Y*d1.Y
+	if math.Abs(cross) < 1e-9 && dot > 0 {
+		return
+	}
+	n0 := point{-d0.Y, d0.X}.scale(s.halfWidth)
+	n1 := point{-d1.Y, d1.X}.scale(s.halfWidth)
+
+	//转角很小时各种连接方式的差异可以忽略
+	if s.join == lineJoinRound && dot < 0.99 {
+		s.addCircle(v)
+		return
+	}
+	s.addPolygon(v, v.add(n0), v.add(n1))
+	s.addPolygon(v, v.sub(n0), v.sub(n1))
+	if s.join != lineJoinMiter {
+		return
+	}
+
+	side := -1.0
+	if cross < 0 {
+		side = 1
+	}
+	ratio := 1 / math.Sqrt(math.Max((1+dot)/2, 1e-12))
+	if ratio > s.miterLimit {
+		return
+	}
+	bisector := n0.add(n1).scale(side)
+	l := bisector.length()
+	if l == 0 {
+		return
+	}
+	tip := v.add(bisector.scale(s.halfWidth * ratio / l))
+	s.addPolygon(v.add(n0.scale(side)), tip, v.add(n1.scale(side)), v)
+}
+
+// addCap d为端点处向外的方向
+func (s *stroker) addCap(v, d point) {
+	switch s.cap {
+	case lineCapRound:
+		s.addCircle(v)
+	case lineCapSquare:
+		nrm := point{-d.Y, d.X}.scale(s.halfWidth)
+		ext := d.scale(s.halfWidth)
+		s.addPolygon(v.add(nrm), v.add(nrm).add(ext), v.sub(nrm).add(ext), v.sub(nrm))
+	}
+}
+
+func (s *stroker) addCircle(c point) {
+	n := int(math.Ceil(s.halfWidth * 2))
+	n = clampInt(n, 8, 64)
+	pts := make([]point, n)
+	for i := range pts {
+		sin, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+		pts[i] = point{c.X + cos*s.halfWidth, c.Y + sin*s.halfWidth}
+	}
+	s.out = append(s.out, path{pts: pts, closed: true})
+}
+
+// addPolygon 统一为正方向后加入，使非零规则下各部分取并集
+func (s *stroker) addPolygon(pts ...point) {
+	area := 0.0
+	for i := range pts {
+		a, b := pts[i], pts[(i+1)%len(pts)]
+		area += a.X*b.Y - b.X*a.Y
+	}
+	if area == 0 {
+		return
+	}
+	if area < 0 {
+		for i, j := 0, len(pts)-1; i < j; i, j = i+1, j-1 {
+			pts[i], pts[j] = pts[j], pts[i]
+		}
+	}
+	s.out = append(s.out, path{pts: pts, closed: true})
+}
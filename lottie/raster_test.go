@@ -0,0 +1,163 @@
+package lottie
+
+import (
+	"math"
+	"testing"
+)
+
+func rectPath(x0, y0, x1, y1 float64) path {
+	return path{pts: []point{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}}, closed: true}
+}
+
+// 五角星，自相交，中心五边形的环绕数为2
+func starPath(cx, cy, r float64) path {
+	pts := make([]point, 5)
+	for i := range pts {
+		sin, cos := math.Sincos((-90 + 144*float64(i)) * math.Pi / 180)
+		pts[i] = point{cx + cos*r, cy + sin*r}
+	}
+	return path{pts: pts, closed: true}
+}
+
+func fillCoverage(w, h int, paths []path, evenOdd bool) *coverage {
+	cov := newCoverage(w, h)
+	newRasterizer(w, h).fill(paths, evenOdd, cov)
+	return cov
+}
+
+func (c *coverage) at(x, y int) float32 {
+	return c.a[y*c.w+x]
+}
+
+func near(a float32, b float64) bool {
+	return math.Abs(float64(a)-b) < 0.02
+}
+
+func TestFillRect(t *testing.T) {
+	tests := []struct {
+		name string
+		rect path
+		want map[[2]int]float64
+	}{
+		{
+			name: "整像素",
+			rect: rectPath(2, 3, 7, 6),
+			want: map[[2]int]float64{
+				{2, 3}: 1, {6, 5}: 1, {4, 4}: 1,
+				{1, 3}: 0, {7, 3}: 0, {2, 2}: 0, {2, 6}: 0,
+			},
+		},
+		{
+			name: "半像素边缘",
+			rect: rectPath(1.5, 1, 4.5, 2),
+			want: map[[2]int]float64{
+				{1, 1}: 0.5, {2, 1}: 1, {3, 1}: 1, {4, 1}: 0.5,
+				{0, 1}: 0, {5, 1}: 0, {2, 0}: 0, {2, 2}: 0,
+			},
+		},
+		{
+			name: "超出画布",
+			rect: rectPath(-5, -5, 3, 3),
+			want: map[[2]int]float64{
+				{0, 0}: 1, {2, 2}: 1, {3, 3}: 0,
+			},
+		},
+		{
+			name: "反向绕行",
+			rect: path{pts: []point{{2, 3}, {2, 6}, {7, 6}, {7, 3}}, closed: true},
+			want: map[[2]int]float64{
+				{2, 3}: 1, {6, 5}: 1, {1, 3}: 0, {7, 3}: 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, evenOdd := range []bool{false, true} {
+				cov := fillCoverage(10, 10, []path{tt.rect}, evenOdd)
+				for p, want := range tt.want {
+					if got := cov.at(p[0], p[1]); !near(got, want) {
+						t.Errorf("evenOdd=%v coverage%v = %v, want %v", evenOdd, p, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFillRule(t *testing.T) {
+	star := []path{starPath(50, 50, 40)}
+	tests := []struct {
+		name    string
+		evenOdd bool
+		want    map[[2]int]float64
+	}{
+		{
+			name:    "非零",
+			evenOdd: false,
+			want:    map[[2]int]float64{{50, 50}: 1, {50, 18}: 1, {5, 5}: 0},
+		},
+		{
+			name:    "奇偶",
+			evenOdd: true,
+			want:    map[[2]int]float64{{50, 50}: 0, {50, 18}: 1, {5, 5}: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cov := fillCoverage(100, 100, star, tt.evenOdd)
+			for p, want := range tt.want {
+				if got := cov.at(p[0], p[1]); !near(got, want) {
+					t.Errorf("coverage%v = %v, want %v", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStrokeJoin(t *testing.T) {
+	//向右再向下的折线，外侧拐角位于右上方的(35,5)
+	corner := []path{{pts: []point{{10, 10}, {30, 10}, {30, 30}}}}
+
+	tests := []struct {
+		name       string
+		join       int
+		miterLimit float64
+		tip        bool //拐角尖端(34,5)是否被覆盖
+		round      bool //圆角范围内的(33,7)是否被覆盖
+	}{
+		{name: "miter", join: lineJoinMiter, miterLimit: 4, tip: true, round: true},
+		{name: "miter默认限制", join: lineJoinMiter, miterLimit: 0, tip: true, round: true},
+		{name: "超出miterLimit退化为bevel", join: lineJoinMiter, miterLimit: 1.2, tip: false, round: false},
+		{name: "round", join: lineJoinRound, tip: false, round: true},
+		{name: "bevel", join: lineJoinBevel, tip: false, round: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			style := &strokeStyle{LineJoin: tt.join, LineCap: lineCapButt, MiterLimit: tt.miterLimit}
+			cov := fillCoverage(40, 40, stroke(corner, 10, style), false)
+
+			if got := cov.at(34, 5); (got > 0.5) != tt.tip {
+				t.Errorf("tip coverage = %v, want covered=%v", got, tt.tip)
+			}
+			if got := cov.at(33, 7); (got > 0.5) != tt.round {
+				t.Errorf("round coverage = %v, want covered=%v", got, tt.round)
+			}
+			//线段本身及内侧拐角始终被完整覆盖
+			for _, p := range [][2]int{{20, 7}, {20, 12}, {32, 20}, {27, 20}, {27, 12}} {
+				if got := cov.at(p[0], p[1]); !near(got, 1) {
+					t.Errorf("coverage%v = %v, want 1", p, got)
+				}
+			}
+			//butt端点不超出线段
+			if got := cov.at(8, 10); !near(got, 0) {
+				t.Errorf("cap coverage = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func TestStrokeZeroWidth(t *testing.T) {
+	if out := stroke([]path{rectPath(0, 0, 10, 10)}, 0, &strokeStyle{}); out != nil {
+		t.Fatalf("stroke with zero width = %v, want nil", out)
+	}
+}
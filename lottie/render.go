@@ -0,0 +1,582 @@
+package lottie
+
+import (
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 预合成及父子图层的最大嵌套深度，防止循环引用
+const maxDepth = 16
+
+// 蒙版模式
+const (
+	maskNone       = "n"
+	maskAdd        = "a"
+	maskSubtract   = "s"
+	maskIntersect  = "i"
+	maskLighten    = "l"
+	maskDarken     = "d"
+	maskDifference = "f"
+)
+
+// Renderer 将动画逐帧光栅化
+//
+// Renderer会复用内部缓冲区，不能并发使用
+type Renderer struct {
+	anim   *Animation
+	w, h   int
+	base   matrix
+	raster *rasterizer
+	assets map[string][]layer
+
+	surfaces  []*surface
+	coverages []*coverage
+}
+
+// NewRenderer 创建渲染器，输出尺寸为w×h
+func NewRenderer(anim *Animation, w, h int) *Renderer {
+	r := &Renderer{
+		anim:   anim,
+		w:      w,
+		h:      h,
+		base:   scaleMatrix(float64(w)/float64(anim.Width), float64(h)/float64(anim.Height)),
+		raster: newRasterizer(w, h),
+		assets: make(map[string][]layer, len(anim.Assets)),
+	}
+	for _, a := range anim.Assets {
+		r.assets[a.ID] = a.Layers
+	}
+	return r
+}
+
+// Render 渲染第frame帧(Lottie帧序号)
+func (r *Renderer) Render(frame float64) *image.RGBA {
+	s := r.getSurface()
+	defer r.putSurface(s)
+	r.renderLayers(s, r.anim.Layers, frame, r.base, 0)
+
+	img := image.NewRGBA(image.Rect(0, 0, r.w, r.h))
+	for i, v := range s.pix {
+		img.Pix[i] = uint8(clamp01(float64(v))*255 + 0.5)
+	}
+	return img
+}
+
+// surface 预乘alpha的浮点RGBA画布
+type surface struct {
+	pix []float32
+}
+
+func (r *Renderer) getSurface() *surface {
+	if n := len(r.surfaces); n > 0 {
+		s := r.surfaces[n-1]
+		r.surfaces = r.surfaces[:n-1]
+		clear(s.pix)
+		return s
+	}
+	return &surface{pix: make([]float32, r.w*r.h*4)}
+}
+
+func (r *Renderer) putSurface(s *surface) {
+	r.surfaces = append(r.surfaces, s)
+}
+
+func (r *Renderer) getCoverage() *coverage {
+	if n := len(r.coverages); n > 0 {
+		c := r.coverages[n-1]
+		r.coverages = r.coverages[:n-1]
+		return c
+	}
+	return newCoverage(r.w, r.h)
+}
+
+func (r *Renderer) putCoverage(c *coverage) {
+	c.reset()
+	r.coverages = append(r.coverages, c)
+}
+
+// blend 将预乘颜色c以覆盖率a叠加到第i个像素
+func (s *surface) blend(i int, c [4]float32, a float32) {
+	p := s.pix[i*4 : i*4+4 : i*4+4]
+	inv := 1 - c[3]*a
+	p[0] = c[0]*a + p[0]*inv
+	p[1] = c[1]*a + p[1]*inv
+	p[2] = c[2]*a + p[2]*inv
+	p[3] = c[3]*a + p[3]*inv
+}
+
+// fill 以纯色填充覆盖区域
+func (s *surface) fill(cov *coverage, c [4]float32) {
+	for y := cov.y0; y < cov.y1; y++ {
+		for x := cov.x0; x < cov.x1; x++ {
+			i := y*cov.w + x
+			if a := cov.a[i]; a > 0 {
+				s.blend(i, c, a)
+			}
+		}
+	}
+}
+
+// composite 将src以不透明度alpha叠加到s上
+func (s *surface) composite(src *surface, alpha float32) {
+	for i := 0; i < len(s.pix); i += 4 {
+		sa := src.pix[i+3] * alpha
+		if sa == 0 {
+			continue
+		}
+		inv := 1 - sa
+		s.pix[i] = src.pix[i]*alpha + s.pix[i]*inv
+		s.pix[i+1] = src.pix[i+1]*alpha + s.pix[i+1]*inv
+		s.pix[i+2] = src.pix[i+2]*alpha + s.pix[i+2]*inv
+		s.pix[i+3] = sa + s.pix[i+3]*inv
+	}
+}
+
+// multiply 按逐像素系数缩放
+func (s *surface) multiply(k []float32) {
+	for i, v := range k {
+		if v == 1 {
+			continue
+		}
+		p := s.pix[i*4 : i*4+4 : i*4+4]
+		p[0] *= v
+		p[1] *= v
+		p[2] *= v
+		p[3] *= v
+	}
+}
+
+func (l *layer) visible(frame float64) bool {
+	return frame >= l.InPoint && frame < l.OutPoint
+}
+
+// matrix 计算包含父图层在内的变换矩阵
+func (l *layer) matrix(byIndex map[int]*layer, frame float64) matrix {
+	m := l.Ks.matrix(frame)
+	parent := l.Parent
+	for depth := 0; parent != nil && depth < maxDepth; depth++ {
+		p, ok := byIndex[*parent]
+		if !ok {
+			break
+		}
+		m = p.Ks.matrix(frame).mul(m)
+		parent = p.Parent
+	}
+	return m
+}
+
+// renderLayers 从下到上绘制图层
+func (r *Renderer) renderLayers(dst *surface, layers []layer, frame float64, m matrix, depth int) {
+	if depth > maxDepth {
+		return
+	}
+	byIndex := make(map[int]*layer, len(layers))
+	for i := range layers {
+		if layers[i].Index != nil {
+			byIndex[*layers[i].Index] = &layers[i]
+		}
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		l := &layers[i]
+		//遮罩图层只在被引用时绘制
+		if l.Hidden || l.IsMatte == 1 || !l.visible(frame) {
+			continue
+		}
+		var matte *layer
+		if l.Matte != matteNone && i > 0 {
+			matte = &layers[i-1]
+		}
+		r.renderLayer(dst, l, matte, byIndex, frame, m, depth)
+	}
+}
+
+func (r *Renderer) renderLayer(dst *surface, l, matte *layer, byIndex map[int]*layer, frame float64, parent matrix, depth int) {
+	opacity := l.Ks.opacity(frame)
+	if opacity <= 0 {
+		return
+	}
+	m := parent.mul(l.matrix(byIndex, frame))
+
+	if len(l.Masks) == 0 && matte == nil && (l.Type != layerPrecomp || opacity >= 1) {
+		r.renderContent(dst, l, frame, m, opacity, depth)
+		return
+	}
+
+	//蒙版、遮罩及半透明的预合成需要离屏绘制
+	offscreen := r.getSurface()
+	defer r.putSurface(offscreen)
+	alpha := 1.0
+	if l.Type == layerPrecomp {
+		r.renderContent(offscreen, l, frame, m, 1, depth)
+		alpha = opacity
+	} else {
+		r.renderContent(offscreen, l, frame, m, opacity, depth)
+	}
+	if len(l.Masks) > 0 {
+		r.applyMasks(offscreen, l.Masks, frame, m)
+	}
+	if matte != nil {
+		r.applyMatte(offscreen, l.Matte, matte, byIndex, frame, parent, depth)
+	}
+	dst.composite(offscreen, float32(alpha))
+}
+
+func (r *Renderer) renderContent(dst *surface, l *layer, frame float64, m matrix, opacity float64, depth int) {
+	switch l.Type {
+	case layerShape:
+		r.paintShapes(dst, buildShapes(l.Shapes, frame, m, opacity), frame)
+	case layerSolid:
+		rect := &bezierShape{
+			Closed: true,
+			V:      [][]float64{{0, 0}, {l.SolidWidth, 0}, {l.SolidWidth, l.SolidHeight}, {0, l.SolidHeight}},
+		}
+		cov := r.getCoverage()
+		defer r.putCoverage(cov)
+		r.raster.fill([]path{rect.toPath(m)}, false, cov)
+		dst.fill(cov, premultiply(parseHexColor(l.SolidColor), opacity))
+	case layerPrecomp:
+		layers, ok := r.assets[l.RefID]
+		if !ok {
+			return
+		}
+		stretch := l.Stretch
+		if stretch == 0 {
+			stretch = 1
+		}
+		r.renderLayers(dst, layers, (frame-l.Start)/stretch, m, depth+1)
+	}
+}
+
+// applyMasks 按蒙版裁剪图层
+func (r *Renderer) applyMasks(s *surface, masks []layerMask, frame float64, m matrix) {
+	acc := r.getCoverage()
+	defer r.putCoverage(acc)
+	cov := r.getCoverage()
+	defer r.putCoverage(cov)
+
+	first := true
+	for i := range masks {
+		mask := &masks[i]
+		if mask.Mode == maskNone {
+			continue
+		}
+		if first {
+			first = false
+			if mask.Mode == maskSubtract {
+				acc.fillAll(1)
+			} else {
+				acc.fillAll(0)
+			}
+		}
+		cov.reset()
+		if shape := mask.Path.at(frame); shape != nil {
+			r.raster.fill([]path{shape.toPath(m)}, false, cov)
+		}
+		opacity := float32(clamp01(mask.Opacity.at(frame, 100)[0] / 100))
+		for j, a := range acc.a {
+			c := cov.a[j]
+			if mask.Inverse {
+				c = 1 - c
+			}
+			c *= opacity
+			switch mask.Mode {
+			case maskAdd:
+				a = a + c - a*c
+			case maskSubtract:
+				a *= 1 - c
+			case maskIntersect:
+				a *= c
+			case maskLighten:
+				a = max(a, c)
+			case maskDarken:
+				a = min(a, c)
+			case maskDifference:
+				a = float32(math.Abs(float64(a - c)))
+			}
+			acc.a[j] = a
+		}
+	}
+	if !first {
+		s.multiply(acc.a)
+	}
+}
+
+// applyMatte 按遮罩图层的alpha或亮度裁剪图层
+func (r *Renderer) applyMatte(s *surface, mode int, matte *layer, byIndex map[int]*layer, frame float64, parent matrix, depth int) {
+	ms := r.getSurface()
+	defer r.putSurface(ms)
+	if matte.visible(frame) {
+		r.renderLayer(ms, matte, nil, byIndex, frame, parent, depth)
+	}
+	for i := 0; i < len(s.pix); i += 4 {
+		var v float32
+		switch mode {
+		case matteLuma, matteLumaInverted:
+			v = 0.299*ms.pix[i] + 0.587*ms.pix[i+1] + 0.114*ms.pix[i+2]
+		default:
+			v = ms.pix[i+3]
+		}
+		if mode == matteAlphaInvert || mode == matteLumaInverted {
+			v = 1 - v
+		}
+		s.pix[i] *= v
+		s.pix[i+1] *= v
+		s.pix[i+2] *= v
+		s.pix[i+3] *= v
+	}
+}
+
+// shapeGroupNode 计算完几何后的形状组
+type shapeGroupNode struct {
+	m     matrix
+	alpha float64
+	nodes []shapeNode
+}
+
+type shapeNode struct {
+	item  any
+	geom  *geometry
+	group *shapeGroupNode
+}
+
+type pathShape interface {
+	shape(frame float64) *bezierShape
+}
+
+// buildShapes 计算形状组内各路径，并应用路径裁剪
+//
+// 裁剪作用于列表中排在它之前的所有路径，包括子组内的路径
+func buildShapes(items shapeList, frame float64, m matrix, alpha float64) *shapeGroupNode {
+	for _, item := range items {
+		if tr, ok := item.(*shapeTransform); ok {
+			m = m.mul(tr.matrix(frame))
+			alpha *= tr.opacity(frame)
+		}
+	}
+	g := &shapeGroupNode{m: m, alpha: alpha, nodes: make([]shapeNode, len(items))}
+	for i, item := range items {
+		node := &g.nodes[i]
+		node.item = item
+		switch s := item.(type) {
+		case *shapeGroup:
+			node.group = buildShapes(s.Items, frame, m, alpha)
+		case *shapeTrim:
+			s.trim(collectGeometry(g.nodes[:i], nil), frame)
+		case pathShape:
+			node.geom = new(geometry)
+			if b := s.shape(frame); b != nil && len(b.V) > 0 {
+				node.geom.paths = []path{b.toPath(m)}
+			}
+		}
+	}
+	return g
+}
+
+func collectGeometry(nodes []shapeNode, dst []*geometry) []*geometry {
+	for i := range nodes {
+		if nodes[i].geom != nil {
+			dst = append(dst, nodes[i].geom)
+		}
+		if nodes[i].group != nil {
+			dst = collectGeometry(nodes[i].group.nodes, dst)
+		}
+	}
+	return dst
+}
+
+func collectPaths(nodes []shapeNode) []path {
+	var paths []path
+	for _, g := range collectGeometry(nodes, nil) {
+		paths = append(paths, g.paths...)
+	}
+	return paths
+}
+
+// paintShapes 绘制形状组
+//
+// 填充和描边作用于排在它之前的路径，排在后面的样式先绘制
+func (r *Renderer) paintShapes(dst *surface, g *shapeGroupNode, frame float64) {
+	if g.alpha <= 0 {
+		return
+	}
+	for i := len(g.nodes) - 1; i >= 0; i-- {
+		node := &g.nodes[i]
+		if node.group != nil {
+			r.paintShapes(dst, node.group, frame)
+			continue
+		}
+		switch s := node.item.(type) {
+		case *shapeFill:
+			r.paintFill(dst, s, collectPaths(g.nodes[:i]), g, frame)
+		case *shapeStroke:
+			r.paintStroke(dst, s, collectPaths(g.nodes[:i]), g, frame)
+		case *shapeGradient:
+			r.paintGradient(dst, s, collectPaths(g.nodes[:i]), g, frame)
+		}
+	}
+}
+
+func (r *Renderer) paintFill(dst *surface, s *shapeFill, paths []path, g *shapeGroupNode, frame float64) {
+	opacity := s.Opacity.at(frame, 100)[0] / 100 * g.alpha
+	if opacity <= 0 || len(paths) == 0 {
+		return
+	}
+	cov := r.getCoverage()
+	defer r.putCoverage(cov)
+	r.raster.fill(paths, s.FillRule == fillRuleEvenOdd, cov)
+	dst.fill(cov, premultiply(colorOf(s.Color.at(frame, 0, 0, 0)), opacity))
+}
+
+func (r *Renderer) paintStroke(dst *surface, s *shapeStroke, paths []path, g *shapeGroupNode, frame float64) {
+	opacity := s.Opacity.at(frame, 100)[0] / 100 * g.alpha
+	if opacity <= 0 || len(paths) == 0 {
+		return
+	}
+	width := s.Width.at(frame, 0)[0] * g.m.scaleFactor()
+	cov := r.getCoverage()
+	defer r.putCoverage(cov)
+	r.raster.fill(stroke(paths, width, &s.strokeStyle), false, cov)
+	dst.fill(cov, premultiply(colorOf(s.Color.at(frame, 0, 0, 0)), opacity))
+}
+
+func (r *Renderer) paintGradient(dst *surface, s *shapeGradient, paths []path, g *shapeGroupNode, frame float64) {
+	opacity := float32(s.Opacity.at(frame, 100)[0] / 100 * g.alpha)
+	if opacity <= 0 || len(paths) == 0 {
+		return
+	}
+	inv, ok := g.m.invert()
+	if !ok {
+		return
+	}
+	cov := r.getCoverage()
+	defer r.putCoverage(cov)
+	if s.isStroke {
+		width := s.Width.at(frame, 0)[0] * g.m.scaleFactor()
+		r.raster.fill(stroke(paths, width, &s.strokeStyle), false, cov)
+	} else {
+		r.raster.fill(paths, s.FillRule == fillRuleEvenOdd, cov)
+	}
+	if cov.empty() {
+		return
+	}
+
+	lut := s.Gradient.lut(frame)
+	start := pointOf(s.Start.at(frame, 0, 0))
+	end := pointOf(s.End.at(frame, 0, 0))
+	d := end.sub(start)
+	l2 := d.X*d.X + d.Y*d.Y
+	radius := math.Sqrt(l2)
+
+	//渐变在形状坐标系内计算
+	for y := cov.y0; y < cov.y1; y++ {
+		for x := cov.x0; x < cov.x1; x++ {
+			i := y*cov.w + x
+			a := cov.a[i]
+			if a <= 0 {
+				continue
+			}
+			p := inv.apply(point{float64(x) + 0.5, float64(y) + 0.5})
+			t := 0.0
+			if s.GradientType == gradientRadial {
+				if radius > 0 {
+					t = p.sub(start).length() / radius
+				}
+			} else if l2 > 0 {
+				v := p.sub(start)
+				t = (v.X*d.X + v.Y*d.Y) / l2
+			}
+			dst.blend(i, lut[int(clamp01(t)*255+0.5)], a*opacity)
+		}
+	}
+}
+
+// lut 生成256级的预乘颜色表
+//
+// k的前4*p个值为(位置,r,g,b)，其后为可选的(位置,不透明度)
+func (g *gradientColors) lut(frame float64) *[256][4]float32 {
+	values := g.Colors.at(frame)
+	n := g.Points
+	if n <= 0 || len(values) < n*4 {
+		n = len(values) / 4
+	}
+	var colorStops, alphaStops [][]float64
+	for i := 0; i < n; i++ {
+		colorStops = append(colorStops, values[i*4:i*4+4])
+	}
+	for i := n * 4; i+1 < len(values); i += 2 {
+		alphaStops = append(alphaStops, values[i:i+2])
+	}
+
+	lut := new([256][4]float32)
+	for i := range lut {
+		t := float64(i) / 255
+		c := [3]float64{}
+		if len(colorStops) > 0 {
+			c = [3]float64{stopValue(colorStops, t, 1), stopValue(colorStops, t, 2), stopValue(colorStops, t, 3)}
+		}
+		a := 1.0
+		if len(alphaStops) > 0 {
+			a = stopValue(alphaStops, t, 1)
+		}
+		lut[i] = premultiply(c, a)
+	}
+	return lut
+}
+
+// stopValue 在色标之间线性插值，stops[i][0]为位置
+func stopValue(stops [][]float64, t float64, idx int) float64 {
+	if t <= stops[0][0] {
+		return stops[0][idx]
+	}
+	for i := 1; i < len(stops); i++ {
+		if t <= stops[i][0] {
+			a, b := stops[i-1], stops[i]
+			if b[0] == a[0] {
+				return b[idx]
+			}
+			k := (t - a[0]) / (b[0] - a[0])
+			return a[idx] + (b[idx]-a[idx])*k
+		}
+	}
+	return stops[len(stops)-1][idx]
+}
+
+// colorOf 取颜色的rgb分量，兼容0-255的旧格式
+func colorOf(v []float64) [3]float64 {
+	c := [3]float64{v[0], v[1], v[2]}
+	if c[0] > 1 || c[1] > 1 || c[2] > 1 {
+		for i := range c {
+			c[i] /= 255
+		}
+	}
+	return c
+}
+
+func premultiply(c [3]float64, alpha float64) [4]float32 {
+	a := clamp01(alpha)
+	return [4]float32{
+		float32(clamp01(c[0]) * a),
+		float32(clamp01(c[1]) * a),
+		float32(clamp01(c[2]) * a),
+		float32(a),
+	}
+}
+
+// parseHexColor 解析#rrggbb格式的颜色
+func parseHexColor(s string) [3]float64 {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) < 6 {
+		return [3]float64{}
+	}
+	c := [3]float64{}
+	for i := range c {
+		v, err := strconv.ParseUint(s[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return [3]float64{}
+		}
+		c[i] = float64(v) / 255
+	}
+	return c
+}
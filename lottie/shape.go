@@ -0,0 +1,487 @@
+package lottie
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// kappa 用三次贝塞尔曲线近似四分之一圆弧的控制点系数
+const kappa = 0.5519150244935105
+
+type shapeList []any
+
+type shapeGroup struct {
+	Items shapeList `json:"it"`
+}
+
+type shapeTransform struct {
+	transform
+}
+
+type shapePath struct {
+	Path      shapeProp `json:"ks"`
+	Direction int       `json:"d"`
+}
+
+type shapeRect struct {
+	Position  valueProp `json:"p"`
+	Size      valueProp `json:"s"`
+	Roundness valueProp `json:"r"`
+	Direction int       `json:"d"`
+}
+
+type shapeEllipse struct {
+	Position  valueProp `json:"p"`
+	Size      valueProp `json:"s"`
+	Direction int       `json:"d"`
+}
+
+type shapeStar struct {
+	StarType    int       `json:"sy"`
+	Position    valueProp `json:"p"`
+	OuterRadius valueProp `json:"or"`
+	InnerRadius valueProp `json:"ir"`
+	Rotation    valueProp `json:"r"`
+	Points      valueProp `json:"pt"`
+	Direction   int       `json:"d"`
+}
+
+type shapeFill struct {
+	Color    valueProp `json:"c"`
+	Opacity  valueProp `json:"o"`
+	FillRule int       `json:"r"`
+}
+
+type strokeStyle struct {
+	Width      valueProp `json:"w"`
+	LineCap    int       `json:"lc"`
+	LineJoin   int       `json:"lj"`
+	MiterLimit float64   `json:"ml"`
+}
+
+type shapeStroke struct {
+	Color   valueProp `json:"c"`
+	Opacity valueProp `json:"o"`
+	strokeStyle
+}
+
+type shapeGradient struct {
+	Opacity      valueProp      `json:"o"`
+	Start        valueProp      `json:"s"`
+	End          valueProp      `json:"e"`
+	GradientType int            `json:"t"`
+	Gradient     gradientColors `json:"g"`
+	FillRule     int            `json:"r"`
+	isStroke     bool
+	strokeStyle
+}
+
+type gradientColors struct {
+	Points int       `json:"p"`
+	Colors valueProp `json:"k"`
+}
+
+type shapeTrim struct {
+	Start  valueProp `json:"s"`
+	End    valueProp `json:"e"`
+	Offset valueProp `json:"o"`
+	Mode   int       `json:"m"`
+}
+
+// 描边端点及连接样式
+const (
+	lineCapButt   = 1
+	lineCapRound  = 2
+	lineCapSquare = 3
+
+	lineJoinMiter = 1
+	lineJoinRound = 2
+	lineJoinBevel = 3
+)
+
+const gradientRadial = 2
+
+const fillRuleEvenOdd = 2
+
+// 多条路径首尾相连裁剪
+const trimIndividual = 2
+
+// 路径方向，3为逆时针
+const directionReversed = 3
+
+func (l *shapeList) UnmarshalJSON(b []byte) error {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return err
+	}
+	*l = make(shapeList, 0, len(raws))
+	for _, raw := range raws {
+		head := struct {
+			Type   string `json:"ty"`
+			Hidden bool   `json:"hd"`
+		}{}
+		if err := json.Unmarshal(raw, &head); err != nil {
+			return err
+		}
+		if head.Hidden {
+			continue
+		}
+
+		var item any
+		switch head.Type {
+		case "gr":
+			item = new(shapeGroup)
+		case "tr":
+			item = new(shapeTransform)
+		case "sh":
+			item = new(shapePath)
+		case "rc":
+			item = new(shapeRect)
+		case "el":
+			item = new(shapeEllipse)
+		case "sr":
+			item = new(shapeStar)
+		case "fl":
+			item = new(shapeFill)
+		case "st":
+			item = new(shapeStroke)
+		case "gf":
+			item = new(shapeGradient)
+		case "gs":
+			item = &shapeGradient{isStroke: true}
+		case "tm":
+			item = new(shapeTrim)
+		default:
+			//不支持的类型直接忽略
+			continue
+		}
+		if err := json.Unmarshal(raw, item); err != nil {
+			return err
+		}
+		*l = append(*l, item)
+	}
+	return nil
+}
+
+// path 已变换到画布坐标系并展平的折线
+type path struct {
+	pts    []point
+	closed bool
+}
+
+// geometry 一个形状生成的路径，裁剪时原地修改
+type geometry struct {
+	paths []path
+}
+
+// toPath 将贝塞尔路径变换并展平
+func (s *bezierShape) toPath(m matrix) path {
+	p := path{closed: s.Closed}
+	n := len(s.V)
+	if n == 0 {
+		return p
+	}
+	vertex := func(i int) point {
+		return pointOf(s.V[i])
+	}
+	tangent := func(list [][]float64, i int) point {
+		if i < len(list) {
+			return pointOf(list[i])
+		}
+		return point{}
+	}
+
+	p.pts = append(p.pts, m.apply(vertex(0)))
+	segments := n - 1
+	if s.Closed {
+		segments = n
+	}
+	for i := 0; i < segments; i++ {
+		j := (i + 1) % n
+		p0 := vertex(i)
+		p3 := vertex(j)
+		p1 := p0.add(tangent(s.O, i))
+		p2 := p3.add(tangent(s.I, j))
+		p.pts = flattenCubic(p.pts, m.apply(p0), m.apply(p1), m.apply(p2), m.apply(p3))
+	}
+	if s.Closed && len(p.pts) > 1 {
+		//闭合路径的最后一点与起点重合
+		p.pts = p.pts[:len(p.pts)-1]
+	}
+	return p
+}
+
+func pointOf(v []float64) point {
+	if len(v) < 2 {
+		return point{}
+	}
+	return point{v[0], v[1]}
+}
+
+// flattenCubic 将三次贝塞尔曲线展平，追加除起点外的点
+func flattenCubic(dst []point, p0, p1, p2, p3 point) []point {
+	if p0 == p1 && p2 == p3 {
+		return append(dst, p3)
+	}
+	l := p1.sub(p0).length() + p2.sub(p1).length() + p3.sub(p2).length()
+	n := int(math.Ceil(math.Sqrt(l) * 1.5))
+	if n < 1 {
+		n = 1
+	}
+	if n > 100 {
+		n = 100
+	}
+	for i := 1; i <= n; i++ {
+		dst = append(dst, cubicPoint(p0, p1, p2, p3, float64(i)/float64(n)))
+	}
+	return dst
+}
+
+// reversed 反转路径方向
+func (s *bezierShape) reversed() *bezierShape {
+	n := len(s.V)
+	r := &bezierShape{Closed: s.Closed, V: make([][]float64, n), I: make([][]float64, n), O: make([][]float64, n)}
+	for i := 0; i < n; i++ {
+		j := n - 1 - i
+		r.V[i] = s.V[j]
+		if j < len(s.O) {
+			r.I[i] = s.O[j]
+		}
+		if j < len(s.I) {
+			r.O[i] = s.I[j]
+		}
+	}
+	return r
+}
+
+func (s *shapePath) shape(frame float64) *bezierShape {
+	b := s.Path.at(frame)
+	if b != nil && s.Direction == directionReversed {
+		return b.reversed()
+	}
+	return b
+}
+
+func (s *shapeRect) shape(frame float64) *bezierShape {
+	pos := s.Position.at(frame, 0, 0)
+	size := s.Size.at(frame, 0, 0)
+	x, y := pos[0], pos[1]
+	hw, hh := size[0]/2, size[1]/2
+	r := math.Min(s.Roundness.at(frame, 0)[0], math.Min(hw, hh))
+	left, right, top, bottom := x-hw, x+hw, y-hh, y+hh
+
+	b := &bezierShape{Closed: true}
+	add := func(vx, vy, ix, iy, ox, oy float64) {
+		b.V = append(b.V, []float64{vx, vy})
+		b.I = append(b.I, []float64{ix, iy})
+		b.O = append(b.O, []float64{ox, oy})
+	}
+	if r <= 0 {
+		add(right, top, 0, 0, 0, 0)
+		add(right, bottom, 0, 0, 0, 0)
+		add(left, bottom, 0, 0, 0, 0)
+		add(left, top, 0, 0, 0, 0)
+	} else {
+		c := r * kappa
+		add(right, top+r, 0, -c, 0, 0)
+		add(right, bottom-r, 0, 0, 0, c)
+		add(right-r, bottom, c, 0, 0, 0)
+		add(left+r, bottom, 0, 0, -c, 0)
+		add(left, bottom-r, 0, c, 0, 0)
+		add(left, top+r, 0, 0, 0, -c)
+		add(left+r, top, -c, 0, 0, 0)
+		add(right-r, top, 0, 0, c, 0)
+	}
+	if s.Direction == directionReversed {
+		return b.reversed()
+	}
+	return b
+}
+
+func (s *shapeEllipse) shape(frame float64) *bezierShape {
+	pos := s.Position.at(frame, 0, 0)
+	size := s.Size.at(frame, 0, 0)
+	x, y := pos[0], pos[1]
+	rx, ry := size[0]/2, size[1]/2
+	cx, cy := rx*kappa, ry*kappa
+
+	b := &bezierShape{
+		Closed: true,
+		V:      [][]float64{{x, y - ry}, {x + rx, y}, {x, y + ry}, {x - rx, y}},
+		I:      [][]float64{{-cx, 0}, {0, -cy}, {cx, 0}, {0, cy}},
+		O:      [][]float64{{cx, 0}, {0, cy}, {-cx, 0}, {0, -cy}},
+	}
+	if s.Direction == directionReversed {
+		return b.reversed()
+	}
+	return b
+}
+
+func (s *shapeStar) shape(frame float64) *bezierShape {
+	pos := s.Position.at(frame, 0, 0)
+	points := int(math.Round(s.Points.at(frame, 5)[0]))
+	if points < 2 {
+		return nil
+	}
+	outer := s.OuterRadius.at(frame, 0)[0]
+	inner := s.InnerRadius.at(frame, 0)[0]
+	angle := (s.Rotation.at(frame, 0)[0] - 90) * math.Pi / 180
+
+	count := points
+	step := 2 * math.Pi / float64(points)
+	if s.StarType != 2 {
+		//star
+		count = points * 2
+		step /= 2
+	}
+	b := &bezierShape{Closed: true}
+	for i := 0; i < count; i++ {
+		radius := outer
+		if s.StarType != 2 && i%2 == 1 {
+			radius = inner
+		}
+		sin, cos := math.Sincos(angle + step*float64(i))
+		b.V = append(b.V, []float64{pos[0] + radius*cos, pos[1] + radius*sin})
+		b.I = append(b.I, []float64{0, 0})
+		b.O = append(b.O, []float64{0, 0})
+	}
+	if s.Direction == directionReversed {
+		return b.reversed()
+	}
+	return b
+}
+
+// 计算折线长度
+func (p path) length() float64 {
+	l := 0.0
+	for i := 1; i < len(p.pts); i++ {
+		l += p.pts[i].sub(p.pts[i-1]).length()
+	}
+	if p.closed && len(p.pts) > 1 {
+		l += p.pts[0].sub(p.pts[len(p.pts)-1]).length()
+	}
+	return l
+}
+
+// extract 截取折线上[from,to]长度范围内的部分
+func (p path) extract(from, to float64) path {
+	out := path{}
+	if to <= from || len(p.pts) < 2 {
+		return out
+	}
+	pts := p.pts
+	if p.closed {
+		pts = append(pts[:len(pts):len(pts)], pts[0])
+	}
+	dist := 0.0
+	for i := 1; i < len(pts); i++ {
+		a, b := pts[i-1], pts[i]
+		segLen := b.sub(a).length()
+		segStart, segEnd := dist, dist+segLen
+		dist = segEnd
+		if segEnd < from || segLen == 0 {
+			continue
+		}
+		if segStart > to {
+			break
+		}
+		if len(out.pts) == 0 {
+			out.pts = append(out.pts, lerpPoint(a, b, math.Max(0, (from-segStart)/segLen)))
+		}
+		if segEnd >= to {
+			out.pts = append(out.pts, lerpPoint(a, b, (to-segStart)/segLen))
+			break
+		}
+		out.pts = append(out.pts, b)
+	}
+	return out
+}
+
+// trimRanges 计算裁剪区间
+//
+// start、end为0-1的比例，offset为圈数；跨越起点时拆分为两段，
+// all表示无需裁剪
+func trimRanges(start, end, offset float64) (ranges [][2]float64, all bool) {
+	if start > end {
+		start, end = end, start
+	}
+	if end-start >= 1 {
+		return nil, true
+	}
+	if end-start <= 0 {
+		return nil, false
+	}
+	start += offset
+	end += offset
+	shift := math.Floor(start)
+	start -= shift
+	end -= shift
+
+	ranges = [][2]float64{{start, math.Min(end, 1)}}
+	if end > 1 {
+		ranges = append(ranges, [2]float64{0, end - 1})
+	}
+	return ranges, false
+}
+
+// trimSimultaneously 每条路径分别按相同比例裁剪
+func trimSimultaneously(paths []path, ranges [][2]float64) []path {
+	var out []path
+	for _, p := range paths {
+		l := p.length()
+		var pieces []path
+		for _, r := range ranges {
+			if piece := p.extract(r[0]*l, r[1]*l); len(piece.pts) > 1 {
+				pieces = append(pieces, piece)
+			}
+		}
+		//闭合路径跨越起点时，两段首尾相接
+		if p.closed && len(pieces) == 2 {
+			pieces = []path{{pts: append(pieces[0].pts, pieces[1].pts[1:]...)}}
+		}
+		out = append(out, pieces...)
+	}
+	return out
+}
+
+// trimIndividually 所有路径首尾相连视为一条路径裁剪
+func trimIndividually(geoms []*geometry, ranges [][2]float64) {
+	total := 0.0
+	for _, g := range geoms {
+		for _, p := range g.paths {
+			total += p.length()
+		}
+	}
+	offset := 0.0
+	for _, g := range geoms {
+		var out []path
+		for _, p := range g.paths {
+			l := p.length()
+			for _, r := range ranges {
+				if piece := p.extract(r[0]*total-offset, r[1]*total-offset); len(piece.pts) > 1 {
+					out = append(out, piece)
+				}
+			}
+			offset += l
+		}
+		g.paths = out
+	}
+}
+
+// trim 对geoms应用路径裁剪
+func (s *shapeTrim) trim(geoms []*geometry, frame float64) {
+	start := s.Start.at(frame, 0)[0] / 100
+	end := s.End.at(frame, 100)[0] / 100
+	offset := s.Offset.at(frame, 0)[0] / 360
+	ranges, all := trimRanges(start, end, offset)
+	if all {
+		return
+	}
+	if s.Mode == trimIndividual {
+		trimIndividually(geoms, ranges)
+		return
+	}
+	for _, g := range geoms {
+		g.paths = trimSimultaneously(g.paths, ranges)
+	}
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"flag"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/converter"
+	"github.com/rroy233/StickerDownloader/dashboard"
 	"github.com/rroy233/StickerDownloader/db"
 	"github.com/rroy233/StickerDownloader/handler"
 	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/metrics"
 	"github.com/rroy233/StickerDownloader/router"
 	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/throttle"
 	"github.com/rroy233/StickerDownloader/utils"
+	"github.com/rroy233/StickerDownloader/webhook"
 	"gopkg.in/rroy233/logger.v2"
 	"log"
 	"os"
@@ -23,7 +29,12 @@ var cancel context.CancelFunc
 var stopCtx context.Context
 var cancelCh chan int
 
+var runMode = flag.String("mode", "", "run mode: all, bot or worker, overrides general.run_mode")
+
 func main() {
+	flag.Parse()
+	config.SetRunMode(*runMode)
+
 	//config
 	config.Init()
 	log.Println("[main]config=" + utils.JsonEncode(config.Get()))
@@ -43,8 +54,13 @@ func main() {
 	//language
 	languages.Init()
 
+	if config.Get().General.RunMode == config.RunModeWorker {
+		runWorker()
+		return
+	}
+
 	var err error
-	bot, err = tgbotapi.NewBotAPI(config.Get().General.BotToken)
+	bot, err = tgbotapi.NewBotAPIWithAPIEndpoint(config.Get().General.BotToken, config.Get().BotAPI.Endpoint+"/bot%s/%s")
 	if err != nil {
 		logger.FATAL.Fatalln(err.Error())
 	}
@@ -53,18 +69,30 @@ func main() {
 	time.Local = time.FixedZone("CST", 8*3600)
 	config.Init()
 	rdb := db.Init()
+	languages.SetUserLanguageFunc(db.GetUserLanguage)
 	statistics.InitStatistic(rdb)
 	utils.Init(bot)
 	handler.Init(bot)
-
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := bot.GetUpdatesChan(u)
+	metrics.Start()
+	dashboard.Start()
+
+	var updates tgbotapi.UpdatesChannel
+	if config.Get().General.UpdateMode == config.UpdateModeWebhook {
+		updates, err = webhook.Start(bot)
+		if err != nil {
+			logger.FATAL.Fatalln("failed to start webhook:", err)
+		}
+	} else {
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		updates = bot.GetUpdatesChan(u)
+	}
 	stopCtx, cancel = context.WithCancel(context.Background())
 	cancelCh = make(chan int, config.Get().General.WorkerNum)
 	for i := 0; i < config.Get().General.WorkerNum; i++ {
 		go worker(stopCtx, updates, cancelCh)
 	}
+	go handler.CacheWarmup(stopCtx)
 
 	logger.Info.Println(languages.Get(nil).System.Running)
 
@@ -78,8 +106,15 @@ func main() {
 }
 
 func Stop() {
+	//stop receiving webhook updates
+	if config.Get().General.UpdateMode == config.UpdateModeWebhook {
+		webhook.Stop()
+	}
+
 	cancel()
 	waitForDone(cancelCh)
+	metrics.Stop()
+	dashboard.Stop()
 
 	//clean temp files
 	utils.CleanTmp()
@@ -91,11 +126,41 @@ func Stop() {
 	db.Close()
 }
 
+// runWorker worker模式下只从Redis拉取转码任务，不连接Telegram
+func runWorker() {
+	time.Local = time.FixedZone("CST", 8*3600)
+	db.Init()
+	utils.InitConverter()
+	metrics.Start()
+
+	stopCtx, cancel = context.WithCancel(context.Background())
+	done := converter.Start(stopCtx, config.Get().General.ConvertWorkerNum)
+
+	logger.Info.Println(languages.Get(nil).System.Running)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGKILL, syscall.SIGTERM)
+	<-sigCh
+
+	//未完成的任务将重新入队
+	cancel()
+	<-done
+	metrics.Stop()
+	utils.CleanTmp()
+	db.Close()
+	logger.Info.Println(languages.Get(nil).System.StopRunning)
+}
+
 func worker(stopCtx context.Context, uc tgbotapi.UpdatesChannel, cancelCh chan int) {
 	for {
 		select {
 		case update := <-uc:
-			utils.Limiter.Take()
+			if err := throttle.Wait(stopCtx, throttle.Updates()); err != nil {
+				//update已被确认接收，重启后不会重新推送，退出前处理完毕
+				router.Handle(update)
+				cancelCh <- 1
+				return
+			}
 			go router.Handle(update)
 		case <-stopCtx.Done():
 			cancelCh <- 1
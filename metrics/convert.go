@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 转码耗时的分桶(秒)
+var convertBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var convertDuration = &histogram{
+	name:    "convert_duration_seconds",
+	help:    "Duration of successful conversions by input extension.",
+	label:   "ext",
+	buckets: convertBuckets,
+	series:  make(map[string]*histogramSeries),
+}
+
+var convertFailures = &labeledCounter{values: make(map[string]int64)}
+
+// ObserveConvert 记录一次转码
+//
+// ext为输入文件扩展名，失败的转码只计数，不计入耗时
+func ObserveConvert(ext string, duration time.Duration, err error) {
+	if err != nil {
+		convertFailures.add(ext, 1)
+		return
+	}
+	convertDuration.observe(ext, duration.Seconds())
+}
+
+type histogram struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []int64 //counts[i]为落入buckets[i]的数量(非累计)
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(labelValue string, value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.series[labelValue]
+	if s == nil {
+		s = &histogramSeries{counts: make([]int64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogram) write(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	name := namespace + "_" + h.name
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+	for _, labelValue := range sortedKeys(h.series) {
+		s := h.series[labelValue]
+		cumulative := int64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(map[string]string{h.label: labelValue, "le": fmt.Sprint(bound)}), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(map[string]string{h.label: labelValue, "le": "+Inf"}), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %v\n", name, formatLabels(map[string]string{h.label: labelValue}), s.sum)
+		fmt.Fprintf(buf, "%s_count%s %d\n", name, formatLabels(map[string]string{h.label: labelValue}), s.count)
+	}
+}
+
+type labeledCounter struct {
+	lock   sync.Mutex
+	values map[string]int64
+}
+
+func (c *labeledCounter) add(labelValue string, delta int64) {
+	c.lock.Lock()
+	c.values[labelValue] += delta
+	c.lock.Unlock()
+}
+
+func (c *labeledCounter) snapshot() map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[string]int64, len(c.values))
+	for key, value := range c.values {
+		values[key] = value
+	}
+	return values
+}
@@ -0,0 +1,168 @@
+// Package metrics 以Prometheus文本格式导出运行指标
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/db"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const namespace = "stickerdl"
+
+var server *http.Server
+
+// 需要导出长度的任务队列，由RegisterJobQueue注册
+var jobQueues []string
+
+// statistics中的计数与导出的指标名
+var counters = []struct {
+	field string
+	name  string
+	help  string
+}{
+	{"MsgHandleTotalTimes", "updates_handled_total", "Updates handled in the current statistics period."},
+	{"MsgStickerNum", "sticker_messages_total", "Sticker messages handled in the current statistics period."},
+	{"MsgAnimationNum", "animation_messages_total", "Animation messages handled in the current statistics period."},
+	{"MsgStickerSet", "sticker_set_requests_total", "Sticker set downloads handled in the current statistics period."},
+	{"MsgStickerUrl", "sticker_url_messages_total", "Sticker set links handled in the current statistics period."},
+	{"MsgInlineQuery", "inline_queries_total", "Inline queries handled in the current statistics period."},
+	{"CacheHit", "cache_hits_total", "Sticker cache hits in the current statistics period."},
+	{"CacheMiss", "cache_misses_total", "Sticker cache misses in the current statistics period."},
+	{"NetworkUpload", "network_upload_bytes_total", "Bytes uploaded to Telegram in the current statistics period."},
+	{"NetworkDownload", "network_download_bytes_total", "Bytes downloaded from Telegram in the current statistics period."},
+}
+
+// RegisterJobQueue 注册需要导出长度的任务队列，需在Start之前调用
+func RegisterJobQueue(queue string) {
+	jobQueues = append(jobQueues, queue)
+}
+
+// Start 启动metrics服务
+func Start() {
+	cf := config.Get().Metrics
+	if !cf.Enable {
+		return
+	}
+	path := cf.Path
+	if path == "" {
+		path = "/metrics"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, Handler)
+	server = &http.Server{
+		Addr:              cf.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error.Println("[metrics]server error:", err)
+		}
+	}()
+	logger.Info.Printf("[metrics]Listening on %s%s", cf.ListenAddr, path)
+}
+
+// Stop 停止metrics服务
+func Stop() {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error.Println("[metrics]failed to shutdown server:", err)
+	}
+}
+
+// Handler 输出Prometheus文本格式的指标
+func Handler(w http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+
+	//statistics，worker模式下未初始化
+	if statistics.Statistics != nil {
+		values := statistics.Statistics.Counters()
+		for _, c := range counters {
+			writeMetric(buf, c.name, "counter", c.help, nil, float64(values[c.field]))
+		}
+		writeMetric(buf, "users", "gauge", "Users seen in the current statistics period.", nil, float64(values["UserTotalNum"]))
+	}
+
+	//queue
+	writeMetric(buf, "wait_queue_length", "gauge", "Requests in the wait queue.", nil, float64(db.QueueLen()))
+	jobReady, jobProcessing := make(map[string]int64), make(map[string]int64)
+	for _, queue := range jobQueues {
+		jobReady[queue], jobProcessing[queue] = db.JobQueueLen(queue)
+	}
+	writeLabeledGauge(buf, "job_queue_ready", "Jobs waiting to be reserved.", "queue", jobReady)
+	writeLabeledGauge(buf, "job_queue_processing", "Jobs reserved and not yet acked.", "queue", jobProcessing)
+	writeMetric(buf, "sender_queue_length", "gauge", "Messages waiting in the sender queue.", nil, float64(utils.SendQueueLen()))
+
+	//cache
+	usage, max := db.CacheDiskUsage()
+	writeMetric(buf, "cache_disk_usage_bytes", "gauge", "Local disk usage of the sticker cache.", nil, float64(usage))
+	writeMetric(buf, "cache_disk_max_bytes", "gauge", "Local disk limit of the sticker cache.", nil, float64(max))
+
+	//convert
+	convertDuration.write(buf)
+	writeLabeledCounter(buf, "convert_failures_total", "Failed conversions by input extension.", "ext", convertFailures.snapshot())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+func writeMetric(buf *bytes.Buffer, name, typ, help string, labels map[string]string, value float64) {
+	name = namespace + "_" + name
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	fmt.Fprintf(buf, "%s%s %v\n", name, formatLabels(labels), value)
+}
+
+func writeLabeledCounter(buf *bytes.Buffer, name, help, label string, values map[string]int64) {
+	writeLabeled(buf, name, "counter", help, label, values)
+}
+
+func writeLabeledGauge(buf *bytes.Buffer, name, help, label string, values map[string]int64) {
+	writeLabeled(buf, name, "gauge", help, label, values)
+}
+
+func writeLabeled(buf *bytes.Buffer, name, typ, help, label string, values map[string]int64) {
+	name = namespace + "_" + name
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(buf, "%s%s %d\n", name, formatLabels(map[string]string{label: key}), values[key])
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	for i, key := range sortedKeys(labels) {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s=%q", key, labels[key])
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
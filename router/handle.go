@@ -1,6 +1,7 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/rroy233/StickerDownloader/config"
@@ -8,19 +9,26 @@ import (
 	"github.com/rroy233/StickerDownloader/handler"
 	"github.com/rroy233/StickerDownloader/languages"
 	"github.com/rroy233/StickerDownloader/statistics"
+	"github.com/rroy233/StickerDownloader/throttle"
 	"github.com/rroy233/StickerDownloader/utils"
 	"gopkg.in/rroy233/logger.v2"
 	"runtime/debug"
 	"strings"
-	"time"
 )
 
+// 各操作消耗的令牌数
 const (
-	rateLimitShort = 2 * time.Second
-	rateLimitLong  = 10 * time.Second
+	rateCostConvert    = 1
+	rateCostStickerSet = 5
 )
 
 func Handle(update tgbotapi.Update) {
+	//drop updates from banned users
+	if db.IsBanned(utils.GetSenderID(&update)) {
+		logger.Debug.Println("[Banned] Ignored", utils.GetSenderID(&update))
+		return
+	}
+
 	//statistics
 	statistics.Statistics.Record("MsgHandleTotalTimes", 1)
 	statistics.Statistics.RecordUser(utils.MD5Short(fmt.Sprintf("%d", utils.GetUID(&update))))
@@ -41,6 +49,25 @@ func Handle(update tgbotapi.Update) {
 		return
 	}
 
+	//group mode
+	inGroup := config.Get().Group.Enable && utils.IsGroupChat(&update)
+	if inGroup {
+		if !db.IsGroupAllowed(utils.GetChatID(&update)) {
+			if update.Message != nil || update.MyChatMember != nil {
+				handler.AutoLeave(update)
+			}
+			return
+		}
+		if update.MyChatMember != nil {
+			handler.GroupJoined(update)
+			return
+		}
+		if update.Message != nil {
+			handler.GroupMessage(update)
+			return
+		}
+	}
+
 	//auto leave channel
 	if !config.Get().Community.Enable {
 		if update.ChannelPost != nil || update.EditedChannelPost != nil {
@@ -59,7 +86,8 @@ func Handle(update tgbotapi.Update) {
 	}
 
 	//channel force subscription check
-	if config.Get().Community.Enable && config.Get().Community.ForceChannelSub && !utils.CheckUserSubscription(&update, config.Get().Community.Channel.Username) {
+	//inline query无法回复提示，且每次输入都会触发，不做检查
+	if !inGroup && update.InlineQuery == nil && config.Get().Community.Enable && config.Get().Community.ForceChannelSub && !utils.CheckUserSubscription(&update, config.Get().Community.Channel.Username) {
 		extraText := ""
 		if config.Get().Community.RewardOnSub {
 			extraText = fmt.Sprintf(languages.Get(&update).BotMsg.CommChannelExtraTimesNoti, config.Get().Community.Reward.ExtraDownloadTimes)
@@ -68,7 +96,7 @@ func Handle(update tgbotapi.Update) {
 		return
 	}
 	//channel subscription reward
-	if config.Get().Community.Enable && config.Get().Community.RewardOnSub {
+	if !inGroup && update.InlineQuery == nil && config.Get().Community.Enable && config.Get().Community.RewardOnSub {
 		added := db.RewardDailyOnce(&update, config.Get().Community.Reward.ExtraDownloadTimes)
 		if added != 0 {
 			utils.SendPlainText(&update, fmt.Sprintf(languages.Get(&update).BotMsg.CommRewardAddedNoti, added))
@@ -78,6 +106,9 @@ func Handle(update tgbotapi.Update) {
 	//command
 	if update.Message != nil && update.Message.IsCommand() {
 		logger.Info.Println(update.Message.Command())
+		if !checkPermission(&update, update.Message.Command()) {
+			return
+		}
 		switch update.Message.Command() {
 		case "start":
 			handler.StartCommand(update)
@@ -85,14 +116,26 @@ func Handle(update tgbotapi.Update) {
 			handler.HelpCommand(update)
 		case "getlimit":
 			handler.GetLimitCommand(update)
-		case "admin": //admin
+		case "settings":
+			handler.SettingsCommand(update)
+		case "admin":
 			handler.AdminCommand(update)
-		case "reload": //admin
+		case "reload":
 			handler.ReloadConfigCommand(update)
-		case "clearcache": //admin
+		case "clearcache":
 			handler.ClearCacheCommand(update)
 		case "statistics":
 			handler.StatisticsCommand(update)
+		case "topsets":
+			handler.TopSetsCommand(update)
+		case "setplan":
+			handler.SetPlanCommand(update)
+		case "ban":
+			handler.BanCommand(update)
+		case "unban":
+			handler.UnbanCommand(update)
+		case "banlist":
+			handler.BanListCommand(update)
 		default:
 			return
 		}
@@ -108,12 +151,8 @@ func Handle(update tgbotapi.Update) {
 
 	//Sticker message
 	if update.Message != nil && update.Message.Sticker != nil {
-		if db.CheckLimit(&update) == true {
-			utils.SendPlainText(&update, fmt.Sprintf(languages.Get(&update).BotMsg.ErrReachLimit, config.Get().General.UserDailyLimit))
-			return
-		}
 		//访问频率控制
-		if limitLast := db.CheckUserRateLimit(utils.GetUID(&update), rateLimitShort); limitLast != -1 {
+		if limitLast := db.CheckUserRateLimit(utils.GetUID(&update), utils.GetUID(&update), rateCostConvert); limitLast != -1 {
 			utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrRateReachLimit)
 			return
 		}
@@ -123,12 +162,8 @@ func Handle(update tgbotapi.Update) {
 
 	//Animation message
 	if update.Message != nil && update.Message.Animation != nil {
-		if db.CheckLimit(&update) == true {
-			utils.SendPlainText(&update, fmt.Sprintf(languages.Get(&update).BotMsg.ErrReachLimit, config.Get().General.UserDailyLimit))
-			return
-		}
 		//访问频率控制
-		if limitLast := db.CheckUserRateLimit(utils.GetUID(&update), rateLimitShort); limitLast != -1 {
+		if limitLast := db.CheckUserRateLimit(utils.GetUID(&update), utils.GetUID(&update), rateCostConvert); limitLast != -1 {
 			utils.SendPlainText(&update, languages.Get(&update).BotMsg.ErrRateReachLimit)
 			return
 		}
@@ -136,17 +171,26 @@ func Handle(update tgbotapi.Update) {
 		statistics.Statistics.Record("MsgAnimationNum", 1)
 	}
 
+	//inline mode
+	// e.g. @bot xxx
+	if update.InlineQuery != nil {
+		//每次输入都会触发，超出频率时返回空结果，不计入自动封禁
+		if wait, _ := throttle.Take(context.Background(), rateCostConvert, throttle.User(utils.GetUID(&update))); wait != 0 {
+			handler.InlineQueryThrottled(update)
+			return
+		}
+		handler.InlineQuery(update)
+		statistics.Statistics.Record("MsgInlineQuery", 1)
+		return
+	}
+
 	//inline query
 	if update.CallbackQuery != nil {
 		data := update.CallbackQuery.Data
 		switch {
 		case data == handler.DownloadStickerSetCallbackQuery:
-			if db.CheckLimit(&update) == true {
-				utils.CallBackWithAlert(update.CallbackQuery.ID, fmt.Sprintf(languages.Get(&update).BotMsg.ErrReachLimit, config.Get().General.UserDailyLimit))
-				return
-			}
 			//访问频率控制
-			if limitLast := db.CheckUserRateLimit(utils.GetUID(&update), rateLimitLong); limitLast != -1 {
+			if limitLast := db.CheckUserRateLimit(utils.GetUID(&update), utils.GetUID(&update), rateCostStickerSet); limitLast != -1 {
 				utils.CallBackWithAlert(update.CallbackQuery.ID, languages.Get(&update).BotMsg.ErrRateReachLimit)
 				return
 			}
@@ -154,6 +198,8 @@ func Handle(update tgbotapi.Update) {
 			statistics.Statistics.Record("MsgStickerSet", 1)
 		case strings.HasPrefix(data, handler.QuitQueueCallbackQueryPrefix) == true:
 			handler.QuitQueueQuery(update)
+		case strings.HasPrefix(data, handler.SettingsCallbackQueryPrefix) == true:
+			handler.SettingsQuery(update)
 		}
 	}
 	return
@@ -0,0 +1,38 @@
+package router
+
+import (
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/languages"
+	"github.com/rroy233/StickerDownloader/utils"
+	"gopkg.in/rroy233/logger.v2"
+)
+
+// 管理员命令所需的最低角色
+var adminCommands = map[string]config.AdminRole{
+	"admin":      config.RoleViewer,
+	"statistics": config.RoleViewer,
+	"topsets":    config.RoleViewer,
+	"clearcache": config.RoleOperator,
+	"setplan":    config.RoleOperator,
+	"reload":     config.RoleOwner,
+	"ban":        config.RoleOwner,
+	"unban":      config.RoleOwner,
+	"banlist":    config.RoleOwner,
+}
+
+// checkPermission 校验命令所需的管理员角色，无权限时回复提示
+//
+// 非管理员命令直接返回true
+func checkPermission(update *tgbotapi.Update, command string) bool {
+	role, ok := adminCommands[command]
+	if !ok {
+		return true
+	}
+	if update.Message.From != nil && config.HasAdminRole(update.Message.From.ID, role) {
+		return true
+	}
+	logger.Info.Printf("%s[checkPermission]/%s requires %s", utils.LogUserInfo(update), command, role)
+	utils.SendPlainText(update, languages.Get(update).BotMsg.ErrNoPermission)
+	return false
+}
@@ -33,6 +33,8 @@ type statistics struct {
 	MsgStickerSet int32 `json:"msg_sticker_set"`
 	//已处理的链接下载请求
 	MsgStickerUrl int32 `json:"msg_sticker_url"`
+	//已处理的inline query
+	MsgInlineQuery int32 `json:"msg_inline_query"`
 
 	//存储
 	//存储变化(B)
@@ -137,6 +139,8 @@ func (s *statistics) Record(field string, delta int32) {
 		dest32 = &s.MsgStickerSet
 	case "MsgStickerUrl":
 		dest32 = &s.MsgStickerUrl
+	case "MsgInlineQuery":
+		dest32 = &s.MsgInlineQuery
 	case "CacheHit":
 		dest32 = &s.CacheHit
 	case "CacheMiss":
@@ -165,6 +169,30 @@ func (s *statistics) Record(field string, delta int32) {
 	}
 }
 
+// Counters 返回各项计数的当前值，key与Record的field相同
+//
+// 另含UserTotalNum，为本周期内的用户数
+func (s *statistics) Counters() map[string]int64 {
+	s._userTotalNumLock.Lock()
+	userTotalNum := len(s.UserTotalNum)
+	s._userTotalNumLock.Unlock()
+
+	return map[string]int64{
+		"UserTotalNum":        int64(userTotalNum),
+		"MsgHandleTotalTimes": int64(atomic.LoadInt32(&s.MsgHandleTotalTimes)),
+		"MsgStickerNum":       int64(atomic.LoadInt32(&s.MsgStickerNum)),
+		"MsgAnimationNum":     int64(atomic.LoadInt32(&s.MsgAnimationNum)),
+		"MsgStickerSet":       int64(atomic.LoadInt32(&s.MsgStickerSet)),
+		"MsgStickerUrl":       int64(atomic.LoadInt32(&s.MsgStickerUrl)),
+		"MsgInlineQuery":      int64(atomic.LoadInt32(&s.MsgInlineQuery)),
+		"CacheHit":            int64(atomic.LoadInt32(&s.CacheHit)),
+		"CacheMiss":           int64(atomic.LoadInt32(&s.CacheMiss)),
+		"NetworkUpload":       atomic.LoadInt64(&s.NetworkUpload),
+		"NetworkDownload":     atomic.LoadInt64(&s.NetworkDownload),
+		"StorageChange":       atomic.LoadInt64(&s.StorageChange),
+	}
+}
+
 func (s *statistics) RecordCommand(commandName string) {
 	s._commandLock.Lock()
 	defer s._commandLock.Unlock()
@@ -224,7 +252,7 @@ func (s *statistics) Printf() string {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	text := "Weekly Active Users [%d]\nHandled Requests [%d]\nHandled Messages:\n\tSticker [%d]\n\tAnimation [%d]\n\tSticker Url [%d]\n\tSticker Set [%d]\nStorage Changed [%d MB]\nCache:\n\tHit [%d]\n\tMiss [%d]\nNetwork:\n\tUploaded [%d MB]\n\tDownloaded [%d MB]\n"
+	text := "Weekly Active Users [%d]\nHandled Requests [%d]\nHandled Messages:\n\tSticker [%d]\n\tAnimation [%d]\n\tSticker Url [%d]\n\tSticker Set [%d]\n\tInline Query [%d]\nStorage Changed [%d MB]\nCache:\n\tHit [%d]\n\tMiss [%d]\nNetwork:\n\tUploaded [%d MB]\n\tDownloaded [%d MB]\n"
 
 	return fmt.Sprintf(text,
 		len(s.UserTotalNum),
@@ -233,6 +261,7 @@ func (s *statistics) Printf() string {
 		s.MsgAnimationNum,
 		s.MsgStickerUrl,
 		s.MsgStickerSet,
+		s.MsgInlineQuery,
 		s.StorageChange>>20,
 		s.CacheHit,
 		s.CacheMiss,
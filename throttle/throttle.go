@@ -0,0 +1,156 @@
+// Package throttle 基于Redis的令牌桶限流，多个实例共享同一组令牌桶
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/rroy233/StickerDownloader/config"
+	"gopkg.in/rroy233/logger.v2"
+	"math"
+	"time"
+)
+
+// ServicePrefix 与db中的前缀一致
+const ServicePrefix = "StickerDl"
+
+// Telegram对发送消息的限制
+//
+// 详见:https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+const (
+	//同一会话每秒1条
+	sendChatRate = 1.0
+	//同一群组每分钟20条
+	sendGroupRate = 20.0 / 60
+	//所有会话合计每秒30条
+	sendGlobalRate = 30.0
+)
+
+var rdb *redis.Client
+
+// Bucket 令牌桶
+//
+// 每秒补充Rate个令牌，最多积累Burst个
+type Bucket struct {
+	Key   string
+	Rate  float64
+	Burst float64
+}
+
+// KEYS 各令牌桶
+//
+// ARGV[1] 取出的令牌数 ARGV[2i] KEYS[i]每毫秒补充的令牌数 ARGV[2i+1] KEYS[i]的容量
+//
+// 所有令牌桶均足够时同时取出并返回{0, 0}，
+// 否则不取出，返回{需要等待的毫秒数, 令牌不足的桶的下标}
+//
+// 以Redis服务器时间为准，避免多个实例间的时钟偏差；Redis 5以下需先开启命令复制，才能在TIME之后执行写操作
+var takeScript = redis.NewScript(`
+redis.replicate_commands()
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+local n = tonumber(ARGV[1])
+local tokens = {}
+local times = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+	local data = redis.call('HMGET', key, 'tokens', 'ts')
+	local t = tonumber(data[1]) or burst
+	local ts = tonumber(data[2]) or now
+	if now > ts then
+		t = math.min(burst, t + (now - ts) * rate)
+	end
+	if t < n then
+		return {math.ceil((n - t) / rate), i}
+	end
+	tokens[i] = t
+	times[i] = math.max(now, ts)
+end
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[2 * i])
+	local burst = tonumber(ARGV[2 * i + 1])
+	redis.call('HSET', key, 'tokens', tostring(tokens[i] - n), 'ts', tostring(times[i]))
+	redis.call('PEXPIRE', key, math.ceil(burst / rate) + 1000)
+end
+return {0, 0}
+`)
+
+// Init 初始化，未初始化时不做限制
+func Init(client *redis.Client) {
+	rdb = client
+}
+
+// Take 尝试从所有令牌桶中各取出n个令牌
+//
+// 成功返回0；否则不取出任何令牌，返回需要等待的时间及令牌不足的桶
+//
+// Redis故障时放行，避免拒绝所有请求
+func Take(ctx context.Context, n int, buckets ...Bucket) (time.Duration, *Bucket) {
+	if rdb == nil || len(buckets) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, 0, len(buckets))
+	args := make([]interface{}, 0, 2*len(buckets)+1)
+	args = append(args, n)
+	for _, b := range buckets {
+		keys = append(keys, fmt.Sprintf("%s:Throttle:%s", ServicePrefix, b.Key))
+		args = append(args, b.Rate/1000, math.Max(b.Burst, float64(n)))
+	}
+	ret, err := takeScript.Run(ctx, rdb, keys, args...).Int64Slice()
+	if err != nil || len(ret) != 2 {
+		logger.Error.Println("[throttle]failed to take tokens:", err)
+		return 0, nil
+	}
+	if ret[0] <= 0 {
+		return 0, nil
+	}
+	return time.Duration(ret[0]) * time.Millisecond, &buckets[ret[1]-1]
+}
+
+// Wait 阻塞直到从所有令牌桶中各取出1个令牌，或ctx结束
+func Wait(ctx context.Context, buckets ...Bucket) error {
+	for {
+		wait, _ := Take(ctx, 1, buckets...)
+		if wait == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// User 单个用户的请求
+func User(UID int64) Bucket {
+	cf := config.Get().RateLimit
+	return Bucket{Key: fmt.Sprintf("User:%d", UID), Rate: cf.UserRate, Burst: float64(cf.UserBurst)}
+}
+
+// Chat 单个群组内所有用户的请求
+func Chat(chatID int64) Bucket {
+	cf := config.Get().RateLimit
+	return Bucket{Key: fmt.Sprintf("Chat:%d", chatID), Rate: cf.ChatRate, Burst: float64(cf.ChatBurst)}
+}
+
+// Updates 所有实例处理update的速率
+func Updates() Bucket {
+	cf := config.Get().RateLimit
+	return Bucket{Key: "Updates", Rate: cf.GlobalRate, Burst: float64(cf.GlobalBurst)}
+}
+
+// SendGlobal 所有实例调用Bot API的速率
+func SendGlobal() Bucket {
+	return Bucket{Key: "Send", Rate: sendGlobalRate, Burst: sendGlobalRate}
+}
+
+// SendChat 向单个会话发送消息的速率，群组还需满足每分钟的限制
+func SendChat(chatID int64) []Bucket {
+	buckets := []Bucket{{Key: fmt.Sprintf("Send:%d", chatID), Rate: sendChatRate, Burst: 1}}
+	if chatID < 0 {
+		buckets = append(buckets, Bucket{Key: fmt.Sprintf("Send:%d:Minute", chatID), Rate: sendGroupRate, Burst: 1})
+	}
+	return buckets
+}
@@ -5,12 +5,11 @@ import (
 	"errors"
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
 	"github.com/rroy233/StickerDownloader/statistics"
 	"gopkg.in/rroy233/logger.v2"
-	"io/ioutil"
 	"log"
 	"math/rand"
-	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -36,13 +35,13 @@ func SendPlainText(update *tgbotapi.Update, text string, entity ...tgbotapi.Mess
 		if entity != nil {
 			msg.Entities = entity
 		}
-		addToSendQueue(msg)
+		addToSendQueue(msg, priorityHigh)
 	} else if update.CallbackQuery != nil || update.CallbackQuery.Message != nil {
 		msg = tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, text)
 		if entity != nil {
 			msg.Entities = entity
 		}
-		addToSendQueue(msg)
+		addToSendQueue(msg, priorityHigh)
 	}
 }
 
@@ -72,17 +71,21 @@ func SendFileByPath(update *tgbotapi.Update, filePath string) (tgbotapi.Message,
 		return tgbotapi.Message{}, errors.New("message nil")
 	}
 
-	var msg tgbotapi.MediaGroupConfig
-	file := tgbotapi.FilePath(filePath)
-	doc := tgbotapi.NewInputMediaDocument(file)
-
 	if update.Message != nil {
-		msg = tgbotapi.NewMediaGroup(update.Message.Chat.ID, []tgbotapi.InputMedia{&doc})
-	} else if update.CallbackQuery != nil || update.CallbackQuery.Message != nil {
-		msg = tgbotapi.NewMediaGroup(update.CallbackQuery.Message.Chat.ID, []tgbotapi.InputMedia{&doc})
+		return SendFileToChat(update.Message.Chat.ID, filePath)
 	}
+	return SendFileToChat(update.CallbackQuery.Message.Chat.ID, filePath)
+}
 
-	Limiter.Take()
+// SendFileToChat 以文件形式发送到指定会话
+//
+// 传入文件本地存储地址
+func SendFileToChat(chatID int64, filePath string) (tgbotapi.Message, error) {
+	file := tgbotapi.FilePath(filePath)
+	doc := tgbotapi.NewInputMediaDocument(file)
+	msg := tgbotapi.NewMediaGroup(chatID, []tgbotapi.InputMedia{&doc})
+
+	waitSend(msg)
 
 	//bot.SendMediaGroup(msg)
 	//github.com/OvyFlash/telegram-bot-api这个库有bug
@@ -92,6 +95,7 @@ func SendFileByPath(update *tgbotapi.Update, filePath string) (tgbotapi.Message,
 	resp, err := bot.Request(msg)
 	if err != nil {
 		logger.Error.Println("bot.Request error：", err, JsonEncode(resp))
+		recordRetryAfter(msg, err)
 		return tgbotapi.Message{}, errors.New("network error-1")
 	}
 	var messages []tgbotapi.Message
@@ -128,11 +132,12 @@ func SendFileByFileID(update *tgbotapi.Update, fileID string) error {
 		msg = tgbotapi.NewMediaGroup(update.CallbackQuery.Message.Chat.ID, []tgbotapi.InputMedia{&doc})
 	}
 
-	Limiter.Take()
+	waitSend(msg)
 	_, err := bot.SendMediaGroup(msg)
 	if err != nil {
 		logger.Error.Println("failed to send file：", err)
-		if strings.Contains(err.Error(), "api.telegram.org") == false {
+		recordRetryAfter(msg, err)
+		if strings.Contains(err.Error(), config.Get().BotAPI.Endpoint) == false {
 			return err
 		}
 		return errors.New("network error")
@@ -148,6 +153,9 @@ func LogUserInfo(update *tgbotapi.Update) string {
 	if update.CallbackQuery != nil {
 		return fmt.Sprintf("[%s(@%s) %d]", update.CallbackQuery.Message.Chat.FirstName+update.CallbackQuery.Message.Chat.LastName, update.CallbackQuery.Message.Chat.UserName, update.CallbackQuery.Message.Chat.ID)
 	}
+	if update.InlineQuery != nil {
+		return fmt.Sprintf("[%s(@%s) %d]", update.InlineQuery.From.FirstName+update.InlineQuery.From.LastName, update.InlineQuery.From.UserName, update.InlineQuery.From.ID)
+	}
 	return ""
 }
 
@@ -159,10 +167,10 @@ func SendSticker(update *tgbotapi.Update, fileID string) {
 	if update.Message != nil {
 		msg = tgbotapi.NewSticker(update.Message.Chat.ID, tgbotapi.FileID(fileID))
 		msg.ReplyParameters.MessageID = update.Message.MessageID
-		addToSendQueue(msg)
+		addToSendQueue(msg, priorityHigh)
 	} else if update.CallbackQuery != nil || update.CallbackQuery.Message != nil {
 		msg = tgbotapi.NewSticker(update.CallbackQuery.Message.Chat.ID, tgbotapi.FileID(fileID))
-		addToSendQueue(msg)
+		addToSendQueue(msg, priorityHigh)
 	}
 }
 
@@ -178,18 +186,27 @@ func SendPlainTextWithKeyboard(update *tgbotapi.Update, text string, keyboard *t
 		if entity != nil {
 			msg.Entities = entity
 		}
-		addToSendQueue(msg)
+		addToSendQueue(msg, priorityHigh)
 	} else if update.CallbackQuery != nil || update.CallbackQuery.Message != nil {
 		msg = tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, text)
 		msg.ReplyMarkup = *keyboard
 		if entity != nil {
 			msg.Entities = entity
 		}
-		addToSendQueue(msg)
+		addToSendQueue(msg, priorityHigh)
 	}
 }
+
+// MaxUploadSize 单个文件的上传上限，使用本地Bot API服务时为2000MB
+func MaxUploadSize() int64 {
+	if config.Get().BotAPI.Local {
+		return 2000 * MB
+	}
+	return 50 * MB
+}
+
 func BotGetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
-	Limiter.Take()
+	waitAPI()
 	return bot.GetFile(config)
 }
 
@@ -198,55 +215,12 @@ func BotGetSelf() tgbotapi.User {
 }
 
 func BotGetStickerSet(config tgbotapi.GetStickerSetConfig) (tgbotapi.StickerSet, error) {
-	Limiter.Take()
+	waitAPI()
 	return bot.GetStickerSet(config)
 }
 
-func DownloadFile(fileUrl string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, fileUrl, nil)
-	if err != nil {
-		return "", err
-	}
-
-	client := &http.Client{
-		Timeout: 60 * time.Second,
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	//get file name
-	oFileName := "file"
-	urls := strings.Split(fileUrl, "/")
-	if len(urls) == 0 {
-		return "", errors.New("url无效")
-	}
-	if strings.Contains(urls[len(urls)-1], ".") != false {
-		oFileName = urls[len(urls)-1]
-	}
-
-	fileName := fmt.Sprintf("./storage/tmp/upload_%s_%s", RandString(), oFileName)
-	err = ioutil.WriteFile(fileName, data, 0666)
-	if err != nil {
-		return "", err
-	}
-
-	//记录statistic
-	statistics.Statistics.Record("NetworkDownload", int32(len(data)))
-
-	return fileName, nil
-}
-
 func SendAction(chaiID int64, action ChatAction) {
-	msgQueue <- tgbotapi.NewChatAction(chaiID, string(action))
+	addToSendQueue(tgbotapi.NewChatAction(chaiID, string(action)), priorityLow)
 }
 
 func EditMsgText(chatID int64, msgID int, msg string, entity ...tgbotapi.MessageEntity) {
@@ -254,18 +228,32 @@ func EditMsgText(chatID int64, msgID int, msg string, entity ...tgbotapi.Message
 	if len(entity) != 0 {
 		newMsg.Entities = entity
 	}
-	addToSendQueue(newMsg)
+	addToSendQueue(newMsg, priorityHigh)
 	return
 }
 
 func EditMsgTextAndMarkup(chatID int64, msgID int, msg string, markup tgbotapi.InlineKeyboardMarkup) {
 	newMsg := tgbotapi.NewEditMessageTextAndMarkup(chatID, msgID, msg, markup)
-	addToSendQueue(newMsg)
+	addToSendQueue(newMsg, priorityHigh)
+	return
+}
+
+// EditMsgProgress 更新进度
+//
+// 优先级低于新消息及EditMsgText，尚未发送的进度更新会被同一条消息后续的编辑替换
+func EditMsgProgress(chatID int64, msgID int, msg string) {
+	addToSendQueue(tgbotapi.NewEditMessageText(chatID, msgID, msg), priorityNormal)
+	return
+}
+
+// EditMsgProgressAndMarkup 更新进度及按钮，同EditMsgProgress
+func EditMsgProgressAndMarkup(chatID int64, msgID int, msg string, markup tgbotapi.InlineKeyboardMarkup) {
+	addToSendQueue(tgbotapi.NewEditMessageTextAndMarkup(chatID, msgID, msg, markup), priorityNormal)
 	return
 }
 
 func DeleteMsg(chatID int64, MsgID int) {
-	addToSendQueue(tgbotapi.NewDeleteMessage(chatID, MsgID))
+	addToSendQueue(tgbotapi.NewDeleteMessage(chatID, MsgID), priorityHigh)
 	return
 }
 
@@ -276,13 +264,33 @@ func GetUID(update *tgbotapi.Update) int64 {
 	if update.CallbackQuery != nil {
 		return update.CallbackQuery.Message.Chat.ID
 	}
+	if update.InlineQuery != nil {
+		return update.InlineQuery.From.ID
+	}
+	return -1
+}
+
+// GetSenderID 获取发送者的UID，群组中与GetUID不同
+func GetSenderID(update *tgbotapi.Update) int64 {
+	if update.Message != nil && update.Message.From != nil {
+		return update.Message.From.ID
+	}
+	if update.CallbackQuery != nil {
+		return update.CallbackQuery.From.ID
+	}
+	if update.InlineQuery != nil {
+		return update.InlineQuery.From.ID
+	}
+	if update.MyChatMember != nil {
+		return update.MyChatMember.From.ID
+	}
 	return -1
 }
 
 func CallBack(callbackQueryID string, text string) {
 	callback := tgbotapi.NewCallback(callbackQueryID, text)
 	//不能用bot.Send(callback)方法，有bug
-	Limiter.Take()
+	waitSend(callback)
 	resp, err := bot.Request(callback)
 	if err != nil {
 		logger.Error.Println("[CallBack]bot.Request失败:", err)
@@ -297,7 +305,7 @@ func CallBack(callbackQueryID string, text string) {
 func CallBackWithAlert(callbackQueryID string, text string) {
 	callback := tgbotapi.NewCallbackWithAlert(callbackQueryID, text)
 	//不能用bot.Send(callback)方法，有bug
-	Limiter.Take()
+	waitSend(callback)
 	resp, err := bot.Request(callback)
 	if err != nil {
 		logger.Error.Println("[CallBackWithAlert]bot.Request失败:", err)
@@ -328,6 +336,15 @@ func GetLogPrefixCallbackQuery(update *tgbotapi.Update) string {
 	)
 }
 
+func GetLogPrefixInlineQuery(update *tgbotapi.Update) string {
+	return fmt.Sprintf("[InlineQuery][User:%d @%s %s][ChatType:%s]",
+		update.InlineQuery.From.ID,
+		update.InlineQuery.From.UserName,
+		update.InlineQuery.From.FirstName+update.InlineQuery.From.LastName,
+		update.InlineQuery.ChatType,
+	)
+}
+
 // 顺序查找UTF-6编码字符串中子串的第一次出现的位置
 // 返回offset=-1则为找到
 func getPartIndex(text, part string) (offset, length int) {
@@ -395,3 +412,34 @@ func CheckUserSubscription(update *tgbotapi.Update, channelUsername string) bool
 	status := member.Status
 	return status == "member" || status == "administrator" || status == "creator"
 }
+
+// IsGroupChat 判断update是否来自群组
+func IsGroupChat(update *tgbotapi.Update) bool {
+	var chat *tgbotapi.Chat
+	if update.Message != nil {
+		chat = &update.Message.Chat
+	} else if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		chat = &update.CallbackQuery.Message.Chat
+	} else if update.MyChatMember != nil {
+		chat = &update.MyChatMember.Chat
+	}
+	return chat != nil && (chat.Type == "group" || chat.Type == "supergroup")
+}
+
+// IsChatAdmin 检查用户是否为群组管理员
+func IsChatAdmin(chatID int64, userID int64) bool {
+	waitAPI()
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{
+			ChatConfig: tgbotapi.ChatConfig{
+				ChatID: chatID,
+			},
+			UserID: userID,
+		},
+	})
+	if err != nil {
+		logger.Error.Println("GetChatMember error:", err)
+		return false
+	}
+	return member.Status == "administrator" || member.Status == "creator"
+}
@@ -7,12 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/lottie"
 	"gopkg.in/rroy233/logger.v2"
 	"image"
 	"image/png"
+	"math"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 )
 
 type ConvertTask struct {
@@ -20,53 +23,58 @@ type ConvertTask struct {
 	InputExtension   string
 	OutputFilePath   string
 	PreserveJsonPath string
+	ConvertOptions
 }
 
 const paletteFilter = "split[s0][s1];[s0]fps=5,palettegen=reserve_transparent=1[p];[s1][p]paletteuse=dither=none"
 
 func (task *ConvertTask) Run(ctx context.Context) error {
-	var cmd *exec.Cmd
-	if task.InputExtension == "tgs" {
-		if !config.Get().General.SupportTGSFile {
-			return errors.New("SupportTGSFile is disabled")
-		}
-		if err := task.tgsDecode(); err != nil {
-			return err
-		}
-		if err := os.Rename(task.InputFilePath, task.InputFilePath+".json"); err != nil {
+	if task.OutputFormat == "" {
+		task.OutputFormat = OutputFormatGIF
+	}
+	task.ConvertOptions = task.ConvertOptions.ForInput(task.InputExtension)
+
+	if task.InputExtension == "tgs" && !config.Get().General.SupportTGSFile {
+		return errors.New("SupportTGSFile is disabled")
+	}
+
+	//保留原始webm
+	if task.OutputFormat == OutputFormatWebM && task.InputExtension == "webm" && task.MaxFPS == 0 && task.TargetSize == 0 {
+		return CopyFile(task.InputFilePath, task.OutputFilePath)
+	}
+
+	//png序列先输出到文件夹，再压缩
+	outputPath := task.OutputFilePath
+	if task.OutputFormat == OutputFormatPNGSequence {
+		outputPath = task.OutputFilePath + "_frames"
+		if err := os.Mkdir(outputPath, 0755); err != nil {
 			return err
 		}
-		task.InputFilePath += ".json"
+		defer os.RemoveAll(outputPath)
+		outputPath += "/%04d.png"
+	}
 
-		if task.PreserveJsonPath != "" {
-			if err := CopyFile(task.InputFilePath, task.PreserveJsonPath); err != nil {
-				logger.Warn.Printf("failed to preserve JSON to %s: %v", task.PreserveJsonPath, err)
-			}
+	if task.InputExtension == "tgs" {
+		if err := task.renderTGS(ctx, outputPath); err != nil {
+			return err
 		}
-
-		cmd = exec.CommandContext(ctx, rlottieExcutablePath, task.InputFilePath, "512x512")
-		defer os.Remove(task.InputFilePath)
 	} else {
 		args := []string{"-y"}
-		vfilter := "fps=fps='min(source_fps,40)'"
 		if task.InputExtension == "webm" {
 			args = append(args, "-vcodec", "libvpx-vp9")
-			if task.detectWebmAlpha(ctx) {
-				vfilter += "," + paletteFilter
-			}
 		}
-		args = append(args, "-i", task.InputFilePath, "-vf", vfilter, task.OutputFilePath)
-		cmd = exec.CommandContext(ctx, ffmpegExecutablePath, args...)
-	}
-
-	if err := cmd.Run(); err != nil {
-		return err
+		args = append(args, "-i", task.InputFilePath)
+		args = append(args, task.encodeArgs(ctx)...)
+		args = append(args, outputPath)
+		if err := exec.CommandContext(ctx, ffmpegExecutablePath, args...).Run(); err != nil {
+			return err
+		}
 	}
 
-	if task.InputExtension == "tgs" {
-		return os.Rename(task.InputFilePath+".gif", task.OutputFilePath)
+	if task.OutputFormat == OutputFormatPNGSequence {
+		return Compress(task.OutputFilePath+"_frames", task.OutputFilePath)
 	}
-	if task.InputExtension == "webp" {
+	if task.OutputFormat == OutputFormatPNG {
 		if err := trimTransparentEdges(task.OutputFilePath); err != nil {
 			logger.Warn.Printf("failed to trim transparent edges: %v", err)
 		}
@@ -74,11 +82,36 @@ func (task *ConvertTask) Run(ctx context.Context) error {
 	return nil
 }
 
-func getRlottieFilename() string {
-	if runtime.GOOS == "windows" {
-		return "lottie2gif.exe"
+// 生成ffmpeg编码参数
+func (task *ConvertTask) encodeArgs(ctx context.Context) []string {
+	maxFPS := defaultMaxFPS
+	if task.MaxFPS > 0 {
+		maxFPS = task.MaxFPS
 	}
-	return "lottie2gif"
+	vfilter := fmt.Sprintf("fps=fps='min(source_fps,%d)'", maxFPS)
+	if task.TargetSize > 0 {
+		vfilter += fmt.Sprintf(",scale=w=%d:h=%d:force_original_aspect_ratio=decrease", task.TargetSize, task.TargetSize)
+	}
+	switch task.OutputFormat {
+	case OutputFormatGIF:
+		if task.InputExtension == "tgs" || (task.InputExtension == "webm" && task.detectWebmAlpha(ctx)) {
+			vfilter += "," + paletteFilter
+		}
+		return []string{"-vf", vfilter}
+	case OutputFormatWebP:
+		return []string{"-vf", vfilter, "-c:v", "libwebp_anim", "-lossless", "0", "-q:v", "80", "-loop", "0", "-pix_fmt", "yuva420p"}
+	case OutputFormatAPNG:
+		return []string{"-vf", vfilter, "-c:v", "apng", "-plays", "0", "-pix_fmt", "rgba", "-f", "apng"}
+	case OutputFormatMP4:
+		//H.264要求宽高为偶数
+		vfilter += ",scale=trunc(iw/2)*2:trunc(ih/2)*2"
+		return []string{"-vf", vfilter, "-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart", "-an"}
+	case OutputFormatWebM:
+		return []string{"-vf", vfilter, "-c:v", "libvpx-vp9", "-pix_fmt", "yuva420p", "-b:v", "0", "-crf", "32", "-an"}
+	case OutputFormatPNGSequence:
+		return []string{"-vf", vfilter, "-start_number", "0"}
+	}
+	return []string{"-vf", vfilter}
 }
 
 func getFfmpegFilename(simplify bool) string {
@@ -92,48 +125,120 @@ func getFfmpegFilename(simplify bool) string {
 	return name
 }
 
-func (task *ConvertTask) tgsDecode() error {
-	file, err := os.OpenFile(task.InputFilePath, os.O_RDWR, 0755)
+// renderTGS 使用内置的Lottie渲染器逐帧渲染，通过管道交给ffmpeg编码
+func (task *ConvertTask) renderTGS(ctx context.Context, outputPath string) error {
+	data, err := decodeTGS(task.InputFilePath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if task.PreserveJsonPath != "" {
+		if err := os.WriteFile(task.PreserveJsonPath, data, 0644); err != nil {
+			logger.Warn.Printf("failed to preserve JSON to %s: %v", task.PreserveJsonPath, err)
+		}
+	}
 
-	r, err := gzip.NewReader(file)
+	anim, err := lottie.Parse(data)
 	if err != nil {
 		return err
 	}
 
-	var buff bytes.Buffer
-	if _, err = buff.ReadFrom(r); err != nil {
+	//按最长边缩放，保持宽高比
+	size := 512
+	if task.TargetSize > 0 {
+		size = task.TargetSize
+	}
+	scale := float64(size) / float64(max(anim.Width, anim.Height))
+	width := max(1, int(math.Round(float64(anim.Width)*scale)))
+	height := max(1, int(math.Round(float64(anim.Height)*scale)))
+
+	fps := float64(defaultMaxFPS)
+	if task.MaxFPS > 0 {
+		fps = float64(task.MaxFPS)
+	}
+	fps = math.Min(fps, anim.FrameRate)
+	frames := max(1, int(math.Ceil(anim.Duration()*fps)))
+
+	args := []string{"-y",
+		"-f", "rawvideo", "-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", width, height),
+		"-framerate", strconv.FormatFloat(fps, 'f', -1, 64),
+		"-i", "pipe:0",
+	}
+	args = append(args, task.encodeArgs(ctx)...)
+	args = append(args, outputPath)
+	cmd := exec.CommandContext(ctx, ffmpegExecutablePath, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	renderer := lottie.NewRenderer(anim, width, height)
+	buf := make([]byte, width*height*4)
+	var writeErr error
+	for i := 0; i < frames && writeErr == nil; i++ {
+		if writeErr = ctx.Err(); writeErr != nil {
+			break
+		}
+		img := renderer.Render(anim.InPoint + float64(i)*anim.FrameRate/fps)
+		unpremultiply(buf, img.Pix)
+		_, writeErr = stdin.Write(buf)
+	}
+	stdin.Close()
+
+	if err = cmd.Wait(); err != nil {
 		return err
 	}
+	return writeErr
+}
 
-	file.Truncate(0)
-	file.Seek(0, 0)
-	_, err = file.Write(buff.Bytes())
-	return err
+// unpremultiply 将预乘alpha的像素转换为ffmpeg rgba所需的直通alpha
+func unpremultiply(dst, src []byte) {
+	for i := 0; i < len(src); i += 4 {
+		a := uint32(src[i+3])
+		switch a {
+		case 0:
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = 0, 0, 0, 0
+		case 255:
+			copy(dst[i:i+4], src[i:i+4])
+		default:
+			dst[i] = uint8((uint32(src[i])*255 + a/2) / a)
+			dst[i+1] = uint8((uint32(src[i+1])*255 + a/2) / a)
+			dst[i+2] = uint8((uint32(src[i+2])*255 + a/2) / a)
+			dst[i+3] = uint8(a)
+		}
+	}
 }
 
-func TgsToJson(tgsFilePath, jsonOutputPath string) error {
+// decodeTGS 解压tgs文件，返回Lottie JSON
+func decodeTGS(tgsFilePath string) ([]byte, error) {
 	tgsFile, err := os.Open(tgsFilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tgsFile.Close()
 
 	r, err := gzip.NewReader(tgsFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer r.Close()
 
 	var buff bytes.Buffer
 	if _, err = buff.ReadFrom(r); err != nil {
-		return err
+		return nil, err
 	}
+	return buff.Bytes(), nil
+}
 
-	return os.WriteFile(jsonOutputPath, buff.Bytes(), 0644)
+func TgsToJson(tgsFilePath, jsonOutputPath string) error {
+	data, err := decodeTGS(tgsFilePath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(jsonOutputPath, data, 0644)
 }
 
 func (task *ConvertTask) detectWebmAlpha(ctx context.Context) bool {
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"github.com/rroy233/StickerDownloader/statistics"
+	"gopkg.in/rroy233/logger.v2"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// 首次重试前的等待时间，之后每次翻倍
+const downloadRetryBackoff = time.Second
+
+var ErrDownloadTooLarge = errors.New("file is too large")
+
+var downloadClient = &http.Client{}
+
+// DownloadFile 将Telegram上的文件流式写入临时目录，返回本地文件地址
+//
+// 文件名取自file_path；超过Download.MaxSize时返回ErrDownloadTooLarge，
+// 网络错误、5xx及429响应或大小与file_size不符时按退避重试，ctx取消时立即停止
+//
+// 使用以--local运行的本地Bot API服务时，file_path为服务器上的绝对路径，直接从本地文件系统复制
+func DownloadFile(ctx context.Context, file tgbotapi.File) (string, error) {
+	cf := config.Get().Download
+	maxSize := int64(cf.MaxSize) << 20
+	if file.FileSize > maxSize {
+		return "", ErrDownloadTooLarge
+	}
+	if file.FilePath == "" {
+		return "", errors.New("file_path is empty")
+	}
+
+	fileName := fmt.Sprintf("./storage/tmp/upload_%s_%s", RandString(), downloadFileName(file.FilePath))
+	if config.Get().BotAPI.Local && filepath.IsAbs(file.FilePath) {
+		if err := copyLocalFile(file.FilePath, fileName, maxSize); err != nil {
+			RemoveFile(fileName)
+			return "", err
+		}
+		return fileName, nil
+	}
+
+	fileUrl := fmt.Sprintf("%s/file/bot%s/%s", config.Get().BotAPI.Endpoint, config.Get().General.BotToken, file.FilePath)
+	backoff := downloadRetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := downloadOnce(ctx, fileUrl, fileName, maxSize, file.FileSize)
+		if err == nil {
+			return fileName, nil
+		}
+		RemoveFile(fileName)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if retry == false || attempt >= cf.Retries {
+			return "", err
+		}
+
+		logger.Warn.Printf("[DownloadFile]%s, retry in %s", err.Error(), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// 单次下载，返回的bool表示错误是否可以重试
+func downloadOnce(ctx context.Context, fileUrl string, fileName string, maxSize int64, fileSize int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Get().Download.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		//不记录含token的url
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return retry, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return false, ErrDownloadTooLarge
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxSize+1))
+	//记录statistic
+	statistics.Statistics.Record("NetworkDownload", int32(n))
+	if err != nil {
+		return true, err
+	}
+	if n > maxSize {
+		return false, ErrDownloadTooLarge
+	}
+
+	//校验大小，不一致时视为传输中断
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return true, fmt.Errorf("download incomplete: %d/%d bytes", n, resp.ContentLength)
+	}
+	if fileSize > 0 && n != fileSize {
+		return true, fmt.Errorf("size mismatch: got %d bytes, file_size %d", n, fileSize)
+	}
+	return false, f.Close()
+}
+
+// 从本地Bot API服务的工作目录复制文件
+func copyLocalFile(src string, dst string, maxSize int64) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxSize {
+		return ErrDownloadTooLarge
+	}
+	return CopyFile(src, dst)
+}
+
+// 由file_path得到文件名，如 stickers/file_1.webp 得到 file_1.webp
+func downloadFileName(filePath string) string {
+	name := path.Base(filePath)
+	if name == "." || name == "/" || name == "" {
+		return "file"
+	}
+	return name
+}
@@ -1,19 +1,51 @@
 package utils
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bufio"
+	"compress/gzip"
 	"crypto/md5"
 	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/klauspost/compress/zstd"
 	"gopkg.in/rroy233/logger.v2"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
 const MB = 1 << 20
 
+// ArchiveFormat 整套表情包的打包格式
+type ArchiveFormat string
+
+const (
+	ArchiveFormatZip     = ArchiveFormat("zip")
+	ArchiveFormatTarGz   = ArchiveFormat("tar.gz")
+	ArchiveFormatTarZstd = ArchiveFormat("tar.zst")
+)
+
+// ArchiveFormats 可供用户选择的打包格式
+var ArchiveFormats = []ArchiveFormat{
+	ArchiveFormatZip,
+	ArchiveFormatTarGz,
+	ArchiveFormatTarZstd,
+}
+
+// ParseArchiveFormat 解析打包格式
+//
+// 若不是可选格式则返回false
+func ParseArchiveFormat(s string) (ArchiveFormat, bool) {
+	for _, f := range ArchiveFormats {
+		if string(f) == s {
+			return f, true
+		}
+	}
+	return "", false
+}
+
 type UploadFile struct {
 	ZipPath    string
 	FolderPath string
@@ -69,7 +101,7 @@ func (f *UploadFile) UploadFragment(update *tgbotapi.Update) error {
 	//操作文件
 	sizeSum := int64(0)
 	for i, entry := range dir {
-		if sizeSum+sizes[i] > 49*MB {
+		if sizeSum+sizes[i] > MaxUploadSize()-MB {
 			sizeSum = 0
 			folderIndex++
 			err = os.Mkdir(fmt.Sprintf("%s_%d", f.FolderPath, folderIndex), 0755)
@@ -192,6 +224,80 @@ func Compress(src, dest string) error {
 	return nil
 }
 
+// Archive 按指定格式打包文件夹
+func Archive(format ArchiveFormat, src, dest string) error {
+	switch format {
+	case ArchiveFormatZip, "":
+		return Compress(src, dest)
+	case ArchiveFormatTarGz, ArchiveFormatTarZstd:
+		return compressTar(format, src, dest)
+	}
+	return fmt.Errorf("unsupported archive format: %s", format)
+}
+
+// 打包为tar并以gzip或zstd压缩，与zip相同，包内以文件夹名作为根目录
+func compressTar(format ArchiveFormat, src, dest string) (err error) {
+	d, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := d.Close(); err == nil {
+			err = cErr
+		}
+	}()
+
+	var cw io.WriteCloser
+	if format == ArchiveFormatTarZstd {
+		cw, err = zstd.NewWriter(d)
+		if err != nil {
+			return err
+		}
+	} else {
+		cw = gzip.NewWriter(d)
+	}
+	tw := tar.NewWriter(cw)
+
+	root := filepath.Base(src)
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(root, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
 func compress(file *os.File, prefix string, zw *zip.Writer) error {
 	info, err := file.Stat()
 	if err != nil {
@@ -249,6 +355,8 @@ func GetChatID(update *tgbotapi.Update) int64 {
 		return update.Message.Chat.ID
 	} else if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
 		return update.CallbackQuery.Message.Chat.ID
+	} else if update.MyChatMember != nil {
+		return update.MyChatMember.Chat.ID
 	}
 	return -1
 }
\ No newline at end of file
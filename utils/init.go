@@ -4,29 +4,39 @@ import (
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"github.com/rroy233/StickerDownloader/config"
 	"github.com/rroy233/StickerDownloader/languages"
-	"go.uber.org/ratelimit"
 	"gopkg.in/rroy233/logger.v2"
 	"os"
 	"strings"
-	"time"
 )
 
 var bot *tgbotapi.BotAPI
 var loggerPrefix = "[utils]"
-var Limiter ratelimit.Limiter
 
 var ffmpegExecutablePath string
-var rlottieExcutablePath string
 
 func Init(api *tgbotapi.BotAPI) {
-	//初始化rate Limiter
-	//TG官方对message发送频率有限制
-	//详见:https://core.telegram.org/bots/faq#broadcasting-to-users
-	Limiter = ratelimit.New(30, ratelimit.Per(1*time.Second))
-
 	bot = api
 	initSender(3)
 
+	initStorage()
+	checkOutputFormat()
+
+	//bot模式下转码由worker完成，无需ffmpeg
+	if config.Get().General.RunMode != config.RunModeBot {
+		findFFmpeg()
+	}
+
+	return
+}
+
+// InitConverter worker模式下的初始化，仅准备转码所需的环境
+func InitConverter() {
+	initStorage()
+	checkOutputFormat()
+	findFFmpeg()
+}
+
+func initStorage() {
 	var err error
 
 	//folder check
@@ -39,19 +49,9 @@ func Init(api *tgbotapi.BotAPI) {
 	if IsExist("./ffmpeg") == false {
 		err = os.Mkdir("./ffmpeg", 0755)
 	}
-	if config.Get().General.SupportTGSFile == true && IsExist("./lottie2gif") == false {
-		err = os.Mkdir("./lottie2gif", 0755)
-	}
 	if err != nil {
 		logger.FATAL.Println(err)
 	}
-
-	findFFmpeg()
-	if config.Get().General.SupportTGSFile == true {
-		findRlottie()
-	}
-
-	return
 }
 
 func findFFmpeg() {
@@ -81,11 +81,3 @@ func findFFmpeg() {
 	}
 	ffmpegExecutablePath = "./ffmpeg/" + getFfmpegFilename(true)
 }
-
-func findRlottie() {
-	//find from StickerDownloader running folder
-	if IsExist("./lottie2gif/"+getRlottieFilename()) == false {
-		logger.FATAL.Printf(languages.Get(nil).System.RlottieNotExist, "./lottie2gif/"+getRlottieFilename())
-	}
-	rlottieExcutablePath = "./lottie2gif/" + getRlottieFilename()
-}
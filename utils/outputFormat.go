@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"fmt"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"gopkg.in/rroy233/logger.v2"
+)
+
+// OutputFormat 转码输出格式
+type OutputFormat string
+
+const (
+	OutputFormatGIF         = OutputFormat("gif")
+	OutputFormatWebP        = OutputFormat("webp")
+	OutputFormatAPNG        = OutputFormat("apng")
+	OutputFormatMP4         = OutputFormat("mp4")
+	OutputFormatWebM        = OutputFormat("webm")
+	OutputFormatPNGSequence = OutputFormat("png_seq")
+
+	// OutputFormatPNG 仅用于静态贴纸，不可由用户选择
+	OutputFormatPNG = OutputFormat("png")
+)
+
+// OutputFormats 可供用户选择的动态贴纸输出格式
+var OutputFormats = []OutputFormat{
+	OutputFormatGIF,
+	OutputFormatWebP,
+	OutputFormatAPNG,
+	OutputFormatMP4,
+	OutputFormatWebM,
+	OutputFormatPNGSequence,
+}
+
+// ParseOutputFormat 解析输出格式
+//
+// 若不是可选格式则返回false
+func ParseOutputFormat(s string) (OutputFormat, bool) {
+	for _, f := range OutputFormats {
+		if string(f) == s {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// DefaultOutputFormat 返回配置中的默认输出格式
+func DefaultOutputFormat() OutputFormat {
+	f, ok := ParseOutputFormat(config.Get().General.OutputFormat)
+	if !ok {
+		return OutputFormatGIF
+	}
+	return f
+}
+
+// Ext 输出文件的扩展名
+func (f OutputFormat) Ext() string {
+	switch f {
+	case OutputFormatPNGSequence:
+		return "zip"
+	case "":
+		return string(OutputFormatGIF)
+	}
+	return string(f)
+}
+
+// ForSticker 根据贴纸类型确定实际输出格式
+//
+// 静态贴纸始终输出PNG
+func (f OutputFormat) ForSticker(sticker tgbotapi.Sticker) OutputFormat {
+	if !sticker.IsAnimated && !sticker.IsVideo {
+		return OutputFormatPNG
+	}
+	return f
+}
+
+// ForInput 根据输入文件扩展名确定实际输出格式
+//
+// 静态webp始终输出PNG
+func (f OutputFormat) ForInput(inputExt string) OutputFormat {
+	if inputExt == "webp" {
+		return OutputFormatPNG
+	}
+	return f
+}
+
+// ConvertOptions 转码选项
+type ConvertOptions struct {
+	OutputFormat OutputFormat `json:"format"`
+
+	//最大帧率，0为默认(40)
+	MaxFPS int `json:"max_fps"`
+
+	//输出的最长边(px)，0为保持原尺寸
+	TargetSize int `json:"target_size"`
+}
+
+const defaultMaxFPS = 40
+
+// ForSticker 根据贴纸类型确定实际转码选项
+func (o ConvertOptions) ForSticker(sticker tgbotapi.Sticker) ConvertOptions {
+	o.OutputFormat = o.OutputFormat.ForSticker(sticker)
+	if o.OutputFormat == OutputFormatPNG {
+		o.MaxFPS = 0
+	}
+	return o
+}
+
+// ForInput 根据输入文件扩展名确定实际转码选项
+func (o ConvertOptions) ForInput(inputExt string) ConvertOptions {
+	o.OutputFormat = o.OutputFormat.ForInput(inputExt)
+	if o.OutputFormat == OutputFormatPNG {
+		o.MaxFPS = 0
+	}
+	return o
+}
+
+// Variant 区分同一贴纸不同转码结果的标识
+//
+// 默认选项(GIF/PNG、默认帧率、原尺寸)返回空字符串
+func (o ConvertOptions) Variant() string {
+	variant := ""
+	if o.OutputFormat != "" && o.OutputFormat != OutputFormatGIF && o.OutputFormat != OutputFormatPNG {
+		variant += string(o.OutputFormat)
+	}
+	if o.MaxFPS > 0 {
+		variant += fmt.Sprintf("_fps%d", o.MaxFPS)
+	}
+	if o.TargetSize > 0 {
+		variant += fmt.Sprintf("_s%d", o.TargetSize)
+	}
+	return variant
+}
+
+func checkOutputFormat() {
+	if config.Get().General.OutputFormat == "" {
+		return
+	}
+	if _, ok := ParseOutputFormat(config.Get().General.OutputFormat); !ok {
+		logger.FATAL.Fatalf("General.OutputFormat [%s] is not supported, available: %v", config.Get().General.OutputFormat, OutputFormats)
+	}
+}
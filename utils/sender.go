@@ -1,55 +1,296 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	tgbotapi "github.com/OvyFlash/telegram-bot-api"
 	"gopkg.in/rroy233/logger.v2"
+	"slices"
+	"sync"
 	"time"
 )
 
-var msgQueue chan tgbotapi.Chattable
+// 发送队列的优先级，数值越小越先发送
+type sendPriority int
+
+const (
+	//新消息、删除消息及最终结果
+	priorityHigh sendPriority = iota
+	//进度更新
+	priorityNormal
+	//chat action，积压或会话被限流时直接丢弃
+	priorityLow
+)
+
+// 低优先级队列的最大长度
+const maxLowPriorityQueued = 20
+
+type sendItem struct {
+	msg      tgbotapi.Chattable
+	priority sendPriority
+	chatID   int64
+	//编辑消息时为"chatID:msgID"，用于合并对同一条消息的编辑
+	editKey string
+}
+
+type sendQueue struct {
+	sync.Mutex
+	lanes [priorityLow + 1][]*sendItem
+	//等待发送的编辑
+	edits map[string]*sendItem
+	//正在发送的编辑，同一条消息的编辑依次发送
+	sending map[string]bool
+	//触发429或令牌不足的会话，在此之前不再发送
+	cooldown map[int64]time.Time
+	notify   chan struct{}
+}
+
+var msgQueue = &sendQueue{
+	edits:    make(map[string]*sendItem),
+	sending:  make(map[string]bool),
+	cooldown: make(map[int64]time.Time),
+	notify:   make(chan struct{}, 1),
+}
 
 func initSender(senderNum int) {
-	msgQueue = make(chan tgbotapi.Chattable, senderNum*2)
 	for i := 0; i < senderNum; i++ {
 		go sender()
 	}
 }
 
-func addToSendQueue(msg tgbotapi.Chattable) {
-	msgQueue <- msg
+func addToSendQueue(msg tgbotapi.Chattable, priority sendPriority) {
+	msgQueue.push(newSendItem(msg, priority))
 	return
 }
 
+// SendQueueLen 查询发送队列中等待发送的消息数
+func SendQueueLen() int {
+	msgQueue.Lock()
+	defer msgQueue.Unlock()
+	num := 0
+	for _, lane := range msgQueue.lanes {
+		num += len(lane)
+	}
+	return num
+}
+
+func newSendItem(msg tgbotapi.Chattable, priority sendPriority) *sendItem {
+	item := &sendItem{msg: msg, priority: priority}
+	item.chatID, _ = requestChatID(msg)
+	switch edit := msg.(type) {
+	case tgbotapi.EditMessageTextConfig:
+		if edit.InlineMessageID == "" {
+			item.editKey = fmt.Sprintf("%d:%d", edit.ChatID, edit.MessageID)
+		}
+	}
+	return item
+}
+
+// push 加入队列
+//
+// 同一条消息的编辑只保留最新的一次；已有更高优先级的编辑等待发送时，丢弃新的进度更新
+func (q *sendQueue) push(item *sendItem) {
+	q.Lock()
+	if item.editKey != "" {
+		if old := q.edits[item.editKey]; old != nil {
+			if old.priority < item.priority {
+				q.Unlock()
+				return
+			}
+			if old.priority == item.priority {
+				old.msg = item.msg
+				q.Unlock()
+				return
+			}
+			q.remove(old)
+		}
+		q.edits[item.editKey] = item
+	}
+	if item.priority == priorityLow && len(q.lanes[priorityLow]) >= maxLowPriorityQueued {
+		q.Unlock()
+		return
+	}
+	q.lanes[item.priority] = append(q.lanes[item.priority], item)
+	q.Unlock()
+	q.wake()
+}
+
+// requeue 触发429后放回队首，期间已有更新的编辑时丢弃
+func (q *sendQueue) requeue(item *sendItem) {
+	q.Lock()
+	if item.editKey != "" {
+		if q.edits[item.editKey] != nil {
+			q.Unlock()
+			return
+		}
+		q.edits[item.editKey] = item
+	}
+	q.lanes[item.priority] = slices.Insert(q.lanes[item.priority], 0, item)
+	q.Unlock()
+	q.wake()
+}
+
+// pop 取出优先级最高且所在会话未被限流的消息，队列为空时阻塞
+func (q *sendQueue) pop() *sendItem {
+	for {
+		q.Lock()
+		now := time.Now()
+		var next time.Time
+		for p := range q.lanes {
+			for i := 0; i < len(q.lanes[p]); i++ {
+				item := q.lanes[p][i]
+				if item.editKey != "" && q.sending[item.editKey] {
+					continue
+				}
+				if until, ok := q.cooldown[item.chatID]; ok {
+					if now.Before(until) {
+						if item.priority == priorityLow {
+							q.remove(item)
+							i--
+						} else if next.IsZero() || until.Before(next) {
+							next = until
+						}
+						continue
+					}
+					delete(q.cooldown, item.chatID)
+				}
+				q.remove(item)
+				if item.editKey != "" {
+					q.sending[item.editKey] = true
+				}
+				q.Unlock()
+				//唤醒其他sender处理剩余的消息
+				q.wake()
+				return item
+			}
+		}
+		q.Unlock()
+
+		if next.IsZero() {
+			<-q.notify
+			continue
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-q.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (q *sendQueue) remove(item *sendItem) {
+	lane := q.lanes[item.priority]
+	if i := slices.Index(lane, item); i != -1 {
+		q.lanes[item.priority] = slices.Delete(lane, i, i+1)
+	}
+	if item.editKey != "" && q.edits[item.editKey] == item {
+		delete(q.edits, item.editKey)
+	}
+}
+
+// done 发送完成
+func (q *sendQueue) done(item *sendItem) {
+	if item.editKey == "" {
+		return
+	}
+	q.Lock()
+	delete(q.sending, item.editKey)
+	q.Unlock()
+	q.wake()
+}
+
+func (q *sendQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 会话被限流时等待至retry_after
+func (q *sendQueue) waitCooldown(chatID int64) {
+	q.Lock()
+	until, ok := q.cooldown[chatID]
+	q.Unlock()
+	if ok {
+		time.Sleep(time.Until(until))
+	}
+}
+
+// 记录Telegram返回的retry_after，返回是否为429
+func (q *sendQueue) recordRetryAfter(chatID int64, err error) bool {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) || tgErr.Code != 429 {
+		return false
+	}
+	retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+	if retryAfter <= 0 {
+		retryAfter = 10 * time.Second
+	}
+	q.setCooldown(chatID, time.Now().Add(retryAfter))
+	return true
+}
+
+// 在until之前不再发送该会话的消息
+func (q *sendQueue) setCooldown(chatID int64, until time.Time) {
+	q.Lock()
+	if until.After(q.cooldown[chatID]) {
+		q.cooldown[chatID] = until
+	}
+	q.Unlock()
+	q.wake()
+}
+
+// delay 会话令牌不足时推迟该会话的消息，pop期间跳过该会话，chat action直接丢弃
+func (q *sendQueue) delay(item *sendItem, wait time.Duration) {
+	q.setCooldown(item.chatID, time.Now().Add(wait))
+	if item.priority != priorityLow {
+		q.requeue(item)
+	}
+}
+
 func sender() {
 	for {
-		msg, _ := <-msgQueue
-		Limiter.Take()
-		resp, err := bot.Request(msg)
+		item := msgQueue.pop()
+		if wait := takeSend(item.msg); wait > 0 {
+			msgQueue.delay(item, wait)
+			msgQueue.done(item)
+			continue
+		}
+		resp, err := bot.Request(item.msg)
 		if err != nil {
 			logger.Error.Printf("%s[sender][%s]%s", loggerPrefix, err.Error(), JsonEncode(resp))
-			if resp != nil && resp.ErrorCode == 429 {
-				//Too Many Requests error
-				time.Sleep(10 * time.Second)
-				msgQueue <- msg
+			//Too Many Requests error
+			if msgQueue.recordRetryAfter(item.chatID, err) && item.priority != priorityLow {
+				msgQueue.requeue(item)
 			}
 		}
+		msgQueue.done(item)
 	}
 }
 
 func BotRequest(c tgbotapi.Chattable) error {
-	Limiter.Take()
+	waitSend(c)
 	_, err := bot.Request(c)
 	if err != nil {
 		logger.Error.Println(loggerPrefix + "[BotRequest]" + err.Error())
+		recordRetryAfter(c, err)
 	}
 	return err
 }
 
 func BotSend(c tgbotapi.Chattable) (tgbotapi.Message, error) {
-	Limiter.Take()
+	waitSend(c)
 	msg, err := bot.Send(c)
 	if err != nil {
 		logger.Error.Println(loggerPrefix + "[BotSend]" + err.Error())
+		recordRetryAfter(c, err)
 	}
 	return msg, err
 }
+
+// 同步请求触发429时同样限制该会话
+func recordRetryAfter(c tgbotapi.Chattable, err error) {
+	chatID, _ := requestChatID(c)
+	msgQueue.recordRetryAfter(chatID, err)
+}
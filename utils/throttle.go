@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/throttle"
+	"time"
+)
+
+// 调用Bot API前等待全局令牌
+//
+// TG官方对请求频率有限制，令牌桶由所有实例共享
+func waitAPI() {
+	_ = throttle.Wait(context.Background(), throttle.SendGlobal())
+}
+
+// 发送消息前等待全局及目标会话的令牌，会话被限流时等待至retry_after
+func waitSend(c tgbotapi.Chattable) {
+	if chatID, ok := requestChatID(c); ok {
+		msgQueue.waitCooldown(chatID)
+	}
+	buckets := []throttle.Bucket{throttle.SendGlobal()}
+	if chatID, ok := sendChatID(c); ok {
+		buckets = append(buckets, throttle.SendChat(chatID)...)
+	}
+	_ = throttle.Wait(context.Background(), buckets...)
+}
+
+// 发送队列使用，只等待全局令牌
+//
+// 目标会话的令牌不足时不等待，返回需要等待的时间，由调用方推迟该会话的消息，避免阻塞其他会话
+func takeSend(c tgbotapi.Chattable) time.Duration {
+	chatID, ok := sendChatID(c)
+	if !ok {
+		waitAPI()
+		return 0
+	}
+	global := throttle.SendGlobal()
+	buckets := append([]throttle.Bucket{global}, throttle.SendChat(chatID)...)
+	for {
+		wait, bucket := throttle.Take(context.Background(), 1, buckets...)
+		if wait == 0 {
+			return 0
+		}
+		if bucket.Key != global.Key {
+			return wait
+		}
+		time.Sleep(wait)
+	}
+}
+
+// 获取会产生新消息的请求的目标会话，编辑、删除消息等不计入
+func sendChatID(c tgbotapi.Chattable) (int64, bool) {
+	switch msg := c.(type) {
+	case tgbotapi.MessageConfig:
+		return msg.ChatID, true
+	case tgbotapi.StickerConfig:
+		return msg.ChatID, true
+	case tgbotapi.PhotoConfig:
+		return msg.ChatID, true
+	case tgbotapi.DocumentConfig:
+		return msg.ChatID, true
+	case tgbotapi.AnimationConfig:
+		return msg.ChatID, true
+	case tgbotapi.MediaGroupConfig:
+		return msg.ChatID, true
+	case tgbotapi.CopyMessageConfig:
+		return msg.ChatID, true
+	case tgbotapi.ForwardConfig:
+		return msg.ChatID, true
+	}
+	return 0, false
+}
+
+// 获取请求所属的会话，不属于任何会话时返回0
+func requestChatID(c tgbotapi.Chattable) (int64, bool) {
+	if chatID, ok := sendChatID(c); ok {
+		return chatID, true
+	}
+	switch msg := c.(type) {
+	case tgbotapi.EditMessageTextConfig:
+		return msg.ChatID, msg.InlineMessageID == ""
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return msg.ChatID, msg.InlineMessageID == ""
+	case tgbotapi.DeleteMessageConfig:
+		return msg.ChatID, true
+	case tgbotapi.ChatActionConfig:
+		return msg.ChatID, true
+	}
+	return 0, false
+}
@@ -0,0 +1,140 @@
+package webhook
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	tgbotapi "github.com/OvyFlash/telegram-bot-api"
+	"github.com/rroy233/StickerDownloader/config"
+	"gopkg.in/rroy233/logger.v2"
+	"net/http"
+	"time"
+)
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// 单个update的最大长度，正常的update远小于此值
+const maxUpdateSize = 1 << 20
+
+var server *http.Server
+
+// Handler 接收Telegram通过webhook推送的update
+//
+// 校验secret_token后将update写入Updates，交由worker处理；未设置SecretToken时拒绝所有请求
+type Handler struct {
+	SecretToken string
+	Updates     chan tgbotapi.Update
+}
+
+// NewHandler 创建webhook处理器
+//
+// bufferSize为Updates的缓冲区大小
+func NewHandler(secretToken string, bufferSize int) *Handler {
+	return &Handler{
+		SecretToken: secretToken,
+		Updates:     make(chan tgbotapi.Update, bufferSize),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.SecretToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(h.SecretToken)) != 1 {
+		logger.Warn.Println("[webhook]secret token mismatch from", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	update := tgbotapi.Update{}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpdateSize)
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		logger.Warn.Println("[webhook]failed to decode update:", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.Updates <- update:
+		w.WriteHeader(http.StatusOK)
+	case <-r.Context().Done():
+		//Telegram会在稍后重新推送
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// Start 启动webhook服务
+//
+// 若配置了Webhook.URL，则同时向Telegram注册webhook；
+// 多实例部署于反向代理之后时，可只在其中一个实例配置URL
+func Start(bot *tgbotapi.BotAPI) (tgbotapi.UpdatesChannel, error) {
+	cf := config.Get().Webhook
+
+	path := cf.Path
+	if path == "" {
+		path = "/webhook"
+	}
+	listenAddr := cf.ListenAddr
+	if listenAddr == "" {
+		listenAddr = ":8443"
+	}
+
+	if cf.URL != "" {
+		wh, err := tgbotapi.NewWebhook(cf.URL)
+		if err != nil {
+			return nil, err
+		}
+		wh.SecretToken = cf.SecretToken
+		wh.MaxConnections = cf.MaxConnections
+		if _, err = bot.Request(wh); err != nil {
+			return nil, err
+		}
+		logger.Info.Println("[webhook]setWebhook succeeded:", cf.URL)
+	}
+
+	handler := NewHandler(cf.SecretToken, 100)
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	server = &http.Server{
+		Addr:              listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if cf.TLS {
+			err = server.ListenAndServeTLS(cf.CertFile, cf.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.FATAL.Fatalln("[webhook]server error:", err)
+		}
+	}()
+	logger.Info.Printf("[webhook]Listening on %s%s (tls=%v)", listenAddr, path, cf.TLS)
+
+	return handler.Updates, nil
+}
+
+// Stop 停止接收webhook推送
+//
+// 不会删除Telegram端的webhook，以免影响其他实例
+func Stop() {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error.Println("[webhook]failed to shutdown server:", err)
+	}
+}
@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"context"
+	"gopkg.in/rroy233/logger.v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test_secret-token"
+
+func TestMain(m *testing.M) {
+	logger.New(&logger.Config{StdOutput: true})
+	m.Run()
+}
+
+func postUpdate(t *testing.T, url, token, body string) int {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(secretTokenHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	update := `{"update_id":1001,"message":{"message_id":1,"date":0,"chat":{"id":42,"type":"private"},"from":{"id":42,"is_bot":false,"first_name":"test"},"text":"/start"}}`
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		body   string
+		want   int
+		queued bool
+	}{
+		{name: "正确的token", secret: testSecret, token: testSecret, body: update, want: http.StatusOK, queued: true},
+		{name: "错误的token", secret: testSecret, token: "wrong", body: update, want: http.StatusUnauthorized},
+		{name: "缺少token", secret: testSecret, body: update, want: http.StatusUnauthorized},
+		{name: "未设置secret", secret: "", body: update, want: http.StatusUnauthorized},
+		{name: "无效的JSON", secret: testSecret, token: testSecret, body: `{"update_id":`, want: http.StatusBadRequest},
+		{name: "超出长度", secret: testSecret, token: testSecret, body: `{"update_id":1,"x":"` + strings.Repeat("a", maxUpdateSize) + `"}`, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(tt.secret, 1)
+			server := httptest.NewServer(h)
+			defer server.Close()
+
+			if got := postUpdate(t, server.URL, tt.token, tt.body); got != tt.want {
+				t.Fatalf("status = %d, want %d", got, tt.want)
+			}
+			select {
+			case u := <-h.Updates:
+				if !tt.queued {
+					t.Fatalf("unexpected update %d", u.UpdateID)
+				}
+				if u.UpdateID != 1001 || u.Message == nil || u.Message.From.ID != 42 || u.Message.Text != "/start" {
+					t.Fatalf("update = %+v", u)
+				}
+			default:
+				if tt.queued {
+					t.Fatal("update not queued")
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerMethod(t *testing.T) {
+	server := httptest.NewServer(NewHandler(testSecret, 1))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+// 缓冲区已满且请求被取消时返回503，由Telegram稍后重新推送
+func TestHandlerBufferFull(t *testing.T) {
+	h := NewHandler(testSecret, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"update_id":1}`)).WithContext(ctx)
+	req.Header.Set(secretTokenHeader, testSecret)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}